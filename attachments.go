@@ -0,0 +1,371 @@
+// Extracts attachments from an email and uploads them to S3 so that
+// they can be linked from the GitHub issue comment
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// attachment is a decoded attachment extracted from an email. If the
+// attachment was not kept (e.g. it was over the size cap), Data is nil
+// and Skipped holds the reason.
+type attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Size        int64
+	Data        []byte
+	Skipped     string
+}
+
+// attachmentLink is the outcome of uploading an attachment
+type attachmentLink struct {
+	Attachment attachment
+	URL        string
+	Err        error
+}
+
+// extractAttachments walks the MIME structure of msg and returns the
+// decoded attachments. Parts with an attachment disposition, a filename,
+// or a non-text content type are treated as attachments. Parts repeating
+// the Content-ID or content of an earlier part, such as a signature logo
+// quoted in every reply, are only returned once.
+//
+// Files larger than maxFile bytes, or that would take the total over
+// maxTotal bytes, are returned with Skipped set instead of their data.
+func extractAttachments(msg *mail.Message, maxFile, maxTotal int64) ([]attachment, error) {
+	var atts []attachment
+	var total int64
+	seenCIDs := map[string]bool{}
+	seenDigests := map[string]bool{}
+
+	// add records an attachment of the given decoded size, keeping its
+	// data if it is within the size caps
+	add := func(filename, mediatype, cid string, data []byte, size int64) {
+		if cid != "" {
+			if seenCIDs[cid] {
+				return
+			}
+			seenCIDs[cid] = true
+		}
+		if int64(len(data)) == size {
+			// the data is complete, so duplicates can be recognized
+			d := contentDigest(data)
+			if seenDigests[d] {
+				return
+			}
+			seenDigests[d] = true
+		}
+		if filename == "" {
+			filename = fmt.Sprintf("attachment-%d", len(atts)+1)
+		}
+		a := attachment{
+			Filename:    filename,
+			ContentType: mediatype,
+			ContentID:   cid,
+			Size:        size,
+		}
+		switch {
+		case size > maxFile:
+			a.Skipped = "exceeds per-file size limit"
+		case total+size > maxTotal:
+			a.Skipped = "exceeds per-message size limit"
+		default:
+			a.Data = data
+			total += size
+		}
+		atts = append(atts, a)
+	}
+
+	var walk func(h textprotoHeader, r io.Reader) error
+	walk = func(h textprotoHeader, r io.Reader) error {
+		ct := h.Get("Content-Type")
+		mediatype, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			// no/invalid content-type is text/plain, i.e. a body
+			return nil
+		}
+		if strings.HasPrefix(mediatype, "multipart/") {
+			mr := multipart.NewReader(r, params["boundary"])
+			for {
+				part, perr := mr.NextPart()
+				if perr == io.EOF {
+					return nil
+				}
+				if perr != nil {
+					return perr
+				}
+				if err := walk(part.Header, part); err != nil {
+					return err
+				}
+			}
+		}
+
+		if isSignature(mediatype) {
+			return nil
+		}
+
+		disp, _, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+		filename := partFilename(h)
+		if disp != "attachment" && filename == "" && strings.HasPrefix(mediatype, "text/") {
+			// body candidate
+			return nil
+		}
+		dec := decodeTransferEncoding(r, h.Get("Content-Transfer-Encoding"), nil)
+		if isTNEF(mediatype, filename) {
+			// list the files inside winmail.dat rather than winmail.dat
+			// itself, unless it cannot be decoded
+			data, err := io.ReadAll(io.LimitReader(dec, maxTotal+1))
+			if err != nil {
+				return fmt.Errorf("decode attachment %q: %w", filename, err)
+			}
+			if size := int64(len(data)); size > maxTotal {
+				n, _ := io.Copy(io.Discard, dec)
+				add(filename, mediatype, "", nil, size+n)
+				return nil
+			}
+			if m, err := decodeTNEF(data); err == nil {
+				for _, ta := range m.Attachments {
+					ctype := mime.TypeByExtension(path.Ext(ta.Filename))
+					if ctype == "" {
+						ctype = "application/octet-stream"
+					}
+					add(ta.Filename, ctype, "", ta.Data, int64(len(ta.Data)))
+				}
+				return nil
+			}
+			add(filename, mediatype, "", data, int64(len(data)))
+			return nil
+		}
+
+		data, err := io.ReadAll(io.LimitReader(dec, maxFile+1))
+		if err != nil {
+			return fmt.Errorf("decode attachment %q: %w", filename, err)
+		}
+		size := int64(len(data))
+		if size > maxFile {
+			n, _ := io.Copy(io.Discard, dec)
+			size += n
+		}
+		add(filename, mediatype, contentID(h.Get("Content-ID")), data, size)
+		return nil
+	}
+
+	if err := walk(msg.Header, msg.Body); err != nil {
+		return atts, err
+	}
+	return atts, nil
+}
+
+// isSignature reports whether mediatype is the signature part of a
+// multipart/signed message (S/MIME or PGP/MIME), which is not a
+// user-visible attachment
+func isSignature(mediatype string) bool {
+	switch mediatype {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature", "application/pgp-signature":
+		return true
+	}
+	return false
+}
+
+// textprotoHeader is satisfied by both mail.Header and textproto.MIMEHeader
+type textprotoHeader interface {
+	Get(key string) string
+}
+
+// sanitizeFilename makes a filename safe to use as part of an S3 key,
+// dropping any directory components and replacing characters outside
+// a conservative set with underscores
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		case r == '.' || r == '-' || r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	s := strings.Trim(b.String(), ".")
+	if s == "" {
+		return "attachment"
+	}
+	return s
+}
+
+// contentDigest returns the hex SHA-256 of data
+func contentDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// attachmentKey returns the S3 key for an attachment. Keys are addressed
+// by content, so that a file sent again (e.g. a logo in every reply of a
+// thread) is stored once.
+func attachmentKey(prefix string, data []byte, filename string) string {
+	return prefix + contentDigest(data) + "/" + sanitizeFilename(filename)
+}
+
+// uploadAttachments writes attachments to the attachment bucket, unless
+// they are already there, and returns a link for each. A failed upload
+// does not stop the others.
+func uploadAttachments(ctx context.Context, atts []attachment) []attachmentLink {
+	presigner := s3.NewPresignClient(s3Client)
+	links := make([]attachmentLink, 0, len(atts))
+	for _, a := range atts {
+		link := attachmentLink{Attachment: a}
+		if a.Skipped != "" {
+			links = append(links, link)
+			continue
+		}
+		key := attachmentKey(attachmentPrefix, a.Data, a.Filename)
+		contentType := a.ContentType
+		var err error
+		if _, herr := s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &attachmentBucket, Key: &key}); herr == nil {
+			log.Printf("attachment %s already uploaded", key)
+		} else {
+			_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:      &attachmentBucket,
+				Key:         &key,
+				Body:        bytes.NewReader(a.Data),
+				ContentType: &contentType,
+			})
+		}
+		if err != nil {
+			log.Printf("failed to upload attachment %s: %v", key, err)
+			link.Err = err
+			links = append(links, link)
+			continue
+		}
+		if attachmentPublicURL != "" {
+			link.URL = strings.TrimSuffix(attachmentPublicURL, "/") + "/" + (&url.URL{Path: key}).EscapedPath()
+		} else {
+			req, err := presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+				Bucket: &attachmentBucket,
+				Key:    &key,
+			}, s3.WithPresignExpires(7*24*time.Hour))
+			if err != nil {
+				link.Err = err
+			} else {
+				link.URL = req.URL
+			}
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// inlineImageURLs maps the Content-ID of each uploaded attachment to its URL
+func inlineImageURLs(links []attachmentLink) map[string]string {
+	urls := map[string]string{}
+	for _, l := range links {
+		if l.Attachment.ContentID != "" && l.URL != "" {
+			urls[l.Attachment.ContentID] = l.URL
+		}
+	}
+	return urls
+}
+
+// renderAttachmentLinks formats uploaded attachments as a markdown list
+// to be appended to the issue comment
+func renderAttachmentLinks(links []attachmentLink) string {
+	if len(links) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\n**Attachments:**\n\n")
+	for _, l := range links {
+		a := l.Attachment
+		switch {
+		case a.Skipped != "":
+			fmt.Fprintf(&b, "- %s (%s): not uploaded, %s\n", a.Filename, formatSize(a.Size), a.Skipped)
+		case l.Err != nil:
+			fmt.Fprintf(&b, "- %s (%s): upload failed\n", a.Filename, formatSize(a.Size))
+		case l.URL == "":
+			// listed only, uploads are not enabled
+			fmt.Fprintf(&b, "- %s (%s)\n", a.Filename, formatSize(a.Size))
+		default:
+			fmt.Fprintf(&b, "- [%s](%s) (%s)\n", a.Filename, l.URL, formatSize(a.Size))
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// formatSize renders a byte count in human readable units
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// withoutInlined returns the links of the attachments that are not shown
+// inline as text attachments, matching them by filename and content, or
+// by filename and size for a file that was not uploaded
+func withoutInlined(links []attachmentLink, inlined []textAttachment) []attachmentLink {
+	var out []attachmentLink
+	for _, l := range links {
+		a := l.Attachment
+		if !slices.ContainsFunc(inlined, func(t textAttachment) bool {
+			if t.Filename != a.Filename {
+				return false
+			}
+			if a.Data == nil {
+				return t.Size == a.Size
+			}
+			return t.Digest == contentDigest(a.Data)
+		}) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// codeFence returns a code fence for text, longer than any run of
+// backticks in it so that the text cannot close the block
+func codeFence(text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence
+}
+
+// renderTextAttachments formats text attachments as collapsible fenced
+// code blocks to be appended to the issue comment
+func renderTextAttachments(atts []textAttachment) string {
+	var b strings.Builder
+	for _, a := range atts {
+		text := strings.Trim(a.Text, "\n")
+		fence := codeFence(text)
+		fmt.Fprintf(&b, "\n\n<details>\n<summary>%s</summary>\n\n%s\n%s\n%s\n\n</details>",
+			html.EscapeString(a.Filename), fence, text, fence)
+	}
+	return b.String()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExtractAttachments(t *testing.T) {
+	pdf := "%PDF-1.4 pretend document"
+	raw := "Content-Type: multipart/mixed; boundary=B1\r\n\r\n" +
+		"--B1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"See attached\r\n" +
+		"--B1\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(pdf)) + "\r\n" +
+		"--B1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"caf=C3=A9\r\n" +
+		"--B1\r\n" +
+		"Content-Type: image/png\r\n\r\n" +
+		"not really a png\r\n" +
+		"--B1--\r\n"
+
+	atts, err := extractAttachments(mustMessage(t, raw), 1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(atts) != 3 {
+		t.Fatalf("expected 3 attachments, got %d: %+v", len(atts), atts)
+	}
+	if atts[0].Filename != "report.pdf" || string(atts[0].Data) != pdf {
+		t.Errorf("base64 attachment not decoded: %+v", atts[0])
+	}
+	if atts[1].Filename != "notes.txt" || string(atts[1].Data) != "café" {
+		t.Errorf("quoted-printable attachment not decoded: %+v", atts[1])
+	}
+	if atts[2].Filename != "attachment-3" || atts[2].ContentType != "image/png" {
+		t.Errorf("unexpected unnamed attachment: %+v", atts[2])
+	}
+}
+
+func TestExtractAttachments_SizeCaps(t *testing.T) {
+	part := func(name, body string) string {
+		return "--B1\r\n" +
+			"Content-Type: application/octet-stream\r\n" +
+			"Content-Disposition: attachment; filename=\"" + name + "\"\r\n\r\n" +
+			body + "\r\n"
+	}
+	raw := "Content-Type: multipart/mixed; boundary=B1\r\n\r\n" +
+		part("big.bin", strings.Repeat("x", 20)) +
+		part("a.bin", strings.Repeat("a", 8)) +
+		part("b.bin", strings.Repeat("b", 8)) +
+		"--B1--\r\n"
+
+	atts, err := extractAttachments(mustMessage(t, raw), 10, 12)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(atts) != 3 {
+		t.Fatalf("expected 3 attachments, got %d", len(atts))
+	}
+	if atts[0].Skipped == "" || atts[0].Data != nil || atts[0].Size != 20 {
+		t.Errorf("expected big.bin to be skipped for per-file cap: %+v", atts[0])
+	}
+	if atts[1].Skipped != "" || string(atts[1].Data) != "aaaaaaaa" {
+		t.Errorf("expected a.bin to be kept: %+v", atts[1])
+	}
+	if atts[2].Skipped == "" {
+		t.Errorf("expected b.bin to be skipped for per-message cap: %+v", atts[2])
+	}
+}
+
+func TestExtractAttachments_RFC2231Filenames(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=B1\r\n\r\n" +
+		"--B1\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment;\r\n" +
+		" filename*0*=UTF-8''Ma%C3%9F;\r\n" +
+		" filename*1*=nah;\r\n" +
+		" filename*2*=men.pdf\r\n\r\n" +
+		"pdf\r\n" +
+		"--B1\r\n" +
+		"Content-Type: text/plain; name*=iso-8859-1''%C4nderungen.txt\r\n" +
+		"Content-Disposition: attachment\r\n\r\n" +
+		"text\r\n" +
+		"--B1--\r\n"
+
+	atts, err := extractAttachments(mustMessage(t, raw), 1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, a := range atts {
+		got = append(got, a.Filename)
+	}
+	want := []string{"Maßnahmen.pdf", "Änderungen.txt"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("filenames: got=%q want=%q", got, want)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "report.pdf", want: "report.pdf"},
+		{in: "../../etc/passwd", want: "passwd"},
+		{in: `C:\Users\me\screen shot.png`, want: "screen_shot.png"},
+		{in: "résumé.docx", want: "r_sum_.docx"},
+		{in: "..", want: "attachment"},
+		{in: "", want: "attachment"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got := sanitizeFilename(tc.in)
+			if got != tc.want {
+				t.Errorf("sanitizeFilename mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentKey(t *testing.T) {
+	got := attachmentKey("mail/", []byte("hello\n"), "a b.txt")
+	want := "mail/5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03/a_b.txt"
+	if got != want {
+		t.Errorf("attachmentKey mismatch: got=%q want=%q", got, want)
+	}
+}
+
+func TestExtractAttachments_Duplicates(t *testing.T) {
+	logo := base64.StdEncoding.EncodeToString([]byte("\x89PNG pretend logo"))
+	image := func(cid, name, data string) string {
+		h := "--B1\r\n" +
+			"Content-Type: image/png; name=\"" + name + "\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n"
+		if cid != "" {
+			h += "Content-ID: <" + cid + ">\r\n"
+		}
+		return h + "\r\n" + data + "\r\n"
+	}
+	raw := "Content-Type: multipart/related; boundary=B1\r\n\r\n" +
+		"--B1\r\n" +
+		"Content-Type: text/html\r\n\r\n" +
+		"<p>Thanks</p><img src=\"cid:image001.png@01D9\">\r\n" +
+		image("image001.png@01D9", "image001.png", logo) +
+		// the same logo, quoted from an earlier reply
+		image("image001.png@01D8", "image001.png", logo) +
+		// a different image reusing the Content-ID
+		image("image001.png@01D9", "image002.png", base64.StdEncoding.EncodeToString([]byte("other"))) +
+		image("", "chart.png", base64.StdEncoding.EncodeToString([]byte("chart"))) +
+		"--B1--\r\n"
+
+	atts, err := extractAttachments(mustMessage(t, raw), 1024, 4096)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, a := range atts {
+		got = append(got, a.Filename)
+	}
+	if want := "image001.png,chart.png"; strings.Join(got, ",") != want {
+		t.Errorf("filenames: got=%q want=%q", strings.Join(got, ","), want)
+	}
+}
+
+func TestRenderAttachmentLinks(t *testing.T) {
+	links := []attachmentLink{
+		{Attachment: attachment{Filename: "a.png", Size: 2048}, URL: "https://example.com/a.png"},
+		{Attachment: attachment{Filename: "b.pdf", Size: 10}, Err: errors.New("access denied")},
+		{Attachment: attachment{Filename: "c.zip", Size: 30 << 20, Skipped: "exceeds per-file size limit"}},
+		{Attachment: attachment{Filename: "d.txt", Size: 5}},
+	}
+	got := renderAttachmentLinks(links)
+	want := "\n\n**Attachments:**\n\n" +
+		"- [a.png](https://example.com/a.png) (2.0 KB)\n" +
+		"- b.pdf (10 B): upload failed\n" +
+		"- c.zip (30.0 MB): not uploaded, exceeds per-file size limit\n" +
+		"- d.txt (5 B)"
+	if got != want {
+		t.Errorf("renderAttachmentLinks mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, want)
+	}
+	if renderAttachmentLinks(nil) != "" {
+		t.Errorf("expected no output for no attachments")
+	}
+}
+
+func TestRenderTextAttachments(t *testing.T) {
+	got := renderTextAttachments([]textAttachment{
+		{Filename: "error.log", Text: "line 1\nline 2\n"},
+		{Filename: "<notes>.txt", Text: "use ```go blocks"},
+	})
+	want := "\n\n<details>\n<summary>error.log</summary>\n\n```\nline 1\nline 2\n```\n\n</details>" +
+		"\n\n<details>\n<summary>&lt;notes&gt;.txt</summary>\n\n````\nuse ```go blocks\n````\n\n</details>"
+	if got != want {
+		t.Errorf("renderTextAttachments mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, want)
+	}
+	if renderTextAttachments(nil) != "" {
+		t.Errorf("expected no output for no attachments")
+	}
+}
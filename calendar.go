@@ -0,0 +1,219 @@
+// Summarizes text/calendar (iCalendar) invitations as markdown
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // TZIDs in invites need the zoneinfo database
+)
+
+// icsProperty is a single content line of an iCalendar object
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsEvent holds the properties of a VEVENT we render
+type icsEvent struct {
+	Summary     string
+	Start       icsProperty
+	End         icsProperty
+	Location    string
+	Organizer   icsProperty
+	Description string
+}
+
+// windowsZones maps the Windows time zone names used by Outlook and
+// Exchange in TZID parameters to IANA zone names
+var windowsZones = map[string]string{
+	"GMT Standard Time":            "Europe/London",
+	"Greenwich Standard Time":      "Atlantic/Reykjavik",
+	"W. Europe Standard Time":      "Europe/Berlin",
+	"Romance Standard Time":        "Europe/Paris",
+	"Central Europe Standard Time": "Europe/Budapest",
+	"E. Europe Standard Time":      "Europe/Chisinau",
+	"FLE Standard Time":            "Europe/Kiev",
+	"Eastern Standard Time":        "America/New_York",
+	"Central Standard Time":        "America/Chicago",
+	"Mountain Standard Time":       "America/Denver",
+	"Pacific Standard Time":        "America/Los_Angeles",
+	"India Standard Time":          "Asia/Kolkata",
+	"China Standard Time":          "Asia/Shanghai",
+	"Tokyo Standard Time":          "Asia/Tokyo",
+	"AUS Eastern Standard Time":    "Australia/Sydney",
+	"UTC":                          "UTC",
+}
+
+// parseICS unfolds and parses the content lines of an iCalendar object
+func parseICS(src string) []icsProperty {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	// unfold continuation lines, which start with a space or tab
+	src = strings.ReplaceAll(src, "\n ", "")
+	src = strings.ReplaceAll(src, "\n\t", "")
+
+	var props []icsProperty
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, "\r")
+		i := indexUnquoted(line, ':')
+		if i < 0 {
+			continue
+		}
+		p := icsProperty{Params: map[string]string{}, Value: line[i+1:]}
+		fields := strings.Split(line[:i], ";")
+		p.Name = strings.ToUpper(fields[0])
+		for _, f := range fields[1:] {
+			k, v, ok := strings.Cut(f, "=")
+			if ok {
+				p.Params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+			}
+		}
+		props = append(props, p)
+	}
+	return props
+}
+
+// indexUnquoted returns the index of the first c in s outside double quotes
+func indexUnquoted(s string, c byte) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == c && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+// icsUnescape decodes an iCalendar TEXT value
+func icsUnescape(v string) string {
+	r := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return r.Replace(v)
+}
+
+// firstEvent returns the first VEVENT in the calendar. For recurring
+// events this is the first occurrence, as RRULEs are not expanded.
+func firstEvent(props []icsProperty) (icsEvent, bool) {
+	var ev icsEvent
+	in, found := false, false
+	for _, p := range props {
+		switch {
+		case p.Name == "BEGIN" && strings.EqualFold(p.Value, "VEVENT"):
+			in, found = true, true
+		case p.Name == "END" && strings.EqualFold(p.Value, "VEVENT"):
+			return ev, true
+		case !in:
+			continue
+		case p.Name == "SUMMARY":
+			ev.Summary = icsUnescape(p.Value)
+		case p.Name == "DTSTART":
+			ev.Start = p
+		case p.Name == "DTEND":
+			ev.End = p
+		case p.Name == "LOCATION":
+			ev.Location = icsUnescape(p.Value)
+		case p.Name == "ORGANIZER":
+			ev.Organizer = p
+		case p.Name == "DESCRIPTION":
+			ev.Description = icsUnescape(p.Value)
+		}
+	}
+	return ev, found
+}
+
+// icsTime renders a DTSTART/DTEND property in a readable form with the
+// UTC offset of its time zone
+func icsTime(p icsProperty) string {
+	v := strings.TrimSpace(p.Value)
+	if v == "" {
+		return ""
+	}
+	if p.Params["VALUE"] == "DATE" || len(v) == 8 {
+		if t, err := time.Parse("20060102", v); err == nil {
+			return t.Format("2006-01-02") + " (all day)"
+		}
+		return v
+	}
+	const layout = "2006-01-02 15:04 (UTC-07:00)"
+	if strings.HasSuffix(v, "Z") {
+		if t, err := time.Parse("20060102T150405Z", v); err == nil {
+			return t.Format("2006-01-02 15:04 UTC")
+		}
+		return v
+	}
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		name := tzid
+		if iana, ok := windowsZones[tzid]; ok {
+			name = iana
+		}
+		l, err := time.LoadLocation(name)
+		if err != nil {
+			// unknown zone: show the local time with the zone name as given
+			if t, err := time.Parse("20060102T150405", v); err == nil {
+				return t.Format("2006-01-02 15:04") + " (" + tzid + ")"
+			}
+			return v
+		}
+		loc = l
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	if err != nil {
+		return v
+	}
+	return t.Format(layout)
+}
+
+// icsOrganizer renders ORGANIZER;CN=Name:mailto:addr as "Name <addr>"
+func icsOrganizer(p icsProperty) string {
+	addr := p.Value
+	if len(addr) >= 7 && strings.EqualFold(addr[:7], "mailto:") {
+		addr = addr[7:]
+	}
+	if cn := p.Params["CN"]; cn != "" && cn != addr {
+		return cn + " <" + addr + ">"
+	}
+	return addr
+}
+
+// calendarToMarkdown summarizes the first event of an iCalendar object as
+// a markdown bullet list. It returns an empty string if there is no event.
+func calendarToMarkdown(src string) string {
+	props := parseICS(src)
+	ev, ok := firstEvent(props)
+	if !ok {
+		return ""
+	}
+	title := "Calendar event"
+	for _, p := range props {
+		if p.Name == "METHOD" {
+			switch strings.ToUpper(p.Value) {
+			case "REQUEST":
+				title = "Calendar invitation"
+			case "CANCEL":
+				title = "Calendar cancellation"
+			}
+			break
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n\n", title)
+	item := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&b, "- **%s:** %s\n", k, v)
+		}
+	}
+	item("Summary", ev.Summary)
+	item("Start", icsTime(ev.Start))
+	item("End", icsTime(ev.End))
+	item("Location", ev.Location)
+	item("Organizer", icsOrganizer(ev.Organizer))
+	if d := strings.TrimSpace(ev.Description); d != "" {
+		b.WriteString("\n" + d + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
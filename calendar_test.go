@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testInvite = "BEGIN:VCALENDAR\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"PRODID:Microsoft Exchange Server 2010\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:GMT Standard Time\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"ORGANIZER;CN=\"Vimes, Sam\":mailto:sam.vimes@example.com\r\n" +
+	"DESCRIPTION;LANGUAGE=en-GB:Agenda:\\n1. Cluster outage\\n2. Next steps\\, if a\r\n" +
+	" ny\r\n" +
+	"RRULE:FREQ=WEEKLY;COUNT=4;BYDAY=TU\r\n" +
+	"SUMMARY;LANGUAGE=en-GB:Incident review\r\n" +
+	"DTSTART;TZID=GMT Standard Time:20240702T140000\r\n" +
+	"DTEND;TZID=GMT Standard Time:20240702T150000\r\n" +
+	"LOCATION;LANGUAGE=en-GB:Room 101\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestCalendarToMarkdown(t *testing.T) {
+	got := calendarToMarkdown(testInvite)
+	want := "**Calendar invitation**\n\n" +
+		"- **Summary:** Incident review\n" +
+		"- **Start:** 2024-07-02 14:00 (UTC+01:00)\n" +
+		"- **End:** 2024-07-02 15:00 (UTC+01:00)\n" +
+		"- **Location:** Room 101\n" +
+		"- **Organizer:** Vimes, Sam <sam.vimes@example.com>\n\n" +
+		"Agenda:\n1. Cluster outage\n2. Next steps, if any"
+	if got != want {
+		t.Errorf("calendarToMarkdown mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, want)
+	}
+}
+
+func TestICSTime(t *testing.T) {
+	tests := []struct {
+		name string
+		prop icsProperty
+		want string
+	}{
+		{
+			name: "utc",
+			prop: icsProperty{Value: "20240305T143000Z"},
+			want: "2024-03-05 14:30 UTC",
+		},
+		{
+			name: "iana tzid",
+			prop: icsProperty{Params: map[string]string{"TZID": "Asia/Kolkata"}, Value: "20240305T090000"},
+			want: "2024-03-05 09:00 (UTC+05:30)",
+		},
+		{
+			name: "all day",
+			prop: icsProperty{Params: map[string]string{"VALUE": "DATE"}, Value: "20240305"},
+			want: "2024-03-05 (all day)",
+		},
+		{
+			name: "unknown tzid",
+			prop: icsProperty{Params: map[string]string{"TZID": "Customized Time Zone"}, Value: "20240305T090000"},
+			want: "2024-03-05 09:00 (Customized Time Zone)",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := icsTime(tc.prop)
+			if got != tc.want {
+				t.Errorf("icsTime mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_Calendar(t *testing.T) {
+	alt := func(plain bool) string {
+		raw := "Content-Type: multipart/alternative; boundary=ALT\r\n\r\n"
+		if plain {
+			raw += "--ALT\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+				"Please join the review.\r\n"
+		}
+		return raw + "--ALT\r\n" +
+			"Content-Type: text/calendar; charset=utf-8; method=REQUEST\r\n\r\n" +
+			testInvite +
+			"--ALT--\r\n"
+	}
+
+	got, err := extractBodyAsMarkdown(mustMessage(t, alt(true)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(got, "Please join the review.\n\n**Calendar invitation**") {
+		t.Errorf("expected calendar summary after plain body: %q", got)
+	}
+
+	got, err = extractBodyAsMarkdown(mustMessage(t, alt(false)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(got, "**Calendar invitation**") || strings.Contains(got, "BEGIN:VEVENT") {
+		t.Errorf("expected calendar summary only: %q", got)
+	}
+}
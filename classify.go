@@ -0,0 +1,208 @@
+// Classifies automatically generated emails, such as bounces, which
+// should not be posted as issue comments
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// bounce describes a delivery status notification
+type bounce struct {
+	Reason           string   `json:"reason"`
+	FailedRecipients []string `json:"failed_recipients,omitempty"`
+}
+
+// detectBounce reports whether msg is a bounce (delivery status
+// notification) or another automatic message that should not be posted.
+// Bounces are recognized by a multipart/report content type with
+// report-type=delivery-status, by the null Return-Path used for
+// automatically generated mail, or by the header and "Undeliverable:"
+// subject of Exchange non-delivery reports, which are not always reports.
+// Outlook "Recall:" requests are also recognized. The message body is only
+// read (and consumed) for multipart/report messages and Exchange reports.
+func detectBounce(msg *mail.Message) (bounce, bool) {
+	mediatype, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	isReport := mediatype == "multipart/report" &&
+		strings.EqualFold(params["report-type"], "delivery-status")
+	if isReport {
+		b := bounce{Reason: "delivery-status report"}
+		b.FailedRecipients = failedRecipients(msg.Body, params["boundary"])
+		return b, true
+	}
+	if strings.TrimSpace(msg.Header.Get("Return-Path")) == "<>" {
+		return bounce{Reason: "null Return-Path"}, true
+	}
+	subject := decodeHeader(msg.Header.Get("Subject"))
+	if _, ok := msg.Header["X-Ms-Exchange-Message-Is-Ndr"]; ok || hasPrefixFold(subject, "Undeliverable:") {
+		b := bounce{Reason: "Exchange non-delivery report"}
+		if body, err := extractBodyAsMarkdown(msg); err == nil {
+			b.FailedRecipients = ndrRecipients(body)
+		}
+		return b, true
+	}
+	if hasPrefixFold(subject, "Recall:") && isFromOutlook(msg.Header) {
+		return bounce{Reason: "Outlook recall request"}, true
+	}
+	return bounce{}, false
+}
+
+// hasPrefixFold reports whether s begins with prefix, ignoring case
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// isFromOutlook reports whether a message was sent by Outlook or
+// Exchange, which add Thread-Index and X-MS-Exchange-* headers
+func isFromOutlook(h mail.Header) bool {
+	if h.Get("Thread-Index") != "" {
+		return true
+	}
+	for k := range h {
+		if strings.HasPrefix(k, "X-Ms-Exchange-") {
+			return true
+		}
+	}
+	return false
+}
+
+// ndrRecipientRes match the failed recipients in the text of an Exchange
+// non-delivery report, in its current and older wording
+var ndrRecipientRes = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)your message to\s+<?([^\s<>]+@[^\s<>]+?)>?\s+couldn't be delivered`),
+	regexp.MustCompile(`(?i)delivery has failed to these recipients or groups:\s+(?:[^\n]*?\(|<)?([^\s()<>]+@[^\s()<>]+)`),
+}
+
+// ndrRecipients returns the failed recipients named in the text of an
+// Exchange non-delivery report
+func ndrRecipients(body string) []string {
+	var failed []string
+	for _, re := range ndrRecipientRes {
+		for _, m := range re.FindAllStringSubmatch(body, -1) {
+			addr := strings.TrimRight(m[1], ".")
+			if !slices.Contains(failed, addr) {
+				failed = append(failed, addr)
+			}
+		}
+	}
+	return failed
+}
+
+// failedRecipients returns the Final-Recipient of each failed recipient
+// listed in the message/delivery-status part of a multipart/report
+func failedRecipients(r io.Reader, boundary string) []string {
+	var failed []string
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return failed
+		}
+		mediatype, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediatype != "message/delivery-status" {
+			continue
+		}
+		// the per-message fields are followed by a block of fields
+		// for each recipient, separated by blank lines
+		tp := textproto.NewReader(bufio.NewReader(part))
+		for {
+			fields, err := tp.ReadMIMEHeader()
+			if len(fields) > 0 && strings.EqualFold(fields.Get("Action"), "failed") {
+				rcpt := fields.Get("Final-Recipient")
+				if rcpt == "" {
+					rcpt = fields.Get("Original-Recipient")
+				}
+				// address type prefix, e.g. "rfc822; user@example.com"
+				if _, addr, ok := strings.Cut(rcpt, ";"); ok {
+					rcpt = addr
+				}
+				if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+					failed = append(failed, rcpt)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+}
+
+// commentMarkerRe matches the Message-ID line that starts our comments
+var commentMarkerRe = regexp.MustCompile(`(?m)^Message-ID: <[^>\s]+>`)
+
+// headerLoopReason reports why a message looks like one of our own
+// comments sent back to us, e.g. by a GitHub notification forwarded to
+// the ticket address, or "" if it does not. Messages are recognized by an
+// X-Loop header naming our ticket domain or a GitHub noreply sender. A
+// message whose References name a GitHub issue thread is a reply to a
+// notification, see extractReferencedTarget, and is not skipped.
+func headerLoopReason(h mail.Header) string {
+	for _, v := range h["X-Loop"] {
+		if ticketDomain != "" && strings.EqualFold(strings.TrimSpace(v), ticketDomain) {
+			return "X-Loop header"
+		}
+	}
+	if addr, err := addressParser.Parse(h.Get("From")); err == nil {
+		a := strings.ToLower(addr.Address)
+		if a == "notifications@github.com" || a == "noreply@github.com" || strings.HasSuffix(a, "noreply.github.com") {
+			return "sent by GitHub (" + a + ")"
+		}
+	}
+	return ""
+}
+
+// bodyLoopReason reports whether an extracted body contains the
+// Message-ID marker of one of our comments, or "" if it does not
+func bodyLoopReason(body string) string {
+	if m := commentMarkerRe.FindString(body); m != "" {
+		return "body contains comment marker " + m
+	}
+	return ""
+}
+
+// partial describes a message/partial fragment of a split message (RFC
+// 2046), which we cannot reassemble
+type partial struct {
+	ID     string
+	Number int
+	Total  int // 0 if not given, it is only required on the last fragment
+}
+
+// detectPartial reports whether a message is a message/partial fragment,
+// going by its Content-Type alone so that the body is never read
+func detectPartial(h mail.Header) (partial, bool) {
+	mediatype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || mediatype != "message/partial" {
+		return partial{}, false
+	}
+	p := partial{ID: params["id"]}
+	p.Number, _ = strconv.Atoi(params["number"])
+	p.Total, _ = strconv.Atoi(params["total"])
+	return p, true
+}
+
+// partialNotice is posted in place of the body of a message/partial fragment
+func partialNotice(p partial) string {
+	fragment := "a fragment"
+	switch {
+	case p.Number > 0 && p.Total > 0:
+		fragment = fmt.Sprintf("fragment %d of %d", p.Number, p.Total)
+	case p.Number > 0:
+		fragment = fmt.Sprintf("fragment %d", p.Number)
+	}
+	id := ""
+	if p.ID != "" {
+		id = fmt.Sprintf(" (id %q)", p.ID)
+	}
+	return fmt.Sprintf("Received %s of a split message%s, which cannot be processed. "+
+		"Please ask the sender to send it again without splitting it.", fragment, id)
+}
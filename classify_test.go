@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectBounce(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []string
+	}{
+		{fixture: "dsn-postfix.eml", want: []string{"nobody@unseen.ac.uk"}},
+		{fixture: "dsn-exchange.eml", want: []string{"rincewind@unseen.ac.uk"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			b, ok := detectBounce(mustFixture(t, tc.fixture))
+			if !ok {
+				t.Fatalf("expected %s to be classified as a bounce", tc.fixture)
+			}
+			if !reflect.DeepEqual(b.FailedRecipients, tc.want) {
+				t.Errorf("failed recipients mismatch: got=%q want=%q", b.FailedRecipients, tc.want)
+			}
+		})
+	}
+}
+
+func TestDetectBounce_Exchange(t *testing.T) {
+	tests := []struct {
+		fixture string
+		reason  string
+		want    []string
+	}{
+		{fixture: "exchange-ndr.eml", reason: "Exchange non-delivery report", want: []string{"librarian@unseen.ac.uk"}},
+		{fixture: "outlook-recall.eml", reason: "Outlook recall request"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			b, ok := detectBounce(mustFixture(t, tc.fixture))
+			if !ok {
+				t.Fatalf("expected %s to be skipped", tc.fixture)
+			}
+			if b.Reason != tc.reason || !reflect.DeepEqual(b.FailedRecipients, tc.want) {
+				t.Errorf("got %+v, want reason %q and failed recipients %q", b, tc.reason, tc.want)
+			}
+		})
+	}
+}
+
+func TestNDRRecipients(t *testing.T) {
+	body := "Delivery has failed to these recipients or groups:\n\n" +
+		"Librarian (librarian@unseen.ac.uk)\n" +
+		"The e-mail address you entered couldn't be found."
+	if got := ndrRecipients(body); !reflect.DeepEqual(got, []string{"librarian@unseen.ac.uk"}) {
+		t.Errorf("ndrRecipients mismatch: got=%q", got)
+	}
+}
+
+func TestDetectBounce_NotBounce(t *testing.T) {
+	if _, ok := detectBounce(mustFixture(t, "outlook-smime.eml")); ok {
+		t.Errorf("expected ordinary email not to be classified as a bounce")
+	}
+	// a recall of a message not sent from Outlook is ordinary mail
+	recall := "Subject: Recall: the 1990s\r\nContent-Type: text/plain\r\n\r\nRemember?\r\n"
+	if _, ok := detectBounce(mustMessage(t, recall)); ok {
+		t.Errorf("expected a subject starting Recall: alone not to be skipped")
+	}
+	raw := "Return-Path: <>\r\nContent-Type: text/plain\r\n\r\nAuto reply\r\n"
+	if _, ok := detectBounce(mustMessage(t, raw)); !ok {
+		t.Errorf("expected null Return-Path to be classified as a bounce")
+	}
+}
+
+func TestLoopReason_GitHubNotification(t *testing.T) {
+	setupTests(t)
+	msg := mustFixture(t, "github-notification.eml")
+	if reason := headerLoopReason(msg.Header); reason == "" {
+		t.Errorf("expected GitHub notification to be detected as a mail loop")
+	}
+	body, err := extractBodyAsMarkdown(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reason := bodyLoopReason(body); reason != "body contains comment marker Message-ID: <CAF1x2y3z@mail.example.com>" {
+		t.Errorf("unexpected body loop reason %q", reason)
+	}
+}
+
+func TestHeaderLoopReason(t *testing.T) {
+	setupTests(t)
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "ordinary email",
+			header: "From: Alice <alice@example.com>\r\nReferences: <CAF1x2y3z@mail.example.com>\r\n",
+			want:   "",
+		},
+		{
+			name:   "X-Loop",
+			header: "From: Alice <alice@example.com>\r\nX-Loop: issues.example.com\r\n",
+			want:   "X-Loop header",
+		},
+		{
+			name:   "GitHub noreply sender",
+			header: "From: alice-example <12345+alice-example@users.noreply.github.com>\r\n",
+			want:   "sent by GitHub (12345+alice-example@users.noreply.github.com)",
+		},
+		{
+			// dispatched to the issue, see extractReferencedTarget
+			name: "reply to a notification",
+			header: "From: Alice <alice@example.com>\r\n" +
+				"References: <CAF1x2y3z@mail.example.com> <OxfordRSE/ticket-dispatcher/issues/123@github.com>\r\n",
+			want: "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := mustMessage(t, tc.header+"\r\nbody\r\n")
+			if got := headerLoopReason(msg.Header); got != tc.want {
+				t.Errorf("headerLoopReason mismatch: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBodyLoopReason_OrdinaryBody(t *testing.T) {
+	body := "Please see the Message-ID: header of the bounced email.\n\nMessage-ID: not a marker"
+	if reason := bodyLoopReason(body); reason != "" {
+		t.Errorf("unexpected loop reason %q", reason)
+	}
+}
+
+func TestDetectPartial(t *testing.T) {
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"Content-Type: message/partial; id=\"ABC@host.example.com\";\r\n" +
+		"\tnumber=2; total=5\r\n\r\n" +
+		"=?garbage that must not be decoded\r\n"
+	msg := mustMessage(t, raw)
+	p, ok := detectPartial(msg.Header)
+	if !ok {
+		t.Fatal("expected a message/partial fragment")
+	}
+	want := partial{ID: "ABC@host.example.com", Number: 2, Total: 5}
+	if p != want {
+		t.Errorf("detectPartial mismatch: got=%+v want=%+v", p, want)
+	}
+	notice := partialNotice(p)
+	if !strings.Contains(notice, `fragment 2 of 5 of a split message (id "ABC@host.example.com")`) {
+		t.Errorf("unexpected notice %q", notice)
+	}
+	if _, err := extractBodyAsMarkdown(msg); err != errPartial {
+		t.Errorf("expected errPartial, got %v", err)
+	}
+
+	if _, ok := detectPartial(mustMessage(t, "Content-Type: text/plain\r\n\r\nhi\r\n").Header); ok {
+		t.Error("text/plain detected as a fragment")
+	}
+	if got := partialNotice(partial{Number: 3}); !strings.HasPrefix(got, "Received fragment 3 of a split message, ") {
+		t.Errorf("unexpected notice without total or id: %q", got)
+	}
+}
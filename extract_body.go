@@ -4,100 +4,854 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
 	"regexp"
+	"slices"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/net/html/charset"
 )
 
+// errNoTextPart is returned when a multipart message contains no
+// text/plain or text/html part. The ExtractedEmail returned with it still
+// lists the message's attachments.
+var errNoTextPart = errors.New("no text part found")
+
+// ErrPartTooLarge is returned by readAndDecodePart, along with the text
+// up to the limit, for parts larger than maxDecodedBytes once decoded
+var ErrPartTooLarge = errors.New("part too large")
+
+// defaultMaxDecodedBytes is the default limit on the decoded size of a
+// text part, so that a small but deeply encoded or huge part cannot
+// exhaust memory
+const defaultMaxDecodedBytes = 4 << 20
+
+// defaultMaxInlineTextBytes is the default limit on the size of text
+// attachments shown inline
+const defaultMaxInlineTextBytes = 20 << 10
+
+// defaultMaxDigestMessages is the default limit on the number of messages
+// of a multipart/digest that are shown
+const defaultMaxDigestMessages = 20
+
+// DecodeTimeoutError is returned when the context passed to ExtractEmail
+// is cancelled or its deadline passes. Part is the index of the part that
+// was being decoded, counting from 1 in the order the parts appear in the
+// message (a forwarded message counts as one part), or 0 if it stopped
+// before the first part.
+type DecodeTimeoutError struct {
+	Part int
+	Err  error
+}
+
+func (e *DecodeTimeoutError) Error() string {
+	return fmt.Sprintf("decoding part %d: %v", e.Part, e.Err)
+}
+
+func (e *DecodeTimeoutError) Unwrap() error { return e.Err }
+
+// decodeTimeout returns err as a DecodeTimeoutError for the given part if
+// ctx is done, otherwise err unchanged
+func decodeTimeout(ctx context.Context, part int, err error) error {
+	var te *DecodeTimeoutError
+	if err == nil || ctx.Err() == nil || errors.As(err, &te) {
+		return err
+	}
+	return &DecodeTimeoutError{Part: part, Err: ctx.Err()}
+}
+
+// ctxCheckBytes is how often, in bytes read, decoding checks whether its
+// context is done
+const ctxCheckBytes = 64 << 10
+
+// ctxReader is a Reader that fails with the context's error once it is
+// done, checking every ctxCheckBytes
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int // bytes read since the last check
+}
+
+func newCtxReader(ctx context.Context, r io.Reader) *ctxReader {
+	return &ctxReader{ctx: ctx, r: r, n: ctxCheckBytes}
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if c.n >= ctxCheckBytes {
+		if err := c.ctx.Err(); err != nil {
+			return 0, err
+		}
+		c.n = 0
+	}
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// errEncrypted is returned for PGP/MIME (multipart/encrypted) messages,
+// whose contents cannot be read
+var errEncrypted = errors.New("message is encrypted")
+
+// errPartial is returned for message/partial fragments of a split
+// message, which are not reassembled
+var errPartial = errors.New("message is a fragment of a split message")
+
+// ExtractedEmail is the result of extracting the body of a message
+type ExtractedEmail struct {
+	// Body is the message text as markdown
+	Body string
+	// SourceType is the media type of the part Body was taken from, e.g.
+	// text/plain, and Charset the charset it declared
+	SourceType string
+	Charset    string
+	// Attachments are the parts not used for the body, such as
+	// attachments and inline images
+	Attachments []AttachmentMeta
+	// TextAttachments are small text attachments to be shown inline,
+	// collected if inlineTextAttachments is set
+	TextAttachments []textAttachment
+	// BodyFromAttachment is set if Body is the text of a single-part
+	// message sent as an attachment, which is also listed in Attachments
+	BodyFromAttachment bool
+	// Truncated is set if the message ended part way through
+	Truncated bool
+	// Warnings describe problems that did not stop the extraction
+	Warnings []string
+}
+
+// AttachmentMeta describes a part that was not used for the body
+type AttachmentMeta struct {
+	Filename    string
+	ContentType string
+}
+
+// images returns the names of the image attachments
+func (e ExtractedEmail) images() []string {
+	var names []string
+	for _, a := range e.Attachments {
+		if strings.HasPrefix(a.ContentType, "image/") {
+			names = append(names, a.Filename)
+		}
+	}
+	return names
+}
+
+// textAttachment is a decoded text attachment. Size and Digest are those
+// of the file before its charset is converted, as extractAttachments
+// returns it, so that it is not also listed as an attachment.
+type textAttachment struct {
+	Filename string
+	Text     string
+	Size     int64
+	Digest   string
+}
+
+// inlineImage describes an image part referenced from HTML by Content-ID.
+// URL is set when the image has been uploaded.
+type inlineImage struct {
+	Name string
+	URL  string
+}
+
 // extractBodyAsMarkdown parses an RFC822 message (net/mail.Message) and returns
 // the best-effort Markdown:
-//   - prefer text/plain (used as-is, trimmed)
+//   - prefer text/plain (used as-is, trimmed), unless PREFER_HTML is set
+//     or it is a short stub of the text/html part
 //   - else transform text/html -> markdown
+//   - else transform text/rtf -> markdown
 //
-// Attachments (Content-Disposition: attachment) are skipped.
+// Forwarded messages (message/rfc822) are appended after the body.
+// Other attachments (Content-Disposition: attachment) are skipped.
 func extractBodyAsMarkdown(msg *mail.Message) (string, error) {
+	e, err := ExtractEmail(context.Background(), msg)
+	return e.Body, err
+}
+
+// ExtractEmail extracts the body of msg as extractBodyAsMarkdown does,
+// along with the type of the part it came from and the attachments, so
+// that a message with attachments but no text can be told apart from an
+// empty one. If ctx is done before the extraction finishes, it returns a
+// *DecodeTimeoutError.
+func ExtractEmail(ctx context.Context, msg *mail.Message) (ExtractedEmail, error) {
+	return extractEmail(ctx, msg, nil)
+}
+
+// extractEmail is ExtractEmail, additionally substituting uploaded URLs
+// (keyed by Content-ID) for cid: images in HTML bodies
+func extractEmail(ctx context.Context, msg *mail.Message, imageURLs map[string]string) (ExtractedEmail, error) {
+	return extractBody(ctx, msg, imageURLs, 0)
+}
+
+// maxForwardDepth limits how deeply forwarded (message/rfc822) messages
+// nested inside each other are extracted
+const maxForwardDepth = 3
+
+// A text/plain part shorter than shortPlainChars is replaced by the
+// text/html alternative if that is at least htmlToPlainRatio times longer,
+// as some mailers send only a stub in text/plain
+const (
+	shortPlainChars  = 200
+	htmlToPlainRatio = 5
+)
+
+// extractBody extracts the body of msg, which is nested inside depth
+// levels of forwarded messages
+func extractBody(ctx context.Context, msg *mail.Message, imageURLs map[string]string, depth int) (ExtractedEmail, error) {
 	ct := msg.Header.Get("Content-Type")
 	cte := msg.Header.Get("Content-Transfer-Encoding")
 	mediatype, params, err := mime.ParseMediaType(ct)
 	if err != nil {
-		// If no/invalid content-type assume simple text/plain
-		buf := new(strings.Builder)
-		_, _ = io.Copy(buf, msg.Body)
-		return strings.TrimSpace(buf.String()), nil
+		// If no/invalid content-type assume simple text/plain, in
+		// whatever charset the bytes look like
+		buf := new(bytes.Buffer)
+		if _, err := io.Copy(buf, newCtxReader(ctx, msg.Body)); err != nil {
+			return ExtractedEmail{}, decodeTimeout(ctx, 1, err)
+		}
+		text := normalizeLineEndings(convertCharset(buf.Bytes(), ""))
+		return ExtractedEmail{Body: strings.TrimSpace(string(text)), SourceType: "text/plain"}, nil
+	}
+
+	if mediatype == "multipart/encrypted" {
+		return ExtractedEmail{}, errEncrypted
+	}
+	if mediatype == "message/partial" {
+		return ExtractedEmail{}, errPartial
 	}
 
 	if strings.HasPrefix(mediatype, "multipart/") {
-		boundary := params["boundary"]
-		if boundary == "" {
-			return "", fmt.Errorf("multipart without boundary")
-		}
-		mr := multipart.NewReader(msg.Body, boundary)
-		// Collect first text/plain, else first text/html
-		var firstHTML string
-		for {
-			part, perr := mr.NextPart()
-			if perr == io.EOF {
-				break
+		if params["boundary"] == "" {
+			return ExtractedEmail{}, fmt.Errorf("multipart without boundary")
+		}
+		w := &bodyWalker{ctx: ctx, images: map[string]inlineImage{}, depth: depth}
+		if err := w.walkMultipart(msg.Body, mediatype, params["boundary"]); err != nil {
+			return ExtractedEmail{}, decodeTimeout(ctx, w.parts, err)
+		}
+		if err := ctx.Err(); err != nil {
+			// e.g. while decoding a forwarded message in the last part
+			return ExtractedEmail{}, &DecodeTimeoutError{Part: w.parts, Err: err}
+		}
+		res, err := w.result(imageURLs)
+		res.Warnings = w.warnings
+		return res, decodeTimeout(ctx, w.htmlPart, err)
+	}
+
+	// not multipart: single part message
+	if !strings.HasPrefix(mediatype, "text/") && mediatype != "application/rtf" {
+		// a lone PDF, image etc. is an attachment with no text
+		return ExtractedEmail{Attachments: []AttachmentMeta{{Filename: partFilename(msg.Header), ContentType: mediatype}}}, nil
+	}
+	if disp, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Disposition")); disp == "attachment" {
+		res, err := extractAttachedBody(ctx, msg, mediatype, params)
+		return res, decodeTimeout(ctx, 1, err)
+	}
+	var warnings []string
+	bodyBytes, err := readAndDecodePart(ctx, msg.Body, ct, cte, func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	})
+	tooLarge := errors.Is(err, ErrPartTooLarge)
+	if tooLarge {
+		warnings = append(warnings, fmt.Sprintf("%s body larger than %d bytes when decoded, truncated", mediatype, maxDecodedBytes))
+		bodyBytes = append(bytes.TrimRight(bodyBytes, " \t\n"), truncatedMarker(mediatype)...)
+		err = nil
+	}
+	if err != nil {
+		return ExtractedEmail{}, decodeTimeout(ctx, 1, err)
+	}
+	text, err := convertText(ctx, mediatype, bodyBytes)
+	if err != nil {
+		return ExtractedEmail{}, decodeTimeout(ctx, 1, err)
+	}
+	return ExtractedEmail{
+		Body:       text,
+		SourceType: mediatype,
+		Charset:    params["charset"],
+		Truncated:  tooLarge,
+		Warnings:   warnings,
+	}, nil
+}
+
+// extractAttachedBody extracts a single-part text message sent with an
+// attachment disposition, as some scanners do. The file is listed as an
+// attachment, and its text is the body if it is no larger than
+// maxInlineTextBytes.
+func extractAttachedBody(ctx context.Context, msg *mail.Message, mediatype string, params map[string]string) (ExtractedEmail, error) {
+	res := ExtractedEmail{
+		Attachments:        []AttachmentMeta{{Filename: partFilename(msg.Header), ContentType: mediatype}},
+		BodyFromAttachment: true,
+	}
+	b, err := readAndDecodePartLimit(ctx, msg.Body, msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"), maxInlineTextBytes, func(format string, args ...any) {
+			res.Warnings = append(res.Warnings, fmt.Sprintf(format, args...))
+		})
+	if errors.Is(err, ErrPartTooLarge) {
+		res.Warnings = []string{fmt.Sprintf("attached %s body larger than %d bytes, listing it only", mediatype, maxInlineTextBytes)}
+		return res, nil
+	}
+	if err != nil {
+		return ExtractedEmail{}, err
+	}
+	res.Body, err = convertText(ctx, mediatype, b)
+	if err != nil {
+		return ExtractedEmail{}, err
+	}
+	res.SourceType, res.Charset = mediatype, params["charset"]
+	return res, nil
+}
+
+// convertText converts a decoded single text part to markdown
+func convertText(ctx context.Context, mediatype string, b []byte) (string, error) {
+	switch mediatype {
+	case "text/html":
+		return convertHTML(ctx, string(b), nil, htmlOptions)
+	case "text/rtf", "application/rtf":
+		return rtfToPlain(string(b))
+	case "text/calendar":
+		if text := calendarToMarkdown(string(b)); text != "" {
+			return text, nil
+		}
+	}
+	// text/plain or other text -> return as text
+	return unwrapURLs(strings.TrimSpace(string(b))), nil
+}
+
+// truncatedMarker is appended to a text part cut at maxDecodedBytes
+func truncatedMarker(mediatype string) string {
+	return partNote(mediatype, "… truncated, this part is larger than "+formatSize(maxDecodedBytes)+" when decoded")
+}
+
+// partNote is a note appended to a text part, in HTML for text/html parts
+// so that it is converted with the rest
+func partNote(mediatype, note string) string {
+	if mediatype == "text/html" {
+		return "<p><em>" + note + "</em></p>"
+	}
+	return "\n\n_" + note + "_"
+}
+
+// bodyWalker collects the first text/plain, text/html and text/rtf parts of a
+// multipart message, along with the inline images the HTML may reference,
+// a calendar invite summary and any forwarded messages
+type bodyWalker struct {
+	ctx context.Context
+	// parts counts the parts visited, and htmlPart is the index of the
+	// text/html part used, for DecodeTimeoutError
+	parts        int
+	htmlPart     int
+	plain        string
+	havePlain    bool
+	plainCharset string
+	html         string
+	haveHTML     bool
+	htmlCharset  string
+	rtf          string
+	haveRTF      bool
+	rtfCharset   string
+	images       map[string]inlineImage // by Content-ID
+	calendar     string
+	tnefBody     string
+	tnefFailed   bool
+	forwards     []string
+	encrypted    bool
+	depth        int
+	// attachments are the parts skipped as attachments or images
+	attachments []AttachmentMeta
+	warnings    []string
+	// truncated is set if the message ended part way through, cut if
+	// a text part was cut at maxDecodedBytes
+	truncated       bool
+	cut             bool
+	textAttachments []textAttachment
+	// levels numbers the multiparts visited, so that text chunks
+	// separated by images in the same multipart/mixed can be joined
+	levels     int
+	plainLevel int
+	htmlLevel  int
+	between    []string // placeholders for parts after the last text chunk
+	// digest holds the messages of a multipart/digest, up to
+	// maxDigestMessages of the digestCount seen
+	digest      []string
+	digestCount int
+}
+
+// result chooses the body from the parts collected by walkMultipart
+func (w *bodyWalker) result(imageURLs map[string]string) (ExtractedEmail, error) {
+	res := ExtractedEmail{Attachments: w.attachments, TextAttachments: w.textAttachments, Truncated: w.truncated || w.cut}
+	if w.truncated {
+		if !w.havePlain && !w.haveHTML && !w.haveRTF && w.tnefBody == "" {
+			return res, fmt.Errorf("message truncated before a text part: %w", io.ErrUnexpectedEOF)
+		}
+		w.warn("message is truncated, using the parts before the end")
+	}
+	var htmlText string
+	var err error
+	if w.haveHTML && (!w.havePlain || preferHTML || utf8.RuneCountInString(w.plain) < shortPlainChars) {
+		// HTML is needed for the body, or to compare with a short
+		// plain text part
+		for cid, u := range imageURLs {
+			img := w.images[cid]
+			img.URL = u
+			w.images[cid] = img
+		}
+		htmlText, err = convertHTML(w.ctx, w.html, w.images, htmlOptions)
+		if err != nil && (!w.havePlain || w.ctx.Err() != nil) {
+			return res, err
+		}
+		if err != nil {
+			w.warn("failed to convert text/html part, using text/plain: %v", err)
+			w.haveHTML = false
+		}
+	}
+	var body string
+	switch {
+	case w.tnefBody != "":
+		// the stub text part of a TNEF message is superseded by the
+		// body inside winmail.dat
+		body = w.tnefBody
+		res.SourceType = "application/ms-tnef"
+	case w.havePlain && w.haveHTML && preferHTML:
+		log.Printf("using text/html part instead of text/plain: PREFER_HTML is set")
+		body = htmlText
+		res.SourceType, res.Charset = "text/html", w.htmlCharset
+	case w.havePlain && w.haveHTML && utf8.RuneCountInString(w.plain) < shortPlainChars &&
+		utf8.RuneCountInString(htmlText) >= htmlToPlainRatio*utf8.RuneCountInString(w.plain):
+		// e.g. a "View this message in your browser" stub
+		log.Printf("using text/html part instead of text/plain: text/plain is %d characters, text/html %d",
+			utf8.RuneCountInString(w.plain), utf8.RuneCountInString(htmlText))
+		body = htmlText
+		res.SourceType, res.Charset = "text/html", w.htmlCharset
+	case w.havePlain:
+		body = unwrapURLs(w.plain)
+		res.SourceType, res.Charset = "text/plain", w.plainCharset
+	case w.haveHTML:
+		// If we saw HTML but no plain text, convert HTML -> markdown
+		body = htmlText
+		res.SourceType, res.Charset = "text/html", w.htmlCharset
+	case w.haveRTF:
+		body, err = rtfToPlain(w.rtf)
+		if err != nil {
+			return res, err
+		}
+		res.SourceType, res.Charset = "text/rtf", w.rtfCharset
+	case len(w.forwards) == 0 && w.digestCount == 0 && w.encrypted:
+		return res, errEncrypted
+	case len(w.forwards) == 0 && w.digestCount == 0 && w.calendar == "" && !w.tnefFailed:
+		// walked the whole structure without finding a text part
+		return res, errNoTextPart
+	}
+	if w.tnefFailed {
+		body = appendSection(body, "_A winmail.dat attachment could not be decoded._")
+	}
+	// calendar invites and forwarded messages follow the sender's own text
+	body = appendSection(body, w.calendar)
+	for _, f := range w.forwards {
+		body = appendSection(body, f)
+	}
+	body = appendSection(body, w.digestText())
+	if res.SourceType == "" {
+		switch {
+		case w.calendar != "":
+			res.SourceType = "text/calendar"
+		case len(w.forwards) > 0:
+			res.SourceType = "message/rfc822"
+		case w.digestCount > 0:
+			res.SourceType = "multipart/digest"
+		}
+	}
+	res.Body = body
+	return res, nil
+}
+
+// warn records a problem that does not stop the extraction
+func (w *bodyWalker) warn(format string, args ...any) {
+	w.warnings = append(w.warnings, fmt.Sprintf(format, args...))
+}
+
+// isTruncated reports whether err is from a multipart body that ends
+// without its closing boundary
+func isTruncated(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// walkMultipart visits the parts of a multipart body, descending into
+// nested multiparts
+func (w *bodyWalker) walkMultipart(r io.Reader, mediatype, boundary string) error {
+	w.levels++
+	level := w.levels
+	mixed := mediatype == "multipart/mixed"
+	mr := multipart.NewReader(r, boundary)
+	for {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		part, perr := mr.NextPart()
+		if perr == io.EOF {
+			break
+		}
+		if isTruncated(perr) {
+			// the message ends without its closing boundary
+			w.truncated = true
+			return nil
+		}
+		if perr != nil {
+			return perr
+		}
+		w.parts++
+		pct := part.Header.Get("Content-Type")
+		pcte := part.Header.Get("Content-Transfer-Encoding")
+		if pct == "" && mediatype == "multipart/digest" {
+			// the parts of a digest default to message/rfc822 (RFC 2046)
+			pct = "message/rfc822"
+		}
+		ptype, pparams, _ := mime.ParseMediaType(pct)
+		name := partFilename(part.Header)
+		if cid := contentID(part.Header.Get("Content-ID")); cid != "" && !strings.HasPrefix(ptype, "text/") {
+			imgName := name
+			if imgName == "" {
+				imgName = cid
 			}
-			pct := part.Header.Get("Content-Type")
-			pcte := part.Header.Get("Content-Transfer-Encoding")
-			ptype, pparams, _ := mime.ParseMediaType(pct)
-			if perr != nil {
-				return "", perr
+			w.images[cid] = inlineImage{Name: imgName}
+		}
+		if ptype == "message/rfc822" && mediatype == "multipart/digest" {
+			w.digestMessage(part, pcte)
+			continue
+		}
+		// forwarded emails are usually attachments, so check before skipping
+		if ptype == "message/rfc822" {
+			if f := w.forwarded(part, pcte); f != "" {
+				w.forwards = append(w.forwards, f)
+			}
+			continue
+		}
+		if isTNEF(ptype, part.FileName()) {
+			w.tnef(part, pcte)
+			continue
+		}
+		// skip signatures and attachments
+		if isSignature(ptype) {
+			continue
+		}
+		// any part with a filename is an attachment whatever its
+		// disposition (Apple Mail marks pasted images inline), except
+		// calendar invites which are summarized
+		disp := strings.ToLower(part.Header.Get("Content-Disposition"))
+		if strings.HasPrefix(disp, "attachment") || (name != "" && ptype != "text/calendar") {
+			w.skipped(level, ptype, name)
+			if inlineTextAttachments && isInlineText(ptype) {
+				w.textAttachment(part, pct, pcte)
 			}
-			// skip attachments
-			if disp := strings.ToLower(part.Header.Get("Content-Disposition")); strings.HasPrefix(disp, "attachment") {
+			continue
+		}
+		switch ptype {
+		case "text/plain":
+			// text following an inline image in the same multipart/mixed
+			// (as sent by Apple Mail) continues the body
+			more := mixed && w.havePlain && w.plainLevel == level
+			if w.havePlain && !more {
 				continue
 			}
-			switch ptype {
-			case "text/plain":
-				b, e := readAndDecodePart(part, pct, pcte)
-				if e != nil {
-					return "", e
-				}
-				return strings.TrimSpace(string(b)), nil
-			case "text/html":
-				b, e := readAndDecodePart(part, pct, pcte)
-				if e != nil {
-					return "", e
-				}
-				firstHTML = string(b)
-			case "multipart/alternative", "multipart/related", "multipart/mixed":
-				mr = multipart.NewReader(part, pparams["boundary"])
+			b, ok, e := w.readText(part, pct, pcte)
+			if e != nil {
+				return e
+			}
+			if !ok {
 				continue
-			default:
-				return "", errors.New("no text part found")
 			}
+			if more {
+				w.plain = appendSection(w.plain, strings.Join(w.between, "\n"))
+				w.plain = appendSection(w.plain, strings.TrimSpace(string(b)))
+			} else {
+				w.plain = strings.TrimSpace(string(b))
+				w.havePlain = true
+				w.plainCharset = pparams["charset"]
+				w.plainLevel = level
+			}
+			w.between = nil
+		case "text/html":
+			more := mixed && w.haveHTML && w.htmlLevel == level
+			if w.haveHTML && !more {
+				continue
+			}
+			b, ok, e := w.readText(part, pct, pcte)
+			if e != nil {
+				return e
+			}
+			if !ok {
+				continue
+			}
+			if more {
+				// images between the chunks are referenced by cid: URLs
+				w.html += "\n" + string(b)
+			} else {
+				w.html = string(b)
+				w.haveHTML = true
+				w.htmlPart = w.parts
+				w.htmlCharset = pparams["charset"]
+				w.htmlLevel = level
+			}
+		case "multipart/alternative", "multipart/related", "multipart/mixed", "multipart/signed", "multipart/digest":
+			// the content of a multipart/signed is its first part, the
+			// signature part that follows is skipped below
+			if err := w.walkMultipart(part, ptype, pparams["boundary"]); err != nil {
+				return err
+			}
+		case "text/rtf", "application/rtf":
+			if w.haveRTF || w.havePlain {
+				continue
+			}
+			b, ok, e := w.readText(part, pct, pcte)
+			if e != nil {
+				return e
+			}
+			if !ok {
+				continue
+			}
+			w.rtf = string(b)
+			w.haveRTF = true
+			w.rtfCharset = pparams["charset"]
+		case "text/calendar":
+			if w.calendar != "" {
+				continue
+			}
+			b, ok, e := w.readText(part, pct, pcte)
+			if e != nil {
+				return e
+			}
+			if !ok {
+				continue
+			}
+			w.calendar = calendarToMarkdown(string(b))
+		case "multipart/encrypted":
+			w.encrypted = true
+		default:
+			// images, PDFs etc. without attachment disposition; a text
+			// part may still follow, so keep scanning
+			log.Printf("skipping non-text part: %s", pct)
+			w.skipped(level, ptype, name)
 		}
-		// If we saw HTML but no plain text, convert HTML -> markdown
-		if firstHTML != "" {
-			return htmlToPlain(firstHTML)
+	}
+	return nil
+}
+
+// readText reads and decodes a text part. Parts over maxDecodedBytes are
+// cut at the limit and marked as truncated.
+func (w *bodyWalker) readText(r io.Reader, ct, cte string) (b []byte, ok bool, err error) {
+	b, err = readAndDecodePart(w.ctx, r, ct, cte, w.warn)
+	if isTruncated(err) {
+		w.truncated = true
+		return nil, false, nil
+	}
+	if errors.Is(err, ErrPartTooLarge) {
+		mediatype, _, _ := mime.ParseMediaType(ct)
+		w.warn("%s part larger than %d bytes when decoded, truncated", mediatype, maxDecodedBytes)
+		w.cut = true
+		return append(bytes.TrimRight(b, " \t\n"), truncatedMarker(mediatype)...), true, nil
+	}
+	return b, err == nil, err
+}
+
+// skipped records a part that is not used for the body. If it follows a
+// text/plain chunk in the same multipart, a placeholder for it is kept in
+// case more text follows.
+func (w *bodyWalker) skipped(level int, mediatype, name string) {
+	w.attachments = append(w.attachments, AttachmentMeta{Filename: name, ContentType: mediatype})
+	if !w.havePlain || w.plainLevel != level {
+		return
+	}
+	kind := "attachment"
+	if strings.HasPrefix(mediatype, "image/") {
+		kind = "inline image"
+	}
+	if name == "" {
+		name = mediatype
+	}
+	w.between = append(w.between, fmt.Sprintf("[%s: %s]", kind, name))
+}
+
+// isInlineText reports whether an attachment of the given media type
+// can be shown inline as text
+func isInlineText(mediatype string) bool {
+	return mediatype == "text/plain" || strings.HasPrefix(mediatype, "text/x-")
+}
+
+// textAttachment decodes a text attachment to be shown inline. Files over
+// maxInlineTextBytes, or that are not text after decoding, are left out.
+func (w *bodyWalker) textAttachment(part *multipart.Part, ct, cte string) {
+	name := partFilename(part.Header)
+	if name == "" {
+		name = fmt.Sprintf("attachment-%d", len(w.attachments))
+	}
+	raw, err := io.ReadAll(io.LimitReader(decodeTransferEncoding(part, cte, w.warn), maxInlineTextBytes+1))
+	if err != nil {
+		log.Printf("not inlining %s: %v", name, err)
+		return
+	}
+	b, err := readAndDecodePartLimit(w.ctx, bytes.NewReader(raw), ct, "", maxInlineTextBytes, nil)
+	if errors.Is(err, ErrPartTooLarge) {
+		log.Printf("not inlining %s: larger than %d bytes", name, maxInlineTextBytes)
+		return
+	}
+	if err != nil {
+		log.Printf("not inlining %s: %v", name, err)
+		return
+	}
+	if !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0 {
+		log.Printf("not inlining %s: not text", name)
+		return
+	}
+	w.textAttachments = append(w.textAttachments, textAttachment{
+		Filename: name,
+		Text:     string(b),
+		Size:     int64(len(raw)),
+		Digest:   contentDigest(raw),
+	})
+}
+
+// tnef extracts the body of a TNEF (winmail.dat) part. If it cannot be
+// decoded, this is noted and the message's other text parts are used.
+func (w *bodyWalker) tnef(r io.Reader, cte string) {
+	// winmail.dat holds the attachments too, so allow it to be as large
+	// as the attachments
+	limit := max(maxDecodedBytes, maxAttachmentsBytes)
+	data, err := io.ReadAll(io.LimitReader(decodeTransferEncoding(r, cte, w.warn), limit+1))
+	if err == nil && int64(len(data)) > limit {
+		err = ErrPartTooLarge
+	}
+	var m *tnefMessage
+	if err == nil {
+		m, err = decodeTNEF(data)
+	}
+	if err != nil {
+		w.warn("failed to decode winmail.dat: %v", err)
+		w.tnefFailed = true
+		return
+	}
+	switch {
+	case strings.TrimSpace(m.Body) != "":
+		w.tnefBody = strings.TrimSpace(m.Body)
+	case m.HTML != "":
+		body, err := convertHTML(w.ctx, m.HTML, nil, htmlOptions)
+		if err != nil {
+			w.warn("failed to convert winmail.dat HTML body: %v", err)
+			return
+		}
+		w.tnefBody = body
+	case m.RTFCompressed != nil:
+		rtf, err := decompressRTF(m.RTFCompressed)
+		if err == nil {
+			w.tnefBody, err = rtfToPlain(string(rtf))
+		}
+		if err != nil {
+			w.warn("failed to convert winmail.dat RTF body: %v", err)
 		}
-		// no useful body found
-		return "", nil
 	}
+}
 
-	// not multipart: single part message
-	bodyBytes, err := readAndDecodePart(msg.Body, ct, cte)
+// forwarded extracts a message/rfc822 part and renders it with a short
+// header giving the original sender, subject and date
+func (w *bodyWalker) forwarded(r io.Reader, cte string) string {
+	return w.nested(r, cte, "Forwarded message")
+}
+
+// digestMessage extracts a message of a multipart/digest, keeping the
+// first maxDigestMessages
+func (w *bodyWalker) digestMessage(r io.Reader, cte string) {
+	w.digestCount++
+	if int64(w.digestCount) > maxDigestMessages {
+		return
+	}
+	if m := w.nested(r, cte, fmt.Sprintf("Digest message %d", w.digestCount)); m != "" {
+		w.digest = append(w.digest, m)
+	}
+}
+
+// digestText joins the messages of a digest with horizontal rules, noting
+// how many were left out
+func (w *bodyWalker) digestText() string {
+	text := strings.Join(w.digest, "\n\n---\n\n")
+	if int64(w.digestCount) > maxDigestMessages {
+		text = appendSection(text, fmt.Sprintf("_Showing the first %d of %d digest messages._",
+			maxDigestMessages, w.digestCount))
+	}
+	return text
+}
+
+// nested renders a message nested in a message/rfc822 part under a title,
+// with its From, Subject and Date and its extracted body
+func (w *bodyWalker) nested(r io.Reader, cte, title string) string {
+	if w.depth >= maxForwardDepth {
+		log.Printf("skipping %s nested deeper than %d", strings.ToLower(title), maxForwardDepth)
+		return "**" + title + "** (not shown, nested too deeply)"
+	}
+	inner, err := mail.ReadMessage(decodeTransferEncoding(r, cte, w.warn))
 	if err != nil {
-		return "", err
+		w.warn("failed to parse %s: %v", strings.ToLower(title), err)
+		return ""
+	}
+	body, err := extractBody(w.ctx, inner, nil, w.depth+1)
+	if w.ctx.Err() != nil {
+		// walkMultipart stops at the next part
+		return ""
+	}
+	if err != nil && err != errNoTextPart {
+		w.warn("failed to extract %s body: %v", strings.ToLower(title), err)
+	}
+	w.warnings = append(w.warnings, body.Warnings...)
+
+	var b strings.Builder
+	b.WriteString("**" + title + "**\n\n")
+	for _, k := range []string{"From", "Subject", "Date"} {
+		if v := inner.Header.Get(k); v != "" {
+			fmt.Fprintf(&b, "- **%s:** %s\n", k, decodeHeader(v))
+		}
+	}
+	if body.Body != "" {
+		b.WriteString("\n" + body.Body)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// noContentLineRe matches lines with no content of their own: inline
+// image placeholders and the signatures of mobile mail apps
+var noContentLineRe = regexp.MustCompile(`^(\[(inline )?image( \d+)?(: [^\]]*)?\]|Sent from my \w+(\s\w+)?)$`)
+
+// hasTextContent reports whether an extracted body has any text beyond
+// whitespace, image placeholders and a "Sent from my iPhone" signature
+func hasTextContent(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if l := strings.TrimSpace(line); l != "" && !noContentLineRe.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendSection appends a section to body, separated by a blank line
+func appendSection(body, section string) string {
+	if section == "" {
+		return body
 	}
-	ptype, _, _ := mime.ParseMediaType(ct)
-	if ptype == "text/html" {
-		return htmlToPlain(string(bodyBytes))
+	if strings.TrimSpace(body) == "" {
+		return section
 	}
-	// default: text/plain or other -> return as text
-	return strings.TrimSpace(string(bodyBytes)), nil
+	return body + "\n\n" + section
+}
+
+// contentID normalizes a Content-ID header value (or the target of a cid:
+// URL) by stripping angle brackets and whitespace
+func contentID(v string) string {
+	return strings.Trim(strings.TrimSpace(v), "<>")
 }
 
 // readAndDecodePart reads from the raw part Reader (r) and decodes:
@@ -105,34 +859,190 @@ func extractBodyAsMarkdown(msg *mail.Message) (string, error) {
 //   - Charset -> UTF-8 conversion based on Content-Type header
 //
 // contentType should be the raw Content-Type header value for charset parsing.
-func readAndDecodePart(r io.Reader, contentType, cteHeader string) ([]byte, error) {
+// Reading stops with the context's error once ctx is done. Problems with
+// the transfer encoding that are worked around are reported with warn.
+func readAndDecodePart(ctx context.Context, r io.Reader, contentType, cteHeader string, warn func(format string, args ...any)) ([]byte, error) {
+	return readAndDecodePartLimit(ctx, r, contentType, cteHeader, maxDecodedBytes, warn)
+}
+
+// readAndDecodePartLimit is readAndDecodePart with a limit on the decoded
+// size of the part. If it is exceeded, the text up to the limit is
+// returned with ErrPartTooLarge; the rest of the part is not read.
+func readAndDecodePartLimit(ctx context.Context, r io.Reader, contentType, cteHeader string, limit int64, warn func(format string, args ...any)) ([]byte, error) {
 	// Step 1: decode Content-Transfer-Encoding (cte)
 	// cteHeader is typically part.Header.Get("Content-Transfer-Encoding")
-	cte := strings.ToLower(strings.TrimSpace(cteHeader))
-	var decodedReader io.Reader = r
+	decodedReader := decodeTransferEncoding(r, cteHeader, warn)
 
-	switch cte {
-	case "quoted-printable":
-		decodedReader = quotedprintable.NewReader(r)
-	case "base64":
-		decodedReader = base64.NewDecoder(base64.StdEncoding, r)
-	default:
-		// 7bit, 8bit, binary, or absent -> use as-is
-		decodedReader = r
-	}
-
-	// Step 2: read into a buffer (we'll wrap with charset converter next)
-	bufReader := bufio.NewReader(decodedReader)
+	// Step 2: read into a buffer (we'll wrap with charset converter next),
+	// up to limit
+	bufReader := bufio.NewReader(io.LimitReader(newCtxReader(ctx, decodedReader), limit+1))
 	rawBytes, err := io.ReadAll(bufReader)
 	if err != nil {
 		return nil, err
 	}
+	var tooLarge error
+	if int64(len(rawBytes)) > limit {
+		rawBytes, tooLarge = trimPartialRune(rawBytes[:limit]), ErrPartTooLarge
+	}
 
 	// Step 3: charset conversion to UTF-8 using contentType
-	_, params, _ := mime.ParseMediaType(contentType)
-	charsetLabel := strings.ToLower(strings.TrimSpace(params["charset"]))
+	mediatype, params, _ := mime.ParseMediaType(contentType)
+	label := params["charset"]
+	if label == "" && mediatype == "text/html" {
+		// HTML may declare its charset only in a <meta> tag
+		label = htmlMetaCharset(rawBytes)
+	}
+	text := normalizeLineEndings(convertCharset(rawBytes, label))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Step 4: rejoin lines wrapped by format=flowed (RFC 3676)
+	if mediatype == "text/plain" && strings.EqualFold(params["format"], "flowed") {
+		text = []byte(unflowText(string(text), strings.EqualFold(params["delsp"], "yes")))
+	}
+
+	// Step 5: remove byte order marks and zero-width characters. For HTML
+	// this is done per text node by htmlToPlain, keeping <pre> verbatim.
+	if mediatype == "text/html" {
+		text = bytes.TrimPrefix(text, []byte("\ufeff"))
+	} else {
+		text = []byte(stripInvisible(string(text)))
+	}
+
+	// Step 6: say where the transfer encoding could not be decoded
+	note := ""
+	switch d := decodedReader.(type) {
+	case *base64Reader:
+		if d.invalid {
+			note = "… cut short, the rest of this part is not valid base64"
+		}
+	case *qpReader:
+		if d.raw > 0 {
+			note = "some lines of this part are not valid quoted-printable and are shown as sent"
+		}
+	}
+	if note != "" && tooLarge == nil {
+		text = append(bytes.TrimRight(text, " \t\n"), partNote(mediatype, note)...)
+	}
+	return text, tooLarge
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence from the end of b,
+// left by cutting it at a byte limit
+func trimPartialRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// normalizeLineEndings converts CRLF and bare CR line endings to LF
+func normalizeLineEndings(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\r"), []byte("\n"))
+}
+
+// invisibleChars removes characters that are invisible but break markdown
+// parsing and text comparison: byte order marks, zero-width spaces and
+// joiners (injected by e.g. Outlook safe links) and soft hyphens
+var invisibleChars = strings.NewReplacer(
+	"\ufeff", "",
+	"\u200b", "",
+	"\u200c", "",
+	"\u200d", "",
+	"\u00ad", "",
+)
+
+// bidiControls removes the explicit bidirectional embedding, override and
+// isolate characters, which can reorder the text around them to disguise
+// it (e.g. a file name or a command). Right-to-left text does not need
+// them, its direction comes from its letters.
+var bidiControls = strings.NewReplacer(
+	"\u202a", "",
+	"\u202b", "",
+	"\u202c", "",
+	"\u202d", "",
+	"\u202e", "",
+	"\u2066", "",
+	"\u2067", "",
+	"\u2068", "",
+	"\u2069", "",
+)
+
+// stripInvisible removes invisibleChars from s, except inside fenced
+// code blocks which are kept verbatim
+func stripInvisible(s string) string {
+	lines := strings.Split(s, "\n")
+	inFence := false
+	for i, ln := range lines {
+		clean := invisibleChars.Replace(ln)
+		if strings.HasPrefix(strings.TrimSpace(clean), "```") {
+			inFence = !inFence
+			lines[i] = clean
+			continue
+		}
+		if !inFence {
+			lines[i] = clean
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// convertCharset converts rawBytes from the named charset to UTF-8. If no
+// charset is given and the bytes are not valid UTF-8, the charset is
+// detected. If the result is still not valid UTF-8, e.g. Windows-1252
+// labelled as UTF-8, decoding is retried with the fallback charset.
+func convertCharset(rawBytes []byte, label string) []byte {
+	charsetLabel := strings.ToLower(strings.TrimSpace(label))
+	if charsetLabel == "" && !utf8.Valid(rawBytes) {
+		// older clients omit the charset of Windows-1252/Latin-1 text
+		_, name, _ := charset.DetermineEncoding(rawBytes, "")
+		log.Printf("no charset declared and body is not UTF-8, detected %s", name)
+		charsetLabel = name
+	}
+	out := decodeCharset(rawBytes, charsetLabel)
+	if utf8.Valid(out) && utf8.Valid(rawBytes) {
+		// valid UTF-8 is kept as it is, form feeds and escape sequences
+		// of pasted logs included
+		return bytes.ReplaceAll(out, []byte{0}, []byte("\uFFFD"))
+	}
+	if utf8.Valid(out) {
+		return replaceBinary(out)
+	}
+	fallback := fallbackCharset
+	if fallback == "" {
+		_, fallback, _ = charset.DetermineEncoding(rawBytes, "")
+	}
+	log.Printf("body declared as %q is not valid UTF-8, retrying as %s", charsetLabel, fallback)
+	return replaceBinary(decodeCharset(rawBytes, fallback))
+}
+
+// replaceBinary replaces invalid UTF-8 and control characters other than
+// whitespace, as found in binary data sent as text, with U+FFFD so that
+// the text is safe to post. It is only used for bytes that were not valid
+// UTF-8; in valid UTF-8 only NULs, which GitHub rejects, are replaced.
+func replaceBinary(b []byte) []byte {
+	b = bytes.ToValidUTF8(b, []byte("\uFFFD"))
+	return bytes.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f') || r == 0x7f {
+			return utf8.RuneError
+		}
+		return r
+	}, b)
+}
+
+// decodeCharset converts rawBytes from the named charset to UTF-8. If the
+// charset is unknown or conversion fails, rawBytes is returned unchanged.
+func decodeCharset(rawBytes []byte, charsetLabel string) []byte {
+	charsetLabel = strings.ToLower(strings.TrimSpace(charsetLabel))
 	if charsetLabel == "" || charsetLabel == "utf-8" || charsetLabel == "us-ascii" {
-		return rawBytes, nil
+		return rawBytes
 	}
 
 	// Use charset.NewReaderLabel which returns a reader that converts to UTF-8.
@@ -140,49 +1050,304 @@ func readAndDecodePart(r io.Reader, contentType, cteHeader string) ([]byte, erro
 	cr, err := charset.NewReaderLabel(charsetLabel, strings.NewReader(string(rawBytes)))
 	if err != nil {
 		// If conversion fails, return the raw bytes rather than fail hard.
-		return rawBytes, nil
+		return rawBytes
 	}
 	convBytes, err := io.ReadAll(cr)
 	if err != nil {
-		return rawBytes, nil
+		return rawBytes
+	}
+	return convBytes
+}
+
+// unflowText decodes a format=flowed body (RFC 3676): lines ending in a
+// space are joined with the next line of the same quote depth, and
+// space-stuffing is removed. With delsp, the trailing space of flowed
+// lines is deleted. Quoted lines are written with a "> " prefix per depth,
+// and the "-- " signature separator is never joined.
+func unflowText(s string, delsp bool) string {
+	var out []string
+	var cur strings.Builder
+	depth, open := 0, false
+	flush := func() {
+		prefix := ""
+		if depth > 0 {
+			prefix = strings.Repeat(">", depth) + " "
+		}
+		out = append(out, prefix+cur.String())
+		cur.Reset()
+		open = false
+	}
+
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	for _, ln := range lines {
+		ln = strings.TrimSuffix(ln, "\r")
+		d := 0
+		for d < len(ln) && ln[d] == '>' {
+			d++
+		}
+		content := strings.TrimPrefix(ln[d:], " ") // space-stuffing
+		if open && d != depth {
+			// a change in quote depth ends a flowed paragraph
+			flush()
+		}
+		if !open {
+			depth, open = d, true
+		}
+		if content != "-- " && strings.HasSuffix(content, " ") {
+			if delsp {
+				content = content[:len(content)-1]
+			}
+			cur.WriteString(content)
+			continue
+		}
+		cur.WriteString(content)
+		flush()
+	}
+	if open {
+		flush()
+	}
+	return strings.Join(out, "\n")
+}
+
+// decodeTransferEncoding wraps r with a decoder for the given
+// Content-Transfer-Encoding header value (quoted-printable, base64).
+// Problems with the encoding that the decoder works around are reported
+// with warn, or logged if it is nil.
+func decodeTransferEncoding(r io.Reader, cteHeader string, warn func(format string, args ...any)) io.Reader {
+	if warn == nil {
+		warn = logWarning
+	}
+	switch strings.ToLower(strings.TrimSpace(cteHeader)) {
+	case "quoted-printable":
+		return &qpReader{br: bufio.NewReader(r), warn: warn}
+	case "base64":
+		return &base64Reader{br: bufio.NewReader(r), warn: warn}
+	default:
+		// 7bit, 8bit, binary, or absent -> use as-is
+		return r
+	}
+}
+
+// logWarning logs a problem that is not reported with the body
+func logWarning(format string, args ...any) {
+	log.Printf("warning: "+format, args...)
+}
+
+// base64Reader decodes base64 leniently: whitespace is skipped, padding
+// ends a quantum wherever it is, as in bodies whose lines are padded
+// separately, and missing padding is tolerated. At the first character
+// that is not base64 the stream ends with a warning, so that whatever was
+// decoded before it is kept.
+type base64Reader struct {
+	br      *bufio.Reader
+	warn    func(format string, args ...any)
+	quantum []byte
+	out     []byte
+	err     error
+	invalid bool // the input had a character that is not base64
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.out) < len(p) && b.err == nil {
+		c, err := b.br.ReadByte()
+		switch {
+		case err == io.EOF:
+			b.flush()
+			b.err = io.EOF
+		case err != nil:
+			b.err = err
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '=':
+			b.flush()
+		case isBase64Char(c):
+			b.quantum = append(b.quantum, c)
+			if len(b.quantum) == 4 {
+				b.flush()
+			}
+		default:
+			b.flush()
+			b.warn("invalid base64 input (%q), the rest of the part is left out", c)
+			b.invalid = true
+			b.err = io.EOF
+		}
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, b.err
+}
+
+// flush decodes the quantum read so far, which padding may have cut
+// short. A single character holds less than a byte and is dropped.
+func (b *base64Reader) flush() {
+	if len(b.quantum) >= 2 {
+		dec, _ := base64.RawStdEncoding.DecodeString(string(b.quantum))
+		b.out = append(b.out, dec...)
+	}
+	b.quantum = b.quantum[:0]
+}
+
+func isBase64Char(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/'
+}
+
+// qpReader decodes quoted-printable input a line at a time. A line that
+// is not valid quoted-printable (e.g. one with raw control characters
+// from a broken mailer) is passed through raw, with a warning, instead of
+// failing the whole body. A literal "=ZZ" is kept by the decoder itself.
+type qpReader struct {
+	br   *bufio.Reader
+	warn func(format string, args ...any)
+	buf  []byte
+	err  error
+	raw  int // number of lines passed through raw
+}
+
+func (q *qpReader) Read(p []byte) (int, error) {
+	for len(q.buf) == 0 {
+		if q.err != nil {
+			return 0, q.err
+		}
+		line, err := q.br.ReadBytes('\n')
+		q.err = err
+		dec, derr := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(line)))
+		if derr != nil {
+			if q.raw == 0 {
+				q.warn("invalid quoted-printable input, keeping such lines undecoded: %v", derr)
+			}
+			q.raw++
+			dec = line
+		}
+		q.buf = dec
 	}
-	return convBytes, nil
+	n := copy(p, q.buf)
+	q.buf = q.buf[n:]
+	return n, nil
 }
 
 func hasLetter(s string) bool {
 	return strings.ContainsFunc(s, unicode.IsLetter)
 }
 
-// hideQuotedPart scans plain/markdown text for quoted email context and,
-// if found, moves it into a collapsible <details> block.
-func hideQuotedPart(md string, removeQuotes bool) string {
-	if strings.TrimSpace(md) == "" {
-		return md
+// defaultMinReplyChars is the default number of letters and digits below
+// which a reply that quotes earlier messages is not posted
+const defaultMinReplyChars = 1
+
+// isEmptyReply reports whether p is a reply that adds nothing to the
+// messages it quotes: fewer than minChars letters and digits of its own
+// and no attachments, as mobile clients send by accident
+func isEmptyReply(p QuotedParts, hasAttachments bool, minChars int) bool {
+	if p.Quoted == "" || hasAttachments {
+		return false
+	}
+	n := 0
+	for _, r := range p.Visible {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			n++
+		}
 	}
+	return n < minChars
+}
+
+// defaultQuoteMinLines is the default number of lines quoted with ">"
+// that start the quoted part of a message
+const defaultQuoteMinLines = 3
+
+// defaultQuotePatterns match lines that start the quoted part of a message
+// besides the reply headers isReplyHeader recognizes
+var defaultQuotePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^Begin forwarded message:`), // Begin forwarded message:
+}
+
+// quoteOptions controls how hideQuotedPart finds the quoted part of a
+// message
+type quoteOptions struct {
+	// minLines lines quoted with ">", maybe with blank lines between
+	// them, start the quoted part
+	minLines int
+	// patterns match lines that start the quoted part. The reply headers
+	// of mail clients are recognized too unless replacePatterns is set.
+	patterns        []*regexp.Regexp
+	replacePatterns bool
+}
+
+// defaultQuoteOptions returns the options of hideQuotedPart used unless
+// the environment sets others
+func defaultQuoteOptions() quoteOptions {
+	return quoteOptions{minLines: defaultQuoteMinLines, patterns: defaultQuotePatterns}
+}
+
+// quotedTextMode is what is done with the quoted part of a message
+type quotedTextMode string
+
+// values of QUOTED_TEXT_MODE
+const (
+	// quotedRemove removes the quoted messages
+	quotedRemove quotedTextMode = "remove"
+	// quotedCollapse moves them into a collapsible <details> block
+	quotedCollapse quotedTextMode = "collapse"
+	// quotedKeep posts the message as it is, quotes and all
+	quotedKeep quotedTextMode = "keep"
+)
+
+// hideQuotedPart scans plain/markdown text for quoted email context and,
+// if found, removes it or moves it into a collapsible <details> block
+// depending on mode. Quoted messages recognized by htmlToPlain start at
+// its quotedEmailMarker.
+func hideQuotedPart(md string, mode quotedTextMode, opts quoteOptions) string {
+	return SplitQuoted(md, opts).render(mode)
+}
+
+// QuotedParts is a message body split by SplitQuoted into the sender's
+// own text, the earlier messages it quotes and the signature after it
+type QuotedParts struct {
+	Visible   string
+	Quoted    string
+	Signature string
+
+	// lead and runs are the text before the quoted part and the quoted
+	// runs and answers of a bottom-posted or interleaved reply, which
+	// Visible and Quoted join
+	lead string
+	runs []quoteRun
+
+	// text is the whole message, posted in quotedKeep mode
+	text string
+}
 
-	pats := []*regexp.Regexp{
-		regexp.MustCompile(`(?i)^On .+ wrote:`),             // On ... wrote:
-		regexp.MustCompile(`(?i)^\**From:\s*.+@.+`),         // From: someone <email>
-		regexp.MustCompile(`(?i)^Sent:\s*`),                 // Sent:
-		regexp.MustCompile(`(?i)^\**To:\s*`),                // To:
-		regexp.MustCompile(`(?i)^\**Subject:\s*`),           // Subject:
-		regexp.MustCompile(`(?i)^-+ ?Original Message ?-+`), // -----Original Message-----
-		regexp.MustCompile(`(?i)^Begin forwarded message:`), // Begin forwarded message:
-		regexp.MustCompile(`(?m)^--\s*$`),                   // signature separator
+// SplitQuoted splits md into the sender's text, the quoted messages and
+// the signature, removing the trailers of mail apps from the end of the
+// sender's text. Text without quoted messages, a signature or a trailer is
+// all Visible, as it is.
+func SplitQuoted(md string, opts quoteOptions) (parts QuotedParts) {
+	if strings.TrimSpace(md) == "" {
+		return QuotedParts{Visible: md, text: md}
 	}
+	md = string(normalizeLineEndings([]byte(md)))
 
 	lines := strings.Split(md, "\n")
+	// htmlToPlain marks where the quoted messages it recognized start;
+	// the split is at the first when the sender answers between quotes
+	marker := slices.Index(lines, quotedEmailMarker)
+	if marker != -1 {
+		lines = slices.DeleteFunc(lines, func(l string) bool { return l == quotedEmailMarker })
+	}
+	text := strings.Join(lines, "\n")
+	defer func() { parts.text = text }()
 	n := len(lines)
 
 	// helper to test if current line looks like start of quoted block of > lines
 	isQuoteBlock := func(i int) bool {
-		// require at least 3 consecutive lines starting with >
+		// require at least minLines consecutive lines starting with >
 		if i >= n {
 			return false
 		}
 		count := 0
-		for j := i; j < n && count < 3; j++ {
-			if strings.HasPrefix(strings.TrimSpace(lines[j]), ">") {
+		for j := i; j < n && count < opts.minLines; j++ {
+			// text quoted with ">" in HTML is escaped as "\>"
+			if l := strings.TrimSpace(lines[j]); strings.HasPrefix(l, ">") || strings.HasPrefix(l, `\>`) {
 				count++
 			} else if strings.TrimSpace(lines[j]) == "" {
 				// allow blank lines in between quoted blocks
@@ -191,41 +1356,148 @@ func hideQuotedPart(md string, removeQuotes bool) string {
 				break
 			}
 		}
-		return count >= 3
+		return count >= opts.minLines
 	}
 
 	// Find split index
-	split := -1
-	for i, ln := range lines {
-		trim := strings.TrimSpace(ln)
+	split := marker
+	for i := 0; i < n && split == -1; i++ {
+		trim := strings.TrimSpace(lines[i])
 		if trim == "" {
 			continue
 		}
-		if isQuoteBlock(i) {
+		if isQuoteBlock(i) || !opts.replacePatterns && isReplyHeader(lines, i) {
 			split = i
 			break
 		}
-		for _, re := range pats {
+		for _, re := range opts.patterns {
 			if re.MatchString(trim) {
 				split = i
 				break
 			}
 		}
-		if split != -1 {
-			break
-		}
 	}
 
 	if split == -1 {
-		return md
+		var p QuotedParts
+		p.Visible, p.Signature = splitSignature(md)
+		p.Visible = stripTrailers(p.Visible)
+		return p
+	}
+
+	if f := forwardStart(lines, split); f != -1 {
+		// a forwarded message is the point of the email rather than a
+		// quote, and stays visible
+		if split == marker {
+			for i := split; i < n; i++ {
+				lines[i] = unquoteOnce(lines[i])
+			}
+		}
+		return QuotedParts{Visible: trimQuoteMarkers(strings.Join(lines, "\n"))}
+	}
+
+	visible := trimQuoteMarkers(strings.Join(lines[:split], "\n"))
+	if runs := quoteRuns(lines, split); runs != nil {
+		// a bottom-posted or interleaved reply: the answers after the
+		// quoted text stay visible, the signature after the last one is
+		// split off
+		p := QuotedParts{lead: visible, runs: runs}
+		for i := range runs {
+			if runs[i].quoted {
+				runs[i].text = collapseQuoteMarkers(runs[i].text)
+			}
+		}
+		if last := &runs[len(runs)-1]; !last.quoted {
+			last.text, p.Signature = splitSignature(last.text)
+			last.text = stripTrailers(last.text)
+		}
+		var answers, quoted []string
+		if hasLetter(visible) {
+			answers = append(answers, visible)
+		}
+		for _, r := range runs {
+			if r.quoted {
+				quoted = append(quoted, r.text)
+			} else {
+				answers = append(answers, r.text)
+			}
+		}
+		p.Visible, p.Quoted = strings.Join(answers, "\n\n"), strings.Join(quoted, "\n\n")
+		return p
+	}
+	p := QuotedParts{Quoted: collapseQuoteMarkers(strings.Join(lines[split:], "\n"))}
+	p.Visible, p.Signature = splitSignature(visible)
+	p.Visible = stripTrailers(p.Visible)
+	return p
+}
+
+// unquoteOnce removes one level of the "> " quoting of quoteLines
+func unquoteOnce(line string) string {
+	if line == ">" {
+		return ""
+	}
+	return strings.TrimPrefix(line, "> ")
+}
+
+// quoteMarkersRe matches a line of nothing but quote markers, as HTML
+// quote containers leave before and after the text they quote, escaped as
+// "\>" or "&gt;" when they were text in the HTML
+var quoteMarkersRe = regexp.MustCompile(`^\s*(?:(?:\\?>|&gt;)\s*)+$`)
+
+// trimQuoteMarkers removes the lines of nothing but quote markers, and
+// blank lines, from the start and end of text
+func trimQuoteMarkers(text string) string {
+	lines := strings.Split(text, "\n")
+	empty := func(l string) bool { return strings.TrimSpace(l) == "" || quoteMarkersRe.MatchString(l) }
+	for len(lines) > 0 && empty(lines[0]) {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && empty(lines[len(lines)-1]) {
+		lines = lines[:len(lines)-1]
 	}
+	return strings.Join(lines, "\n")
+}
 
-	visible := strings.TrimRight(strings.Join(lines[:split], "\n"), "\n")
-	quoted := strings.TrimLeft(strings.Join(lines[split:], "\n"), "\n")
+// collapseQuoteMarkers trims the quote markers around quoted text and
+// collapses the runs of blank quoted lines in it into one
+func collapseQuoteMarkers(quoted string) string {
+	var out []string
+	prev := false
+	for line := range strings.SplitSeq(trimQuoteMarkers(quoted), "\n") {
+		blank := quoteMarkersRe.MatchString(line)
+		if !blank || !prev {
+			out = append(out, line)
+		}
+		prev = blank
+	}
+	return strings.Join(out, "\n")
+}
+
+// render returns the text of p to post: the quoted messages are removed
+// or collapsed depending on mode, and the signature is collapsed unless
+// STRIP_SIGNATURES is set. In quotedKeep mode the message is as it is.
+func (p QuotedParts) render(mode quotedTextMode) string {
+	if mode == quotedKeep {
+		return p.text
+	}
+	sig := ""
+	if p.Signature != "" && !stripSignatures {
+		sig = "\n\n<details>\n<summary>Signature</summary>\n\n" + p.Signature + "\n\n</details>"
+	}
+	if p.runs != nil {
+		runs := slices.Clone(p.runs)
+		if last := &runs[len(runs)-1]; !last.quoted {
+			last.text += sig
+		}
+		return hideQuoteRuns(p.lead, runs, mode)
+	}
+	visible := p.Visible + sig
+	if p.Quoted == "" {
+		return visible
+	}
 
 	// Wrap the quoted part in details
-	details := "<details>\n<summary>Show quoted email</summary>\n\n" +
-		strings.TrimRight(quoted, "\n") + "\n\n</details>"
+	details := quotedDetails(p.Quoted)
 
 	// If visible body is empty (e.g., purely quoted), we still show a short header
 	if strings.TrimSpace(visible) == "" || !hasLetter(visible) {
@@ -234,8 +1506,8 @@ func hideQuotedPart(md string, removeQuotes bool) string {
 	}
 
 	// Remove quotes entirely as message threads can get long
-	// if removeQuotes = false, then display the context as a <details>/<summary> enclosure
-	if removeQuotes {
+	// in quotedCollapse mode, display the context as a <details>/<summary> enclosure
+	if mode == quotedRemove {
 		// remove quotes entirely
 		return visible + "\n"
 	} else {
@@ -243,3 +1515,140 @@ func hideQuotedPart(md string, removeQuotes bool) string {
 		return visible + "\n\n" + details
 	}
 }
+
+// maxSignatureLines is the length of the longest signature splitSignature
+// splits off; longer text after a "-- " line is taken for part of the
+// message
+const maxSignatureLines = 15
+
+// splitSignature splits text into the message and the signature at its
+// end, after a "-- " line outside code blocks. Text that is all signature
+// is returned as it is.
+func splitSignature(text string) (body, signature string) {
+	lines := strings.Split(text, "\n")
+	sep := -1
+	var st blockState
+	for i, line := range lines {
+		inBlock := st.open()
+		st.scan(line)
+		if !inBlock && !st.open() && signatureSeparatorRe.MatchString(strings.TrimSpace(line)) {
+			sep = i
+		}
+	}
+	if sep == -1 {
+		return text, ""
+	}
+	sig := lines[sep+1:]
+	for len(sig) > 0 && strings.TrimSpace(sig[len(sig)-1]) == "" {
+		sig = sig[:len(sig)-1]
+	}
+	if len(sig) > maxSignatureLines || slices.ContainsFunc(sig, isQuotedLine) {
+		return text, ""
+	}
+	before := strings.TrimRight(strings.Join(lines[:sep], "\n"), "\n")
+	if !hasLetter(before) {
+		return text, ""
+	}
+	return before, strings.Trim(strings.Join(sig, "\n"), "\n")
+}
+
+// quotedDetails wraps quoted text in a collapsed <details> block
+func quotedDetails(quoted string) string {
+	return "<details>\n<summary>Show quoted email</summary>\n\n" +
+		strings.TrimRight(quoted, "\n") + "\n\n</details>"
+}
+
+// quoteRun is a run of lines quoted with ">", or of the sender's own text
+// between or after them
+type quoteRun struct {
+	text   string
+	quoted bool
+}
+
+// isQuotedLine reports whether line is quoted with ">", which is escaped
+// as "\>" in text converted from HTML
+func isQuotedLine(line string) bool {
+	l := strings.TrimSpace(line)
+	return strings.HasPrefix(l, ">") || strings.HasPrefix(l, `\>`)
+}
+
+// quoteRuns splits lines from split, where the quoted part starts, into
+// runs of quoted text and the answers after them, if the quoted part is
+// quoted with ">" and the sender wrote below it. The "On ... wrote:" line
+// is part of the first quoted run. It returns nil for a top-posted reply.
+func quoteRuns(lines []string, split int) []quoteRun {
+	start := split
+	if !isQuotedLine(lines[split]) {
+		// only an "On ... wrote:" line, maybe wrapped, may come before
+		// the first quoted line
+		line := strings.TrimSpace(lines[split])
+		switch {
+		case replyLineRe.MatchString(line):
+			start = split + 1
+		case split+1 < len(lines) && replyLineRe.MatchString(line+" "+strings.TrimSpace(lines[split+1])):
+			start = split + 2
+		default:
+			return nil
+		}
+		for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+			start++
+		}
+		if start == len(lines) || !isQuotedLine(lines[start]) {
+			return nil
+		}
+	}
+
+	var runs []quoteRun
+	answered := false
+	from := split
+	for i := start; i <= len(lines); i++ {
+		if i < len(lines) && (strings.TrimSpace(lines[i]) == "" || isQuotedLine(lines[i]) == (len(runs)%2 == 0)) {
+			// blank lines belong to the run they are in
+			continue
+		}
+		text := strings.Trim(strings.Join(lines[from:i], "\n"), "\n")
+		quoted := len(runs)%2 == 0
+		if !quoted && hasLetter(text) && !signatureSeparatorRe.MatchString(strings.TrimSpace(lines[from])) {
+			answered = true
+		}
+		runs = append(runs, quoteRun{text: text, quoted: quoted})
+		from = i
+	}
+	if !answered {
+		return nil
+	}
+	return runs
+}
+
+// hideQuoteRuns hides the quoted runs of a bottom-posted or interleaved
+// reply after the visible text, keeping the answers in order. The quoted
+// runs of an interleaved reply are kept collapsed even in quotedRemove
+// mode, as the answers refer to them.
+func hideQuoteRuns(visible string, runs []quoteRun, mode quotedTextMode) string {
+	removeQuotes := mode == quotedRemove
+	answers := 0
+	for _, r := range runs {
+		if !r.quoted {
+			answers++
+		}
+	}
+	// a quoted run after an answer makes the reply interleaved
+	interleaved := answers > 1 || runs[len(runs)-1].quoted
+	var parts []string
+	if hasLetter(visible) {
+		parts = append(parts, visible)
+	}
+	for _, r := range runs {
+		switch {
+		case !r.quoted:
+			parts = append(parts, r.text)
+		case interleaved || !removeQuotes:
+			parts = append(parts, quotedDetails(r.text))
+		}
+	}
+	out := strings.Join(parts, "\n\n")
+	if removeQuotes && !interleaved {
+		return out + "\n"
+	}
+	return out
+}
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // helper to build a mail.Message from raw RFC822 text
@@ -92,6 +106,36 @@ func TestExtractBodyAsMarkdown_QuotedPrintableDecoded(t *testing.T) {
 	}
 }
 
+func TestExtractBodyAsMarkdown_QuotedPrintableInvalidEscape(t *testing.T) {
+	raw := "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Caf=C3=A9 menu\r\nPrice code =ZZ stays\r\nSoft=\r\nbreak\r\n"
+	msg := mustMessage(t, raw)
+	got, err := extractBodyAsMarkdown(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Caf\u00e9 menu\nPrice code =ZZ stays\nSoftbreak"
+	if got != want {
+		t.Fatalf("invalid quoted-printable not kept: got=%q want=%q", got, want)
+	}
+}
+
+func TestExtractEmail_QuotedPrintableRawLineWarning(t *testing.T) {
+	raw := "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Caf=C3=A9 menu\r\nbuild \x1b[31mfailed\x1b[0m\r\n"
+	got, err := ExtractEmail(context.Background(), mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Caf\u00e9 menu\nbuild \x1b[31mfailed\x1b[0m\n\n_some lines of this part are not valid quoted-printable and are shown as sent_"
+	if got.Body != want {
+		t.Errorf("body = %q, want %q", got.Body, want)
+	}
+	if len(got.Warnings) != 1 || !strings.Contains(got.Warnings[0], "invalid quoted-printable") {
+		t.Errorf("warnings = %q", got.Warnings)
+	}
+}
+
 func TestExtractBodyAsMarkdown_Base64Decoded(t *testing.T) {
 	payload := "Hi base64"
 	enc := base64.StdEncoding.EncodeToString([]byte(payload))
@@ -112,18 +156,1788 @@ func TestHideQuotedPart_Behavior(t *testing.T) {
 	md := visible + "\n\n" + quoted
 
 	// keep quotes inside <details>
-	got := hideQuotedPart(md, false)
+	got := hideQuotedPart(md, quotedCollapse, defaultQuoteOptions())
 	if !strings.Contains(got, "<details>") || !strings.Contains(got, visible) {
 		t.Fatalf("expected details wrapper with visible content; got: %q", got)
 	}
 
 	// remove quotes entirely
-	got2 := hideQuotedPart(md, true)
+	got2 := hideQuotedPart(md, quotedRemove, defaultQuoteOptions())
 	if !strings.Contains(got2, visible) {
 		t.Fatalf("expected visible content when removing quotes; got: %q", got2)
 	}
 	// when removing quotes we expect no "<details>"
 	if strings.Contains(got2, "<details>") {
-		t.Fatalf("did not expect details when removeQuotes=true: %q", got2)
+		t.Fatalf("did not expect details when quotes are removed: %q", got2)
+	}
+}
+
+func TestExtractBodyAsMarkdown_SkipsNonTextParts(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\nfake"))
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "image before plain text",
+			raw: "Content-Type: multipart/mixed; boundary=B1\r\n\r\n" +
+				"--B1\r\n" +
+				"Content-Type: image/png\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				png + "\r\n" +
+				"--B1\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+				"See screenshot\r\n" +
+				"--B1--\r\n",
+			want: "See screenshot",
+		},
+		{
+			name: "several application parts before plain text",
+			raw: "Content-Type: multipart/mixed; boundary=B2\r\n\r\n" +
+				"--B2\r\n" +
+				"Content-Type: application/pdf\r\n\r\n" +
+				"%PDF-1.4\r\n" +
+				"--B2\r\n" +
+				"Content-Type: application/zip\r\n\r\n" +
+				"PK\r\n" +
+				"--B2\r\n" +
+				"Content-Type: application/octet-stream\r\n\r\n" +
+				"\x00\x01\r\n" +
+				"--B2\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+				"Logs attached\r\n" +
+				"--B2--\r\n",
+			want: "Logs attached",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := extractBodyAsMarkdown(mustMessage(t, tc.raw))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("unexpected body: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_NoTextPart(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=B3\r\n\r\n" +
+		"--B3\r\n" +
+		"Content-Type: image/png\r\n\r\n" +
+		"fake\r\n" +
+		"--B3--\r\n"
+	_, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != errNoTextPart {
+		t.Fatalf("expected errNoTextPart, got %v", err)
+	}
+}
+
+func TestExtractBodyWithImages_NoTextContent(t *testing.T) {
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.4 fake"))
+	tests := []struct {
+		name            string
+		raw             string
+		wantAttachments int
+	}{
+		{
+			name: "single part pdf",
+			raw: "Content-Type: application/pdf; name=\"scan.pdf\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" + pdf + "\r\n",
+			wantAttachments: 1,
+		},
+		{
+			name: "pdf attachment only",
+			raw: "Content-Type: multipart/mixed; boundary=B\r\n\r\n" +
+				"--B\r\n" +
+				"Content-Type: application/pdf; name=\"scan.pdf\"\r\n" +
+				"Content-Disposition: attachment; filename=\"scan.pdf\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" + pdf + "\r\n" +
+				"--B\r\n" +
+				"Content-Type: image/png\r\n\r\n" +
+				"fake\r\n" +
+				"--B--\r\n",
+			wantAttachments: 2,
+		},
+		{
+			name: "empty text part",
+			raw: "Content-Type: multipart/alternative; boundary=B\r\n\r\n" +
+				"--B\r\n" +
+				"Content-Type: text/plain\r\n\r\n" +
+				"  \r\n" +
+				"--B--\r\n",
+			wantAttachments: 0,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ExtractEmail(context.Background(), mustMessage(t, tc.raw))
+			if err != nil && err != errNoTextPart {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.TrimSpace(got.Body) != "" {
+				t.Errorf("expected no text, got %q", got.Body)
+			}
+			if len(got.Attachments) != tc.wantAttachments {
+				t.Errorf("attachments: got=%d want=%d", len(got.Attachments), tc.wantAttachments)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_CIDImages(t *testing.T) {
+	raw := "Content-Type: multipart/related; boundary=REL\r\n\r\n" +
+		"--REL\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		`<p>Before <img src="cid:image001.png@01D9"></p>` +
+		`<p>Again <img src="cid:image001.png@01D9" alt="chart"></p>` +
+		`<p>Missing <img src="cid:nothere@01D9"></p>` + "\r\n" +
+		"--REL\r\n" +
+		"Content-Type: image/png; name=\"image001.png\"\r\n" +
+		"Content-ID: <image001.png@01D9>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("fakepng")) + "\r\n" +
+		"--REL--\r\n"
+
+	t.Run("placeholder", func(t *testing.T) {
+		got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := "Before [inline image: image001.png]\n\n" +
+			"Again [inline image: image001.png]\n\n" +
+			"Missing [inline image: nothere@01D9]"
+		if got != want {
+			t.Fatalf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+		}
+	})
+
+	t.Run("uploaded", func(t *testing.T) {
+		urls := map[string]string{"image001.png@01D9": "https://files.example.com/image001.png"}
+		body, err := extractEmail(context.Background(), mustMessage(t, raw), urls)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := body.Body
+		want := "Before ![image001.png](https://files.example.com/image001.png)\n\n" +
+			"Again ![chart](https://files.example.com/image001.png)\n\n" +
+			"Missing [inline image: nothere@01D9]"
+		if got != want {
+			t.Fatalf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+		}
+	})
+}
+
+// forwardAsAttachment wraps inner as a message/rfc822 attachment after
+// an optional plain text part
+func forwardAsAttachment(boundary, text, inner string) string {
+	raw := "Content-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n"
+	if text != "" {
+		raw += "--" + boundary + "\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+			text + "\r\n"
+	}
+	return raw + "--" + boundary + "\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"Content-Disposition: attachment; filename=\"fwd.eml\"\r\n\r\n" +
+		inner + "\r\n" +
+		"--" + boundary + "--\r\n"
+}
+
+func TestExtractBodyAsMarkdown_ForwardedMessage(t *testing.T) {
+	inner := "From: Alice <alice@example.com>\r\n" +
+		"Subject: Broken build\r\n" +
+		"Date: Tue, 5 Mar 2024 14:32:00 +0000\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"The build is broken.\r\n"
+
+	t.Run("outer text first", func(t *testing.T) {
+		got, err := extractBodyAsMarkdown(mustMessage(t, forwardAsAttachment("OUT", "FYI, see below", inner)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := "FYI, see below\n\n" +
+			"**Forwarded message**\n\n" +
+			"- **From:** Alice <alice@example.com>\n" +
+			"- **Subject:** Broken build\n" +
+			"- **Date:** Tue, 5 Mar 2024 14:32:00 +0000\n\n" +
+			"The build is broken."
+		if got != want {
+			t.Fatalf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+		}
+	})
+
+	t.Run("forward only", func(t *testing.T) {
+		got, err := extractBodyAsMarkdown(mustMessage(t, forwardAsAttachment("OUT", "", inner)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(got, "**Forwarded message**") || !strings.HasSuffix(got, "The build is broken.") {
+			t.Fatalf("unexpected body: %q", got)
+		}
+	})
+
+	t.Run("nesting limit", func(t *testing.T) {
+		msg := inner
+		for i := 0; i < maxForwardDepth+2; i++ {
+			msg = forwardAsAttachment(fmt.Sprintf("B%d", i), fmt.Sprintf("level %d", i), msg)
+		}
+		got, err := extractBodyAsMarkdown(mustMessage(t, msg))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Contains(got, "The build is broken.") {
+			t.Fatalf("expected innermost message to be cut off: %q", got)
+		}
+		if !strings.Contains(got, "nested too deeply") {
+			t.Fatalf("expected nesting note: %q", got)
+		}
+	})
+}
+
+// mustFixture parses an email from the testdata directory
+func mustFixture(t *testing.T, name string) *mail.Message {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	return mustMessage(t, string(raw))
+}
+
+func TestExtractBodyAsMarkdown_SMIMESigned(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "outlook-smime.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi team,\n\nThe cluster job is still failing after the update.\n\nThanks,\nSam"
+	if got != want {
+		t.Fatalf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+	}
+
+	atts, err := extractAttachments(mustFixture(t, "outlook-smime.eml"), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(atts) != 0 {
+		t.Fatalf("expected signature not to be listed as attachment: %+v", atts)
+	}
+}
+
+func TestExtractBodyAsMarkdown_SignedHTMLOnly(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=MIX\r\n\r\n" +
+		"--MIX\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=SIG\r\n\r\n" +
+		"--SIG\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p>Signed <b>content</b></p>\r\n" +
+		"--SIG\r\n" +
+		"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n\r\n" +
+		"MIAGCSqGSIb3DQEHAqCAMIACAQExCzAJBgUrDgMCGgUA\r\n" +
+		"--SIG--\r\n" +
+		"--MIX--\r\n"
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "Signed **content**" {
+		t.Fatalf("unexpected body: %q", got)
+	}
+}
+
+func TestExtractBodyAsMarkdown_PGP(t *testing.T) {
+	t.Run("encrypted", func(t *testing.T) {
+		raw := "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=ENC\r\n\r\n" +
+			"--ENC\r\n" +
+			"Content-Type: application/pgp-encrypted\r\n\r\n" +
+			"Version: 1\r\n" +
+			"--ENC\r\n" +
+			"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n\r\n" +
+			"-----BEGIN PGP MESSAGE-----\r\n" +
+			"hQEMA1234567890ABCDEF\r\n" +
+			"-----END PGP MESSAGE-----\r\n" +
+			"--ENC--\r\n"
+		_, err := extractBodyAsMarkdown(mustMessage(t, raw))
+		if err != errEncrypted {
+			t.Fatalf("expected errEncrypted, got %v", err)
+		}
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		raw := "Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; boundary=SIG\r\n\r\n" +
+			"--SIG\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+			"Clear text\r\n" +
+			"--SIG\r\n" +
+			"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n" +
+			"Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n" +
+			"-----BEGIN PGP SIGNATURE-----\r\n" +
+			"iQEzBAEBCAAdFiEE\r\n" +
+			"-----END PGP SIGNATURE-----\r\n" +
+			"--SIG--\r\n"
+		got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "Clear text" {
+			t.Fatalf("unexpected body: %q", got)
+		}
+		atts, _ := extractAttachments(mustMessage(t, raw), 1<<20, 1<<20)
+		if len(atts) != 0 {
+			t.Fatalf("expected signature not to be listed as attachment: %+v", atts)
+		}
+	})
+}
+
+func TestUnflowText(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		delsp bool
+		want  string
+	}{
+		{
+			name: "soft breaks joined",
+			in:   "This is a long \r\nparagraph that \r\nwraps.\r\nNext line\r\n",
+			want: "This is a long paragraph that wraps.\nNext line",
+		},
+		{
+			name:  "delsp removes trailing space",
+			in:    "Supercalifragi \r\nlistic\r\n",
+			delsp: true,
+			want:  "Supercalifragilistic",
+		},
+		{
+			name: "delsp off keeps trailing space",
+			in:   "Supercalifragi \r\nlistic\r\n",
+			want: "Supercalifragi listic",
+		},
+		{
+			name: "space stuffing removed",
+			in:   " From the start\r\n >not a quote\r\n",
+			want: "From the start\n>not a quote",
+		},
+		{
+			name: "quoted flowed text keeps depth",
+			in:   "My reply\r\n> quoted text \r\n> continues\r\n>> older \r\n>> text\r\n",
+			want: "My reply\n> quoted text continues\n>> older text",
+		},
+		{
+			name: "depth change ends paragraph",
+			in:   "> quoted \r\nnot quoted\r\n",
+			want: "> quoted \nnot quoted",
+		},
+		{
+			name: "signature separator not unwrapped",
+			in:   "Thanks\r\n-- \r\nSam\r\n",
+			want: "Thanks\n-- \nSam",
+		},
+		{
+			name: "list items stay separate",
+			in:   "Steps:\r\n- one\r\n- two is a \r\nlong item\r\n",
+			want: "Steps:\n- one\n- two is a long item",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := unflowText(tc.in, tc.delsp)
+			if got != tc.want {
+				t.Errorf("unflowText mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_FormatFlowed(t *testing.T) {
+	raw := "Content-Type: text/plain; charset=utf-8; format=flowed\r\n\r\n" +
+		"Thanks for looking into \r\nthis.\r\n\r\n" +
+		"On Tue, Alice wrote:\r\n" +
+		"> first quoted \r\n> line\r\n> second\r\n> third\r\n"
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(got, "Thanks for looking into this.") {
+		t.Fatalf("unexpected body: %q", got)
+	}
+	if hidden := hideQuotedPart(got, quotedRemove, defaultQuoteOptions()); hidden != "Thanks for looking into this.\n" {
+		t.Fatalf("quoted text not hidden: %q", hidden)
+	}
+}
+
+func TestReadAndDecodePart_CharsetSniffing(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "latin-1 without charset", in: "Caf\xe9 costs \xa35", want: "Café costs £5"},
+		{name: "utf-8 without charset", in: "Café costs £5 – ok", want: "Café costs £5 – ok"},
+		{name: "ascii", in: "Plain ASCII text", want: "Plain ASCII text"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readAndDecodePart(context.Background(), strings.NewReader(tc.in), "text/plain", "", nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("readAndDecodePart mismatch: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadAndDecodePart_MislabelledCharset(t *testing.T) {
+	in := "\x93Quoted\x94 text"
+	got, err := readAndDecodePart(context.Background(), strings.NewReader(in), "text/plain; charset=utf-8", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != "“Quoted” text" {
+		t.Errorf("expected Windows-1252 fallback: got=%q", got)
+	}
+}
+
+func TestExtractBodyAsMarkdown_Raw8BitIn7Bit(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "declared us-ascii",
+			raw: "Content-Type: text/plain; charset=us-ascii\r\n" +
+				"Content-Transfer-Encoding: 7bit\r\n\r\n" +
+				"Set the freezer to -80\xb0C \x96 not -20\xb0C\r\n",
+			want: "Set the freezer to -80°C – not -20°C",
+		},
+		{
+			name: "no content type",
+			raw:  "Subject: freezer\r\n\r\nSet the freezer to -80\xb0C\r\n",
+			want: "Set the freezer to -80°C",
+		},
+		{
+			name: "binary garbage",
+			raw: "Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+				"core dump: \x00\x01\x02\xff done\r\n",
+			want: "core dump: \ufffd\ufffd\ufffdÿ done",
+		},
+		{
+			name: "NUL in valid UTF-8",
+			raw: "Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+				"core dump: \x00 done\r\n",
+			want: "core dump: \ufffd done",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := extractBodyAsMarkdown(mustMessage(t, tc.raw))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("body mismatch: got=%q want=%q", got, tc.want)
+			}
+			payload, err := json.Marshal(map[string]string{"body": got})
+			if err != nil {
+				t.Fatalf("marshal comment payload: %v", err)
+			}
+			var back map[string]string
+			if err := json.Unmarshal(payload, &back); err != nil || back["body"] != got {
+				t.Errorf("comment payload does not round trip: %s", payload)
+			}
+		})
+	}
+}
+
+func TestReadAndDecodePart_ValidUTF8ControlCharacters(t *testing.T) {
+	// a pasted log with colour escape sequences, a form feed and a bell
+	in := "\x1b[31mERROR\x1b[0m disk full\n\fpage 2 \x07\x7f é"
+	got, err := readAndDecodePart(context.Background(), strings.NewReader(in), "text/plain; charset=utf-8", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != in {
+		t.Errorf("valid UTF-8 changed: got=%q want=%q", got, in)
+	}
+}
+
+func TestReadAndDecodePart_StripsInvisible(t *testing.T) {
+	tests := []struct {
+		name string
+		ct   string
+		in   string
+		want string
+	}{
+		{
+			name: "bom and zero-width space in emphasis",
+			ct:   "text/plain; charset=utf-8",
+			in:   "\ufeffThis is **\u200bbold\u200b** and co\u00adoperate",
+			want: "This is **bold** and cooperate",
+		},
+		{
+			name: "fenced code kept verbatim",
+			ct:   "text/plain; charset=utf-8",
+			in:   "a\u200bb\n```\nx\u200by\n```\nc\u200dd",
+			want: "ab\n```\nx\u200by\n```\ncd",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readAndDecodePart(context.Background(), strings.NewReader(tc.in), tc.ct, "", nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("readAndDecodePart mismatch: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_HTMLStripsInvisible(t *testing.T) {
+	raw := "Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"\ufeff<p>Text <b>\u200bbold\u200b</b></p><pre>keep\u200bme</pre>\r\n"
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Text **bold**\n\n```\nkeep\u200bme\n```"
+	if got != want {
+		t.Errorf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_HTMLStylesAndScripts(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "newsletter-reply.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi,\n\nWe have two places left on the HPC workshop next week, shall I hold one for you?\n\nTraining Team"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_WordStyles(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "word-styles.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi team,\n\n**Deadline:** Friday 5pm\n\n*Note* the ***new*** queue, ~~Monday~~ Tuesday\n\n" +
+		"**Whole bold paragraph**\n\n**Already bold**"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_HiddenPreheader(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "helpdesk-preheader.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Reply above this line to add a comment.\n\n**Sam Tech** commented:\n\n" +
+		"The licence server has been restarted, please try launching MATLAB again."
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_LayoutTables(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "owa-reply.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[inline image: avatar]\n\nHi,\n\nI have moved the results to project storage, so the scratch files can go.\n\nMany thanks,\nPriya"
+	if got != want || strings.Contains(got, "|") {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_OutlookList(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "outlook-list.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi,\n\nCould you install the following on the lab machines?\n\n" +
+		"- Python 3.12 with:\n  - numpy and scipy\n  - **matplotlib** 3.9\n- RStudio\n- QGIS (the LTR version)\n\n" +
+		"Thanks,\n\nHannah"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_PastedCode(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "owa-python-snippet.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi,\n\nMy script only processes the first file in the folder:\n\n" +
+		"```\ndef process_all(folder):\n    for name in os.listdir(folder):\n        data = load(name)\n" +
+		"        return summarise(data)\n\nprocess_all(\"/data/run_07\")\n```\n\n" +
+		"Any idea why?\n\nRavi"
+	if got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_NonBreakingSpaces(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "outlook-nbsp-indent.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hello,\n\nSince this morning my job fails. What I did:\n\n" +
+		"Loaded the new module (GCC/13.2.0)\n\n\\- then resubmitted with the same script\n\n" +
+		"\\# is the job id 12345 relevant?\n\n" +
+		"```\nif [ -f out.log ]; then\n    tail out.log\nfi\n```\n\n" +
+		"Thanks,\n\nOliver"
+	if got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_DefinitionList(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "web-form.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "A new request was submitted through the software installation form.\n\n" +
+		"**Name:** Tom Richards\n**Department:** Zoology\n**Software:** R 4.4 with *lme4*\n" +
+		"**Cluster:** arc\nhtc\n**Deadline:**\n**Comments:** Needed for the spring field season."
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_OutlookReplyLineEndings(t *testing.T) {
+	body, err := extractBodyAsMarkdown(mustFixture(t, "outlook-reply-qp.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(body, "\r") {
+		t.Fatalf("expected no carriage returns in body: %q", body)
+	}
+	got := hideQuotedPart(body, quotedRemove, defaultQuoteOptions())
+	want := "Thanks, that fixed it.\n\nSam\n\n________________________________\n"
+	if got != want {
+		t.Fatalf("Outlook header block not collapsed:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+	}
+}
+
+func TestHideQuotedPart_EscapedHTML(t *testing.T) {
+	md, err := htmlToPlain(`<p>Done, thanks.</p><p>-----Original Message-----<br>From: Ann &lt;ann@example.com&gt;</p><p>Can you check?</p>`)
+	if err != nil {
+		t.Fatalf("htmlToPlain returned error: %v", err)
+	}
+	if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != "Done, thanks.\n" {
+		t.Errorf("quote not hidden in %q, got %q", md, got)
+	}
+}
+
+func TestHideQuotedPart_BareCR(t *testing.T) {
+	md := "Reply text\rOn Tue, Alice <alice@example.com> wrote:\r> quoted"
+	got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions())
+	if got != "Reply text\n" {
+		t.Fatalf("unexpected result: %q", got)
+	}
+}
+
+func TestHideQuotedPart_ReplyStyles(t *testing.T) {
+	header := "On Tue, 18 Mar 2025 at 17:03, Research Computing <support@example.ac.uk> wrote:"
+	details := func(quoted string) string {
+		return "<details>\n<summary>Show quoted email</summary>\n\n" + quoted + "\n\n</details>"
+	}
+	tests := []struct {
+		name, md           string
+		removed, inDetails string
+	}{
+		{
+			name: "bottom-posted",
+			md: header + "\n> Please check that the job script loads the module.\n>\n> Regards,\n> Research Computing\n\n" +
+				"It does, the log is attached.\n\nAnn",
+			removed:   "It does, the log is attached.\n\nAnn\n",
+			inDetails: details(header+"\n> Please check that the job script loads the module.\n>\n> Regards,\n> Research Computing") + "\n\nIt does, the log is attached.\n\nAnn",
+		},
+		{
+			name: "interleaved",
+			md: header + "\n> Which partition did you submit to?\n\nThe gpu partition.\n\n" +
+				"> How many nodes?\n\nTwo, with 4 GPUs each.\n\n> Did it work before the upgrade?\n\nYes, last week.\n\nAnn",
+			removed: details(header+"\n> Which partition did you submit to?") + "\n\nThe gpu partition.\n\n" +
+				details("> How many nodes?") + "\n\nTwo, with 4 GPUs each.\n\n" +
+				details("> Did it work before the upgrade?") + "\n\nYes, last week.\n\nAnn",
+		},
+		{
+			name: "top-posted",
+			md: "Thanks, it works now.\n\n" + header + "\n> Please try again.\n>\n> Research Computing\n\n" +
+				"-- \nYou received this message because you opened a ticket.",
+			removed: "Thanks, it works now.\n",
+			inDetails: "Thanks, it works now.\n\n" + details(header+"\n> Please try again.\n>\n> Research Computing\n\n"+
+				"-- \nYou received this message because you opened a ticket."),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hideQuotedPart(tc.md, quotedRemove, defaultQuoteOptions()); got != tc.removed {
+				t.Errorf("removing quotes:\n--- got ---\n%q\n--- want ---\n%q", got, tc.removed)
+			}
+			want := tc.inDetails
+			if want == "" {
+				// the quotes of an interleaved reply are kept either way
+				want = tc.removed
+			}
+			if got := hideQuotedPart(tc.md, quotedCollapse, defaultQuoteOptions()); got != want {
+				t.Errorf("collapsing quotes:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	quote := "On Tue, 18 Mar 2025 at 17:03, Research Computing <support@example.ac.uk> wrote:\n> Please try again.\n> \n> Research Computing"
+	tests := []struct {
+		name, md string
+		want     QuotedParts
+	}{
+		{"no quote", "Just a question.\n", QuotedParts{Visible: "Just a question.\n"}},
+		{"top-posted", "Thanks!\n\n-- \nAnn\n\n" + quote, QuotedParts{Visible: "Thanks!", Quoted: quote, Signature: "Ann"}},
+		{"only quoted", "\n" + quote, QuotedParts{Quoted: quote}},
+		{
+			"bottom-posted",
+			quote + "\n\nIt works now.\n-- \nAnn",
+			QuotedParts{Visible: "It works now.", Quoted: quote, Signature: "Ann"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := SplitQuoted(tc.md, defaultQuoteOptions())
+			if got.Visible != tc.want.Visible || got.Quoted != tc.want.Quoted || got.Signature != tc.want.Signature {
+				t.Errorf("SplitQuoted(%q) = visible %q, quoted %q, signature %q; want %q, %q, %q", tc.md,
+					got.Visible, got.Quoted, got.Signature, tc.want.Visible, tc.want.Quoted, tc.want.Signature)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_Signatures(t *testing.T) {
+	defer func(b bool) { stripSignatures = b }(stripSignatures)
+	sigDetails := "<details>\n<summary>Signature</summary>\n\nDr Ann Example\nDepartment of Physics\n\n</details>"
+	quote := "On Tue, 18 Mar 2025 at 17:03, Research Computing <support@example.ac.uk> wrote:\n> Please try again.\n> \n> Research Computing"
+	fenced := "The script ends with:\n\n```\necho done\n--\nexit 0\n```\n\nIs that wrong?"
+	long := "Notes from the meeting\n--\n" + strings.Repeat("A point that was discussed.\n", 20)
+	tests := []struct {
+		name, md string
+		strip    bool
+		mode     quotedTextMode
+		want     string
+	}{
+		{"collapsed", "Thanks!\n\n-- \nDr Ann Example\nDepartment of Physics\n", false, quotedRemove, "Thanks!\n\n" + sigDetails},
+		{"stripped", "Thanks!\n\n-- \nDr Ann Example\nDepartment of Physics\n", true, quotedRemove, "Thanks!"},
+		{"before a quoted thread", "Thanks!\n\n-- \nDr Ann Example\nDepartment of Physics\n\n" + quote, false, quotedRemove, "Thanks!\n\n" + sigDetails + "\n"},
+		{"before a shown quoted thread", "Thanks!\n\n-- \nDr Ann Example\nDepartment of Physics\n\n" + quote, false, quotedCollapse,
+			"Thanks!\n\n" + sigDetails + "\n\n<details>\n<summary>Show quoted email</summary>\n\n" + quote + "\n\n</details>"},
+		{"in a code fence", fenced, false, quotedRemove, fenced},
+		{"too long", long, false, quotedRemove, long},
+		{"only a signature", "-- \nDr Ann Example", false, quotedRemove, "-- \nDr Ann Example"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stripSignatures = tc.strip
+			if got := hideQuotedPart(tc.md, tc.mode, defaultQuoteOptions()); got != tc.want {
+				t.Errorf("hideQuotedPart:\n--- got ---\n%q\n--- want ---\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_Localized(t *testing.T) {
+	tests := []struct {
+		fixture, visible string
+	}{
+		{"fr-gmail-reply.eml", "Bonjour,\n\nLe quota est bien passé à 2 To, merci beaucoup.\n\nCamille\n"},
+		{"de-outlook-reply.eml", "Hallo,\n\nvielen Dank, der Zugang funktioniert jetzt.\n\nGrüße\nJonas\n"},
+		{"es-apple-mail-reply.eml", "Hola:\n\nYa funciona la licencia, gracias.\n\nLucía\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			md, err := extractBodyAsMarkdown(mustFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != tc.visible {
+				t.Errorf("quote not hidden:\n--- markdown ---\n%s\n--- got ---\n%q", md, got)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_OutlookHeaderBlock(t *testing.T) {
+	tests := []struct {
+		name, md string
+	}{
+		{"plain text", "Thanks, that fixed it.\n\nFrom: Research Computing <support@example.ac.uk>\nSent: 18 March 2025 17:03\n" +
+			"To: Ann Example <ann@example.ac.uk>\nSubject: RE: Job stuck\n\nPlease try again."},
+		{"converted from HTML", "Thanks, that fixed it.\n\n**From:** Research Computing <support@example.ac.uk>\n**Sent:** 18 March 2025 17:03\n" +
+			"**To:** Ann Example <ann@example.ac.uk>\n**Subject:** RE: Job stuck\n\nPlease try again."},
+		{"From without an address", "Thanks, that fixed it.\n\nFrom: Smith, John\nSent: 18 March 2025 17:03\n" +
+			"To: Example, Ann\nSubject: RE: Job stuck\n\nPlease try again."},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hideQuotedPart(tc.md, quotedRemove, defaultQuoteOptions()); got != "Thanks, that fixed it.\n" {
+				t.Errorf("hideQuotedPart(%q) = %q", tc.md, got)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_WrappedAttribution(t *testing.T) {
+	tests := []struct {
+		fixture, visible string
+	}{
+		{"gmail-wrapped-attribution.eml", "That worked, thank you.\n\nTom\n"},
+		{"apple-mail-wrapped-attribution.eml", "I can see the files now, thanks.\n\nPriya\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			md, err := extractBodyAsMarkdown(mustFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != tc.visible {
+				t.Errorf("quote not hidden:\n--- markdown ---\n%s\n--- got ---\n%q", md, got)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_Options(t *testing.T) {
+	twoLines := "Yes, that is the one.\n\n> Is the job ID 123456?\n> It ran on node gpu07."
+	if got := hideQuotedPart(twoLines, quotedRemove, defaultQuoteOptions()); got != twoLines {
+		t.Errorf("two quoted lines hidden by default: %q", got)
+	}
+	opts := defaultQuoteOptions()
+	opts.minLines = 2
+	if got := hideQuotedPart(twoLines, quotedRemove, opts); got != "Yes, that is the one.\n" {
+		t.Errorf("two quoted lines not hidden with minLines 2: %q", got)
+	}
+
+	desk := "Thanks, closing.\n\nReply from the service desk:\nYour ticket has been updated."
+	gmail := "Thanks, closing.\n\nOn Tue, 5 Mar 2024 at 14:02, Jane <jane@example.ac.uk> wrote:\n> Done."
+	opts = defaultQuoteOptions()
+	opts.patterns = append(slices.Clone(opts.patterns), regexp.MustCompile(`^Reply from the service desk:`))
+	for _, md := range []string{desk, gmail} {
+		if got := hideQuotedPart(md, quotedRemove, opts); got != "Thanks, closing.\n" {
+			t.Errorf("hideQuotedPart(%q) with an extra pattern = %q", md, got)
+		}
+	}
+	opts.patterns = opts.patterns[len(opts.patterns)-1:]
+	opts.replacePatterns = true
+	if got := hideQuotedPart(desk, quotedRemove, opts); got != "Thanks, closing.\n" {
+		t.Errorf("hideQuotedPart(%q) with replaced patterns = %q", desk, got)
+	}
+	if got := hideQuotedPart(gmail, quotedRemove, opts); got != gmail {
+		t.Errorf("reply header recognized with replaced patterns: %q", got)
+	}
+}
+
+func TestHideQuotedPart_NotReplyHeaders(t *testing.T) {
+	tests := []string{
+		"Hi,\n\nOn the wiki page Sam wrote: \"restart the job\", but it still fails.\n\nThanks",
+		"On Monday I wrote: the script, and it ran for an hour.",
+		"On Friday the admin who looked after the old cluster\nwrote:\nthe quota is 2 TB per group.\nIs that still right?",
+		"Von den 40 Jobs sind 3 fehlgeschlagen.\nDatum und Uhrzeit stehen im Log.",
+		"Le serveur a redémarré et le job a écrit : rien.",
+		"Subject: grant deadline\n\nThe deadline for the compute time application is 4 April.\nCan we get the usage figures before then?",
+		"To: whoever handles printing — the third floor printer is jammed again.\n\nFrom: room 3.12, next to the kitchen",
+	}
+	for _, md := range tests {
+		if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != md {
+			t.Errorf("hideQuotedPart(%q) = %q, want it unchanged", md, got)
+		}
+	}
+}
+
+func TestDecodeTransferEncoding_LenientBase64(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "padded", in: "SGVsbG8gd29ybGQ=\r\n", want: "Hello world"},
+		{name: "unpadded", in: "SGVsbG8gd29ybGQ", want: "Hello world"},
+		{name: "whitespace mid-line", in: "SGVs bG8g\td29y\r\nbGQ=", want: "Hello world"},
+		{name: "trailing CRLF after terminator", in: "SGVsbG8gd29ybGQ=\r\n\r\n", want: "Hello world"},
+		{name: "junk after padding", in: "SGk=\r\n--junk--\r\n", want: "Hi"},
+		{name: "invalid character keeps prefix", in: "SGVsbG8g!!!!d29ybGQ=", want: "Hello "},
+		{name: "lines padded separately", in: "SGVsbG8=\r\nIHdvcmxk\r\nIQ==\r\nIQ=\r\n", want: "Hello world!!"},
+		{name: "padding mid-line", in: "SGk=IHRoZXJl", want: "Hi there"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := io.ReadAll(decodeTransferEncoding(strings.NewReader(tc.in), "base64", nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("base64 mismatch: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractEmail_InvalidBase64Warning(t *testing.T) {
+	raw := "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"SGVsbG8gd29ybGQ=\r\n%%%%\r\nd29ybGQ=\r\n"
+	got, err := ExtractEmail(context.Background(), mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Warnings) != 1 || !strings.Contains(got.Warnings[0], "invalid base64") {
+		t.Errorf("warnings = %q", got.Warnings)
+	}
+	if want := "Hello world\n\n_… cut short, the rest of this part is not valid base64_"; got.Body != want {
+		t.Errorf("body = %q, want %q", got.Body, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_PreferHTML(t *testing.T) {
+	alternative := func(plain string) string {
+		return "Content-Type: multipart/alternative; boundary=ALT\r\n\r\n" +
+			"--ALT\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+			plain + "\r\n" +
+			"--ALT\r\n" +
+			"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+			"<p>Rich <b>HTML</b> version</p>\r\n" +
+			"--ALT--\r\n"
+	}
+
+	t.Run("stub plain part", func(t *testing.T) {
+		got, err := extractBodyAsMarkdown(mustFixture(t, "crm-view-in-browser.eml"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(got, "## Case 4821 has been updated") ||
+			!strings.Contains(got, "copy the results to the project share") {
+			t.Errorf("expected the text/html part, got:\n%s", got)
+		}
+	})
+
+	t.Run("plain part kept", func(t *testing.T) {
+		got, err := extractBodyAsMarkdown(mustMessage(t, alternative("Plain version")))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "Plain version" {
+			t.Errorf("expected the text/plain part, got %q", got)
+		}
+	})
+
+	t.Run("PREFER_HTML", func(t *testing.T) {
+		setupTests(t)
+		t.Setenv("PREFER_HTML", "1")
+		loadConfig()
+		t.Cleanup(func() { preferHTML = false })
+		got, err := extractBodyAsMarkdown(mustMessage(t, alternative("Plain version")))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "Rich **HTML** version" {
+			t.Errorf("expected the text/html part, got %q", got)
+		}
+	})
+}
+
+// repeatReader yields line n times
+type repeatReader struct {
+	line string
+	n    int
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 && r.n > 0 {
+		c := copy(p, r.line[r.off:])
+		p = p[c:]
+		total += c
+		r.off += c
+		if r.off == len(r.line) {
+			r.off = 0
+			r.n--
+		}
+	}
+	if total == 0 {
+		return 0, io.EOF
+	}
+	return total, nil
+}
+
+func TestExtractBodyAsMarkdown_LargeAttachmentStreamed(t *testing.T) {
+	// 50 MB of inline video, base64 encoded in 76 character lines
+	line := strings.Repeat("QUFB", 19) + "\r\n"
+	lines := 50 << 20 / 57
+	r := io.MultiReader(
+		strings.NewReader("Content-Type: multipart/mixed; boundary=B\r\n\r\n"+
+			"--B\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n\r\n"+
+			"See the recording\r\n"+
+			"--B\r\n"+
+			"Content-Type: video/mp4\r\n"+
+			"Content-Transfer-Encoding: base64\r\n\r\n"),
+		&repeatReader{line: line, n: lines},
+		strings.NewReader("--B--\r\n"),
+	)
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	got, err := extractBodyAsMarkdown(msg)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "See the recording" {
+		t.Errorf("unexpected body: %q", got)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4<<20 {
+		t.Errorf("allocated %d bytes extracting the body, want at most %d", alloc, 4<<20)
+	}
+}
+
+func TestExtractEmail_Cancelled(t *testing.T) {
+	// 50 MB of base64 text, which would take a while to decode
+	line := strings.Repeat("QUFB", 19) + "\r\n"
+	lines := 50 << 20 / 57
+	for _, tc := range []struct {
+		name, head, tail string
+		part             int
+	}{
+		{"single part",
+			"Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\n", "", 1},
+		{"multipart",
+			"Content-Type: multipart/mixed; boundary=B\r\n\r\n--B\r\n" +
+				"Content-Type: text/html\r\nContent-Transfer-Encoding: base64\r\n\r\n",
+			"--B--\r\n", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := mail.ReadMessage(io.MultiReader(strings.NewReader(tc.head),
+				&repeatReader{line: line, n: lines}, strings.NewReader(tc.tail)))
+			if err != nil {
+				t.Fatalf("parse message: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			start := time.Now()
+			_, err = ExtractEmail(ctx, msg)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("took %v to return", d)
+			}
+			var te *DecodeTimeoutError
+			if !errors.As(err, &te) || !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected a DecodeTimeoutError for context.Canceled, got %v", err)
+			}
+			if te.Part != tc.part {
+				t.Errorf("expected part %d, got %d", tc.part, te.Part)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_PartTooLarge(t *testing.T) {
+	defer func(n int64) { maxDecodedBytes = n }(maxDecodedBytes)
+	maxDecodedBytes = 100
+	raw := "Content-Type: multipart/alternative; boundary=B\r\n\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.Repeat("long text ", 20) + "\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<p>Short</p>\r\n" +
+		"--B--\r\n"
+	got, err := ExtractEmail(context.Background(), mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := strings.TrimSpace(strings.Repeat("long text ", 10)) +
+		"\n\n_… truncated, this part is larger than 100 B when decoded_"
+	if got.Body != want || !got.Truncated || len(got.Warnings) != 1 {
+		t.Errorf("expected the oversized plain part to be truncated, got %+v", got)
+	}
+
+	single := "Content-Type: text/html\r\n\r\n<p>" + strings.Repeat("long text ", 20) + "</p>"
+	got, err = ExtractEmail(context.Background(), mustMessage(t, single))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(got.Body, "… truncated, this part is larger than 100 B when decoded*") || !got.Truncated {
+		t.Errorf("expected the oversized body to be truncated, got %+v", got)
+	}
+}
+
+func TestExtractBodyAsMarkdown_DecodedSizeCap(t *testing.T) {
+	defer func(n int64) { maxDecodedBytes = n }(maxDecodedBytes)
+	maxDecodedBytes = 1 << 10
+	// each encoded line decodes to a 3-byte character, with a soft line
+	// break so that the whole body is a single line
+	line := strings.Repeat("=E2=82=AC", 8) + "=\r\n"
+	raw := "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		strings.Repeat(line, 1000) + "end\r\n"
+	got, err := ExtractEmail(context.Background(), mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	marker := "\n\n_… truncated, this part is larger than 1.0 KB when decoded_"
+	if !strings.HasSuffix(got.Body, marker) {
+		t.Fatalf("expected the truncation marker, got %q", got.Body[max(0, len(got.Body)-100):])
+	}
+	text := strings.TrimSuffix(got.Body, marker)
+	if len(text) > 1<<10 || !utf8.ValidString(text) || strings.Trim(text, "€") != "" {
+		t.Errorf("expected at most 1 KB of whole characters, got %d bytes", len(text))
+	}
+	if !got.Truncated || len(got.Warnings) != 1 {
+		t.Errorf("expected a truncation warning, got truncated=%v warnings=%q", got.Truncated, got.Warnings)
+	}
+}
+
+func TestExtractBodyAsMarkdown_MissingClosingBoundary(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "truncated-html.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "The transfer finished, all 12 files are on the share now.\n\nAlice"
+	if got != want {
+		t.Errorf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+	}
+
+	// cut off before any text part
+	raw := "Content-Type: multipart/mixed; boundary=B\r\n\r\n" +
+		"--B\r\n" +
+		"Content-Type: image/png\r\n\r\n" +
+		"fake"
+	_, err = extractBodyAsMarkdown(mustMessage(t, raw))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestExtractBodyWithImages_InlineTextAttachments(t *testing.T) {
+	defer func(b bool) { inlineTextAttachments = b }(inlineTextAttachments)
+	inlineTextAttachments = true
+	defer func(n int64) { maxInlineTextBytes = n }(maxInlineTextBytes)
+	maxInlineTextBytes = 100
+
+	raw := "Content-Type: multipart/mixed; boundary=B\r\n\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Log attached\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1; name=\"error.log\"\r\n" +
+		"Content-Disposition: attachment; filename=\"error.log\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Fehler: Datei nicht gefunden (Gr=F6=DFe 0)\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/x-python; name=\"job.py\"\r\n" +
+		"Content-Disposition: attachment; filename=\"job.py\"\r\n\r\n" +
+		"print('hi')\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; name=\"big.txt\"\r\n" +
+		"Content-Disposition: attachment; filename=\"big.txt\"\r\n\r\n" +
+		strings.Repeat("x", 200) + "\r\n" +
+		"--B\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n\r\n" +
+		"%PDF\r\n" +
+		"--B--\r\n"
+	got, err := ExtractEmail(context.Background(), mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []textAttachment{
+		{Filename: "error.log", Text: "Fehler: Datei nicht gefunden (Größe 0)", Size: 38, Digest: contentDigest([]byte("Fehler: Datei nicht gefunden (Gr\xf6\xdfe 0)"))},
+		{Filename: "job.py", Text: "print('hi')", Size: 11, Digest: contentDigest([]byte("print('hi')"))},
+	}
+	if fmt.Sprint(got.TextAttachments) != fmt.Sprint(want) {
+		t.Errorf("text attachments:\n--- got ---\n%q\n--- want ---\n%q", got.TextAttachments, want)
+	}
+	if got.Body != "Log attached" || len(got.Attachments) != 4 {
+		t.Errorf("unexpected body %q with %d attachments", got.Body, len(got.Attachments))
+	}
+}
+
+func TestExtractBodyWithImages_AppleMailInlineImage(t *testing.T) {
+	got, err := ExtractEmail(context.Background(), mustFixture(t, "apple-mail-inline-image.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi,\n\nThe job fails with this error:\n\n" +
+		"[inline image: Screenshot 2025-03-04 at 10.12.03.png]\n\n" +
+		"It started after the module update.\n\nThanks,\nBob"
+	if got.Body != want {
+		t.Errorf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got.Body, want)
+	}
+	if len(got.Attachments) != 1 {
+		t.Errorf("attachments: got=%d want=1", len(got.Attachments))
+	}
+}
+
+func TestExtractBodyAsMarkdown_InlineTextWithFilename(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=B\r\n\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Notes attached\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Disposition: inline; filename=\"notes.txt\"\r\n\r\n" +
+		"these are the notes\r\n" +
+		"--B--\r\n"
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "Notes attached" {
+		t.Errorf("expected the named part to be treated as an attachment, got %q", got)
+	}
+}
+
+func TestExtractBodyWithImages_IPhonePhotos(t *testing.T) {
+	got, err := ExtractEmail(context.Background(), mustFixture(t, "iphone-photo.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantImages := []string{"IMG_0042.jpeg", "IMG_0043.jpeg"}
+	if !reflect.DeepEqual(got.images(), wantImages) {
+		t.Errorf("images: got=%q want=%q", got.images(), wantImages)
+	}
+	if len(got.Attachments) != 2 {
+		t.Errorf("attachments: got=%d want=2", len(got.Attachments))
+	}
+	if hasTextContent(got.Body) {
+		t.Errorf("expected no text content, got %q", got.Body)
+	}
+}
+
+func TestHasTextContent(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", false},
+		{" \n\t\n", false},
+		{"[inline image: IMG_0042.jpeg]\n\nSent from my iPhone", false},
+		{"Sent from my Galaxy Tab", false},
+		{"[inline image]", false},
+		{"[inline image 2]\n[image: photo.jpg]", false},
+		{"See photo\n\n[inline image: IMG_0042.jpeg]", true},
+		{"Sent from my iPhone while on the train to the office", true},
+	}
+	for _, tc := range tests {
+		if got := hasTextContent(tc.text); got != tc.want {
+			t.Errorf("hasTextContent(%q) = %v, want %v", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestExtractBodyAsMarkdown_Digest(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "digest.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := "**Digest message 1**\n\n" +
+		"- **From:** Alice Example <alice@example.com>\n" +
+		"- **Subject:** Cluster maintenance\n" +
+		"- **Date:** Wed, 5 Mar 2025 09:15:00 +0000\n\n" +
+		"The cluster will be down for maintenance on Friday."
+	second := "**Digest message 2**\n\n" +
+		"- **From:** Bob Example <bob@example.com>\n" +
+		"- **Subject:** Re: Cluster maintenance\n" +
+		"- **Date:** Wed, 5 Mar 2025 10:02:00 +0000\n\n" +
+		"Will running jobs be requeued?"
+	if !strings.HasSuffix(got, first+"\n\n---\n\n"+second) {
+		t.Errorf("expected two digest sections separated by a rule, got:\n%s", got)
+	}
+	if !strings.HasPrefix(got, "Today's Topics:") {
+		t.Errorf("expected the digest's table of contents first, got:\n%s", got)
+	}
+	if strings.Contains(got, "Content-Type:") {
+		t.Errorf("raw headers of digest messages in body:\n%s", got)
+	}
+}
+
+func TestExtractBodyAsMarkdown_DigestCap(t *testing.T) {
+	defer func(n int64) { maxDigestMessages = n }(maxDigestMessages)
+	maxDigestMessages = 1
+
+	got, err := extractBodyAsMarkdown(mustFixture(t, "digest.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(got, "Digest message 2") {
+		t.Errorf("expected only the first digest message, got:\n%s", got)
+	}
+	if !strings.HasSuffix(got, "_Showing the first 1 of 2 digest messages._") {
+		t.Errorf("expected a note of the messages left out, got:\n%s", got)
+	}
+}
+
+func TestExtractEmail(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         *mail.Message
+		wantType    string
+		wantCharset string
+		wantAtts    []AttachmentMeta
+		truncated   bool
+		warnings    int
+	}{
+		{
+			name:        "plain with inline image",
+			msg:         mustFixture(t, "apple-mail-inline-image.eml"),
+			wantType:    "text/plain",
+			wantCharset: "us-ascii",
+			wantAtts:    []AttachmentMeta{{Filename: "Screenshot 2025-03-04 at 10.12.03.png", ContentType: "image/png"}},
+		},
+		{
+			name:        "html instead of stub",
+			msg:         mustFixture(t, "crm-view-in-browser.eml"),
+			wantType:    "text/html",
+			wantCharset: "utf-8",
+		},
+		{
+			name:        "truncated",
+			msg:         mustFixture(t, "truncated-html.eml"),
+			wantType:    "text/plain",
+			wantCharset: "UTF-8",
+			truncated:   true,
+			warnings:    1,
+		},
+		{
+			name:        "single part",
+			msg:         mustMessage(t, "Content-Type: text/html; charset=iso-8859-1\r\n\r\n<p>Hi</p>\r\n"),
+			wantType:    "text/html",
+			wantCharset: "iso-8859-1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ExtractEmail(context.Background(), tc.msg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.SourceType != tc.wantType || got.Charset != tc.wantCharset {
+				t.Errorf("source: got=%s (%s) want=%s (%s)", got.SourceType, got.Charset, tc.wantType, tc.wantCharset)
+			}
+			if !reflect.DeepEqual(got.Attachments, tc.wantAtts) {
+				t.Errorf("attachments: got=%+v want=%+v", got.Attachments, tc.wantAtts)
+			}
+			if got.Truncated != tc.truncated || len(got.Warnings) != tc.warnings {
+				t.Errorf("truncated=%v warnings=%q, want truncated=%v and %d warnings",
+					got.Truncated, got.Warnings, tc.truncated, tc.warnings)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_HTMLMetaCharset(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "shift-jis-meta.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "いつもお世話になっております。\n\nジョブが失敗しました。ログを確認していただけますか。"
+	if !strings.Contains(got, want) {
+		t.Errorf("expected the Shift-JIS body decoded, got %q", got)
+	}
+}
+
+func TestExtractBodyAsMarkdown_HTMLMetaCharset7Bit(t *testing.T) {
+	// ISO-2022-JP is valid UTF-8, so only the <meta> tag tells it apart
+	raw := "Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"PG1ldGEgY2hhcnNldD0iaXNvLTIwMjItanAiPjxwPhskQiU4JWclViQsPDpHVCQ3JF4kNyQ/ISMbKEI8L3A+\r\n"
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "ジョブが失敗しました。" {
+		t.Errorf("expected the ISO-2022-JP body decoded, got %q", got)
+	}
+}
+
+func TestExtractEmail_AttachedBody(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    string
+		file    AttachmentMeta
+	}{
+		{
+			fixture: "scanner-text-attachment.eml",
+			want:    "Sample 42 failed QC on the second run.\nReadings attached in the LIMS.",
+			file:    AttachmentMeta{Filename: "scan.txt", ContentType: "text/plain"},
+		},
+		{
+			fixture: "html-attachment.eml",
+			want:    "# Nightly report\n\n3 jobs failed, see the CI dashboard (https://ci.example.com/nightly).",
+			file:    AttachmentMeta{Filename: "report.html", ContentType: "text/html"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			got, err := ExtractEmail(context.Background(), mustFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Body != tc.want {
+				t.Errorf("body mismatch:\n--- got ---\n%q\n--- want ---\n%q", got.Body, tc.want)
+			}
+			if !got.BodyFromAttachment || !reflect.DeepEqual(got.Attachments, []AttachmentMeta{tc.file}) {
+				t.Errorf("expected %+v listed as an attachment, got %+v", tc.file, got.Attachments)
+			}
+		})
+	}
+
+	defer func(n int64) { maxInlineTextBytes = n }(maxInlineTextBytes)
+	maxInlineTextBytes = 20
+	for _, tc := range tests {
+		got, err := ExtractEmail(context.Background(), mustFixture(t, tc.fixture))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Body != "" || len(got.Attachments) != 1 || len(got.Warnings) != 1 {
+			t.Errorf("%s: expected a large attachment to be listed only, got %+v", tc.fixture, got)
+		}
+	}
+}
+
+func TestHideQuotedPart_QuoteContainers(t *testing.T) {
+	defer func(b bool) { preferHTML = b }(preferHTML)
+	preferHTML = true
+	tests := []struct {
+		fixture string
+		visible string
+		quoted  string
+	}{
+		{"gmail-reply.eml", "Merci, l'environnement fonctionne maintenant. Camille", "> Please run \"module load Anaconda3\" before activating the environment."},
+		{"outlook-desktop-reply.eml", "Danke, der Job läuft jetzt. Jonas", "> Your job asked for 8 GPUs on one node; the largest nodes have 4."},
+		{"owa-quoted-reply.eml", "Gracias, ya puedo acceder. Lucía", "> Your group has been added to the project share; please log in again."},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			md, err := extractBodyAsMarkdown(mustFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the visible text is compared with its whitespace collapsed
+			got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions())
+			if visible := strings.Join(strings.Fields(got), " "); visible != tc.visible {
+				t.Errorf("quote not hidden:\n--- markdown ---\n%s\n--- got ---\n%q", md, got)
+			}
+			got = hideQuotedPart(md, quotedCollapse, defaultQuoteOptions())
+			visible, quoted, ok := strings.Cut(got, "<details>\n<summary>Show quoted email</summary>\n\n")
+			if !ok || strings.Join(strings.Fields(visible), " ") != tc.visible || !strings.Contains(quoted, "\n"+tc.quoted+"\n") ||
+				strings.Contains(got, "> >") || strings.Contains(got, quotedEmailMarker) {
+				t.Errorf("quote not collapsed into details, got:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestExtractBodyAsMarkdown_ReflowBRParagraphs(t *testing.T) {
+	defer func(o HTMLConvertOptions) { htmlOptions = o }(htmlOptions)
+	htmlOptions.ReflowBRParagraphs = true
+	got, err := extractBodyAsMarkdown(mustFixture(t, "mainframe-gateway.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "The nightly archive job for the research data store did not complete " +
+		"successfully. The transfer of the project volumes stopped after 3 hours " +
+		"when the tape library reported that no scratch tapes were available.\n\n" +
+		"Volumes affected:\n\\- PROJ01 (partially written)\n\\- PROJ07 (not started)\n\n" +
+		"The job will be retried automatically at 22:00 tonight. If the retry " +
+		"also fails, please contact the storage team so that tapes can be added " +
+		"to the library before the weekend.\n\n" +
+		"Operations\nResearch Data Services\n\n" +
+		"```\nRC=0012  STEP=ARCHV02\nABEND S613\n```"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	htmlOptions.ReflowBRParagraphs = false
+	got, err = extractBodyAsMarkdown(mustFixture(t, "mainframe-gateway.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(got, "The nightly archive job for the research data store did not complete\nsuccessfully.") {
+		t.Errorf("lines joined without REFLOW_BR_PARAGRAPHS:\n%s", got)
+	}
+}
+
+func TestExtractBodyAsMarkdown_StyledHeadings(t *testing.T) {
+	got, err := extractBodyAsMarkdown(mustFixture(t, "owa-report.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "Hi all,\n\nHere is the report on last week's migration of the group shares.\n\n" +
+		"## Summary\n\n" +
+		"All 42 shares were copied. **Two shares need to be checked by their owners.** The old file server will be switched off on 31 March.\n\n" +
+		"## Problems found\n\n" +
+		"Some file names were too long for the new system and have been shortened.\n\n" +
+		"**Shares to check:**\n\n- zoology-imaging\n- physics-lab3\n\n" +
+		"### Next steps\n\n" +
+		"Owners have been emailed and asked to reply by Friday.\n\n" +
+		"Best wishes,\n\n**Megan Price**\n\nResearch Data Services"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	defer func(o HTMLConvertOptions) { htmlOptions = o }(htmlOptions)
+	htmlOptions.StyledHeadings = false
+	got, err = extractBodyAsMarkdown(mustFixture(t, "owa-report.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(got, "#") || !strings.Contains(got, "\n\n**Summary**\n\n") {
+		t.Errorf("headings made with DISABLE_STYLED_HEADINGS:\n%s", got)
+	}
+}
+
+func TestIsEmptyReply(t *testing.T) {
+	quote := "On Tue, 18 Mar 2025 at 17:03, Research Computing <support@example.ac.uk> wrote:\n> Please try again."
+	tests := []struct {
+		name           string
+		md             string
+		hasAttachments bool
+		minChars       int
+		want           bool
+	}{
+		{"only quoted text", quote, false, 1, true},
+		{"whitespace and punctuation", "  \n...\n\n" + quote, false, 1, true},
+		{"a one word reply", "Thanks\n\n" + quote, false, 1, false},
+		{"a short reply under the minimum", "ok\n\n" + quote, false, 3, true},
+		{"an attachment", quote, true, 1, false},
+		{"disabled", quote, false, 0, false},
+		{"no quoted text", "", false, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := SplitQuoted(tt.md, defaultQuoteOptions())
+			if got := isEmptyReply(parts, tt.hasAttachments, tt.minChars); got != tt.want {
+				t.Errorf("isEmptyReply(%q) = %v, want %v", tt.md, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_StrayQuoteMarkers(t *testing.T) {
+	md, err := extractBodyAsMarkdown(mustFixture(t, "gmail-stray-quote-markers.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	visible := "I've cleared out the old checkpoints, it's down to 1.2 TB now.\n\nPriya"
+	if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != visible+"\n" {
+		t.Errorf("stray quote markers not removed:\n--- markdown ---\n%s\n--- got ---\n%q", md, got)
+	}
+	want := visible + "\n\n<details>\n<summary>Show quoted email</summary>\n\n" +
+		"> On Wed, 9 Apr 2025 at 16:40, Research Computing <rc@example.ac.uk> wrote:\n>\n" +
+		"> Your scratch usage is 2.4 TB against a quota of 2 TB.\n>\n> Regards,\n> Research Computing\n\n</details>"
+	if got := hideQuotedPart(md, quotedCollapse, defaultQuoteOptions()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCollapseQuoteMarkers(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{">\n> \n> Please try again.\n>\n>\n> >\n> Regards\n>\n\\>", "> Please try again.\n>\n> Regards"},
+		{"&gt;\n> Please try again.\n&gt; ", "> Please try again."},
+		{"> Please try again.\n>\n> Regards", "> Please try again.\n>\n> Regards"},
+	}
+	for _, tc := range tests {
+		if got := collapseQuoteMarkers(tc.in); got != tc.want {
+			t.Errorf("collapseQuoteMarkers(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestHideQuotedPart_Forwards(t *testing.T) {
+	headers := "From: Licensing Team <licensing@example.com>\nDate: Mon, 14 Apr 2025 at 17:30\n" +
+		"Subject: Licence server maintenance\nTo: <tom.okafor@example.ac.uk>"
+	notice := "Dear customer,\n\nThe licence server will be unavailable on 22 April from 08:00 to 12:00 BST while it is upgraded."
+
+	t.Run("pure forward", func(t *testing.T) {
+		md, err := extractBodyAsMarkdown(mustFixture(t, "gmail-forward.eml"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := "\\---------- Forwarded message ---------\n" +
+			"From: **Licensing Team** <licensing@example.com>\nDate: Mon, 14 Apr 2025 at 17:30\n" +
+			"Subject: Licence server maintenance\nTo: <tom.okafor@example.ac.uk>\n\n" + notice + "\n\nLicensing Team"
+		for _, mode := range []quotedTextMode{quotedRemove, quotedCollapse} {
+			if got := hideQuotedPart(md, mode, defaultQuoteOptions()); got != want {
+				t.Errorf("%s mode, got:\n%s\nwant:\n%s", mode, got, want)
+			}
+		}
+	})
+
+	tests := []struct {
+		name, md, want string
+	}{
+		{
+			name: "covering note",
+			md:   "FYI, see below.\n\n---------- Forwarded message ---------\n" + headers + "\n\n" + notice,
+			want: "FYI, see below.\n\n---------- Forwarded message ---------\n" + headers + "\n\n" + notice,
+		},
+		{
+			name: "Apple Mail",
+			md:   "Begin forwarded message:\n\n> " + strings.ReplaceAll(headers, "\n", "\n> ") + "\n>\n> Dear customer,",
+			want: "Begin forwarded message:\n\n> " + strings.ReplaceAll(headers, "\n", "\n> ") + "\n>\n> Dear customer,",
+		},
+		{
+			name: "reply quoting a forward",
+			md: "Thanks, we'll plan around it.\n\nOn Tue, 15 Apr 2025 at 11:02, Tom Okafor <tom.okafor@example.ac.uk> wrote:\n" +
+				"> ---------- Forwarded message ---------\n> " + strings.ReplaceAll(headers, "\n", "\n> ") + "\n>\n> Dear customer,",
+			want: "Thanks, we'll plan around it.\n",
+		},
+		{
+			name: "long note before a forward",
+			md: "Hi,\n\nThe licensing team sent the notice below.\n\nCan we move the training session?\n\n" +
+				"Begin forwarded message:\n\n> " + strings.ReplaceAll(headers, "\n", "\n> "),
+			want: "Hi,\n\nThe licensing team sent the notice below.\n\nCan we move the training session?\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hideQuotedPart(tc.md, quotedRemove, defaultQuoteOptions()); got != tc.want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHideQuotedPart_HTMLQuoteContainers(t *testing.T) {
+	// no reply headers and no runs of ">" lines start the quoted part:
+	// the quote containers of the HTML must
+	opts := quoteOptions{minLines: math.MaxInt, replacePatterns: true}
+	tests := []struct {
+		fixture, visible, quoted string
+	}{
+		{"apple-mail-html-reply.eml", "Danke, der Zugang funktioniert jetzt.\n\nJonas", "> Am 22.04.2025 um 17:12 schrieb Research Computing <rc@example.ac.uk>:"},
+		{"thunderbird-reply.eml", "Bedankt, ik zie nu 5 TB.\n\nSanne", "> Op 23-04-2025 om 16:48 schreef Research Computing:"},
+		{"yahoo-reply.eml", "Obrigada, a licença já está ativa.\n\nAna", "> Em quinta-feira, 24 de abril de 2025, 18:03:11 WEST, Research Computing <rc@example.ac.uk> escreveu:"},
+		{"protonmail-reply.eml", "Grazie, la VPN ora funziona.\n\nLuca", "> Il lunedì 28 aprile 2025 alle 09:12, Research Computing <rc@example.ac.uk> ha scritto:"},
+		{"gmail-stray-quote-markers.eml", "I've cleared out the old checkpoints, it's down to 1.2 TB now.\n\nPriya", "> On Wed, 9 Apr 2025 at 16:40, Research Computing <rc@example.ac.uk> wrote:"},
+		{"owa-quoted-reply.eml", "Gracias, ya puedo acceder.\n\nLucía", "> **De:** Research Computing <rc@example.ac.uk>"},
+		{"outlook-desktop-reply.eml", "Danke, der Job läuft jetzt.\n\nJonas", "> **Von:** Research Computing <rc@example.ac.uk>"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			md, err := extractBodyAsMarkdown(mustFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			parts := SplitQuoted(md, opts)
+			if parts.Visible != tc.visible || !strings.HasPrefix(parts.Quoted, tc.quoted+"\n") {
+				t.Errorf("quote not found:\n--- markdown ---\n%s\n--- got ---\n%#v", md, parts)
+			}
+		})
+	}
+
+	t.Run("answers between quotes", func(t *testing.T) {
+		md, err := htmlToPlain(`<div>See below.</div><blockquote type="cite"><div>Which module did you load?</div></blockquote>` +
+			`<div>CUDA 12.4</div><blockquote type="cite"><div>And which partition?</div></blockquote><div>gpu-short</div>`)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := "See below.\n\n<details>\n<summary>Show quoted email</summary>\n\n> Which module did you load?\n\n</details>\n\n" +
+			"CUDA 12.4\n\n<details>\n<summary>Show quoted email</summary>\n\n> And which partition?\n\n</details>\n\ngpu-short"
+		if got := hideQuotedPart(md, quotedRemove, opts); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
+
+// quotedTextModeEmail is the email the QUOTED_TEXT_MODE tests post in
+// each mode
+func quotedTextModeEmail(t *testing.T) string {
+	t.Helper()
+	md, err := extractBodyAsMarkdown(mustFixture(t, "outlook-desktop-reply.eml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return md
+}
+
+const quotedTextModeQuote = "> **Von:** Research Computing <rc@example.ac.uk>\n> **Gesendet:** Montag, 3. März 2025 17:40\n" +
+	"> **An:** Jonas Weber <jonas.weber@example.de>\n> **Betreff:** [215] GPU job pending\n>\n" +
+	"> Your job asked for 8 GPUs on one node; the largest nodes have 4.\n>\n> Research Computing"
+
+func TestHideQuotedPart_RemoveMode(t *testing.T) {
+	want := "Danke, der Job läuft jetzt.\n\nJonas\n"
+	if got := hideQuotedPart(quotedTextModeEmail(t), quotedRemove, defaultQuoteOptions()); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestHideQuotedPart_CollapseMode(t *testing.T) {
+	want := "Danke, der Job läuft jetzt.\n\nJonas\n\n<details>\n<summary>Show quoted email</summary>\n\n" +
+		quotedTextModeQuote + "\n\n</details>"
+	if got := hideQuotedPart(quotedTextModeEmail(t), quotedCollapse, defaultQuoteOptions()); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestHideQuotedPart_KeepMode(t *testing.T) {
+	want := "Danke, der Job läuft jetzt.\n\nJonas\n\n" + quotedTextModeQuote
+	if got := hideQuotedPart(quotedTextModeEmail(t), quotedKeep, defaultQuoteOptions()); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestHideQuotedPart_OriginalMessageSeparators(t *testing.T) {
+	tests := []struct {
+		fixture, visible, separator string
+	}{
+		{"de-outlook-original-message.eml", "Hallo,\n\nder Antrag ist jetzt unterschrieben, ich schicke ihn heute noch ab.\n\nGrüße\nKatrin Schulz", "-----Ursprüngliche Nachricht-----"},
+		{"fr-outlook-original-message.eml", "Bonjour,\n\nC'est bon, j'arrive à me connecter.\n\nJulien", "_____Message d'origine_____"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			md, err := extractBodyAsMarkdown(mustFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the quoted part starts at the separator, not the header
+			// block after it
+			parts := SplitQuoted(md, defaultQuoteOptions())
+			if parts.Visible != tc.visible || !strings.HasPrefix(parts.Quoted, tc.separator+"\n") {
+				t.Errorf("quote not found:\n--- markdown ---\n%s\n--- got ---\n%#v", md, parts)
+			}
+		})
+	}
+
+	for _, sep := range []string{
+		"-----Original Message-----",
+		"-----Oryginalna wiadomość-----",
+		"-------- Původní zpráva --------",
+		"-----Alkuperäinen viesti-----",
+		"______ Исходное сообщение ______",
+		`\_\_\_\_\_Message d’origine\_\_\_\_\_`,
+		`\-\-\-\-\-Messaggio originale\-\-\-\-\-`,
+	} {
+		md := "Thanks, that fixed it.\n\n" + sep + "\nPlease try again."
+		if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != "Thanks, that fixed it.\n" {
+			t.Errorf("hideQuotedPart(%q) = %q", md, got)
+		}
 	}
 }
@@ -1,13 +1,238 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/mail"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
+
+	"golang.org/x/net/html/charset"
 )
 
-// extractIssueNumber scans To and Cc headers and returns the first numeric local-part found.
-func extractIssueNumber(toHeader, ccHeader string) string {
+// headerDecoder decodes RFC 2047 encoded-words, supporting the same
+// charsets as message bodies
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, input)
+	},
+}
+
+// addressParser parses address lists with encoded-word display names
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+// decodeHeader decodes RFC 2047 encoded-words in a header value, such as
+// "=?UTF-8?B?...?=" in Subject and From. Adjacent encoded-words are joined.
+// If the value cannot be decoded, it is returned unchanged.
+func decodeHeader(v string) string {
+	d, err := headerDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return d
+}
+
+// partFilename returns the decoded filename of a MIME part, from the
+// filename parameter of its Content-Disposition or else the name
+// parameter of its Content-Type, or "" if it has neither
+func partFilename(h textprotoHeader) string {
+	if name := headerParam(h.Get("Content-Disposition"), "filename"); name != "" {
+		return name
+	}
+	return headerParam(h.Get("Content-Type"), "name")
+}
+
+// headerParam returns the decoded value of a parameter of a structured
+// header value such as Content-Disposition. Unlike mime.ParseMediaType it
+// decodes RFC 2231 extended values (name*=charset'lang'%XX, and continued
+// as name*0*, name*1*, ...) in any charset, ignores malformed parameters
+// rather than failing, and decodes the RFC 2047 encoded-words that many
+// mailers put in quoted filenames.
+func headerParam(v, name string) string {
+	name = strings.ToLower(name)
+	var plain string
+	segs := map[int]string{}
+	encoded := map[int]bool{}
+	for _, p := range splitParams(v) {
+		k, val, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		val = unquoteParam(strings.TrimSpace(val))
+		switch {
+		case k == name:
+			plain = val
+		case k == name+"*":
+			segs[0], encoded[0] = val, true
+		case strings.HasPrefix(k, name+"*"):
+			idx := k[len(name)+1:]
+			n, err := strconv.Atoi(strings.TrimSuffix(idx, "*"))
+			if err != nil || n < 0 {
+				continue
+			}
+			segs[n], encoded[n] = val, strings.HasSuffix(idx, "*")
+		}
+	}
+
+	// the charset and language prefix only the first segment
+	var b []byte
+	cs := ""
+	for i := 0; ; i++ {
+		s, ok := segs[i]
+		if !ok {
+			break
+		}
+		if !encoded[i] {
+			b = append(b, s...)
+			continue
+		}
+		if i == 0 {
+			if parts := strings.SplitN(s, "'", 3); len(parts) == 3 {
+				cs, s = parts[0], parts[2]
+			}
+		}
+		b = append(b, percentDecode(s)...)
+	}
+	if len(b) == 0 {
+		return decodeHeader(plain)
+	}
+	return string(decodeCharset(b, cs))
+}
+
+// splitParams splits the parameters of a header value at semicolons
+// outside quoted strings, dropping the leading media type or disposition
+func splitParams(v string) []string {
+	var params []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			params = append(params, v[start:i])
+			start = i + 1
+		}
+	}
+	params = append(params, v[start:])
+	return params[1:]
+}
+
+// unquoteParam removes the quotes and backslash escapes of a quoted
+// parameter value
+func unquoteParam(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range v[1 : len(v)-1] {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// percentDecode decodes %XX escapes, leaving malformed escapes as they are
+func percentDecode(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			n, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b = append(b, byte(n))
+			i += 2
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// obsoleteZones maps the obsolete time zone names allowed by RFC 5322,
+// and others seen in the wild, to numeric offsets
+var obsoleteZones = map[string]string{
+	"UT": "+0000", "UTC": "+0000", "GMT": "+0000", "Z": "+0000",
+	"EST": "-0500", "EDT": "-0400",
+	"CST": "-0600", "CDT": "-0500",
+	"MST": "-0700", "MDT": "-0600",
+	"PST": "-0800", "PDT": "-0700",
+	"BST": "+0100", "CET": "+0100", "CEST": "+0200",
+}
+
+// dateLayouts are tried for Date headers that mail.ParseDate rejects
+var dateLayouts = []string{
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 January 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006 -0700",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	time.RFC3339,
+}
+
+// parseDate parses a Date header, tolerating common deviations from
+// RFC 5322: a missing weekday or seconds, named time zones and trailing
+// comments such as "(UTC)"
+func parseDate(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if i := strings.IndexByte(v, '('); i > 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	fields := strings.Fields(v)
+	if len(fields) > 1 {
+		last := strings.ToUpper(fields[len(fields)-1])
+		if off, ok := obsoleteZones[last]; ok {
+			fields[len(fields)-1] = off
+		}
+	}
+	v = strings.Join(fields, " ")
+	if t, err := mail.ParseDate(v); err == nil {
+		return t, nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date format %q", v)
+}
+
+// extractTargets scans To and Cc headers and returns the issues of the
+// ticket addresses found, see extractTarget, in the order they appear. An
+// issue is returned once, as it first appears. Addresses with an unknown
+// route are logged and skipped.
+func extractTargets(toHeader, ccHeader string) []ticketTarget {
+	var targets []ticketTarget
+	add := func(local, domain string) {
+		t, err := extractTarget(local, domain)
+		if err != nil {
+			log.Printf("ignoring ticket address %s@%s: %v", local, domain, err)
+			return
+		}
+		if t.issue != "" && !slices.ContainsFunc(targets, t.same) {
+			targets = append(targets, t)
+		}
+	}
 	// Combine headers; ParseAddressList handles comma-separated lists
 	headers := []string{toHeader, ccHeader}
 
@@ -15,7 +240,7 @@ func extractIssueNumber(toHeader, ccHeader string) string {
 		if h == "" {
 			continue
 		}
-		addrs, err := mail.ParseAddressList(h)
+		addrs, err := addressParser.ParseList(h)
 		if err != nil {
 			// fallback: naive split
 			parts := strings.FieldsFunc(h, func(r rune) bool {
@@ -24,9 +249,7 @@ func extractIssueNumber(toHeader, ccHeader string) string {
 			for _, p := range parts {
 				if strings.Contains(p, "@") {
 					stringParts := strings.SplitN(p, "@", 2)
-					if isDigits(stringParts[0]) && stringParts[1] == ticketDomain {
-						return stringParts[0]
-					}
+					add(stringParts[0], stringParts[1])
 				}
 			}
 			continue
@@ -40,22 +263,161 @@ func extractIssueNumber(toHeader, ccHeader string) string {
 			if len(parts) != 2 {
 				continue
 			}
-			local := parts[0]
-			domain := parts[1]
-			if isDigits(local) && domain == ticketDomain {
-				return local
-			}
+			add(parts[0], parts[1])
+		}
+	}
+	return targets
+}
+
+// sameIssue reports whether two issue numbers are the same, 0042 and 42
+func sameIssue(a, b string) bool {
+	return strings.TrimLeft(a, "0") == strings.TrimLeft(b, "0")
+}
+
+// defaultTicketAddressSeparator separates TICKET_ADDRESS_PREFIX from the
+// issue number
+const defaultTicketAddressSeparator = "+"
+
+// issueFromAddress returns the issue number of an address at
+// ticketDomain, whatever its case: a numeric local part (123@issues.example.com) or, if
+// ticketAddressPrefix is set, the prefix, the separator and the number
+// (issues+123@example.com). The number is returned as it is, leading zeros
+// and all.
+func issueFromAddress(local, domain string) string {
+	if !strings.EqualFold(domain, ticketDomain) {
+		return ""
+	}
+	if isDigits(local) {
+		return local
+	}
+	if ticketAddressPrefix != "" {
+		if n, ok := strings.CutPrefix(local, ticketAddressPrefix+ticketAddressSeparator); ok && isDigits(n) {
+			return n
 		}
 	}
 	return ""
 }
 
+// findTargets returns the issues of the ticket addresses in the To and Cc
+// headers of a message or, failing those, the issue of the one it was
+// delivered to (when it was BCC'd), the one in its subject (unless
+// DISABLE_SUBJECT_ISSUE_NUMBER is set, always of GITHUB_PROJECT) or that
+// of the GitHub notification it replies to. source says where an issue
+// that is not from the To or Cc header came from.
+func findTargets(h mail.Header) (targets []ticketTarget, source string) {
+	if targets = extractTargets(h.Get("To"), h.Get("Cc")); len(targets) > 0 {
+		return targets, ""
+	}
+	if t := extractEnvelopeTarget(h); t.issue != "" {
+		return []ticketTarget{t}, "envelope recipient"
+	}
+	if subjectIssueNumbers {
+		if issue := extractSubjectIssueNumber(decodeHeader(h.Get("Subject"))); issue != "" {
+			return []ticketTarget{{githubProject, issue}}, "subject"
+		}
+	}
+	if t := extractReferencedTarget(h.Get("In-Reply-To"), h.Get("References")); t.issue != "" {
+		return []ticketTarget{t}, "GitHub notification replied to"
+	}
+	return nil, ""
+}
+
+// receivedForRe matches the recipient of a Received header,
+// "... for <123@issues.example.com>; Tue, 4 Mar 2025 ..."
+var receivedForRe = regexp.MustCompile(`(?i)\bfor\s+<?([^\s<>;@]+@[^\s<>;]+?)>?\s*(?:;|$)`)
+
+// extractEnvelopeTarget returns the issue of the ticket address a message
+// was delivered to, for a message that was BCC'd to it. The envelope
+// headers are tried in order: Delivered-To, then X-Original-To, then the
+// "for" clauses of the Received headers, newest (topmost) first. Only
+// ticket addresses count. The receipt.recipients of the SES event are not
+// consulted, as only the message stored in S3 is read; the Received header
+// SES adds names the envelope recipient instead.
+func extractEnvelopeTarget(h mail.Header) ticketTarget {
+	var addrs []string
+	addrs = append(addrs, h["Delivered-To"]...)
+	addrs = append(addrs, h["X-Original-To"]...)
+	for _, v := range h["Received"] {
+		if m := receivedForRe.FindStringSubmatch(v); m != nil {
+			addrs = append(addrs, m[1])
+		}
+	}
+	for _, a := range addrs {
+		a = strings.Trim(strings.TrimSpace(a), "<>")
+		if local, domain, ok := strings.Cut(a, "@"); ok {
+			t, err := extractTarget(local, domain)
+			if err != nil {
+				log.Printf("ignoring envelope recipient %s: %v", a, err)
+			} else if t.issue != "" {
+				return t
+			}
+		}
+	}
+	return ticketTarget{}
+}
+
+// messageIDListRe matches the Message-IDs of In-Reply-To and References
+var messageIDListRe = regexp.MustCompile(`<[^<>\s]+>`)
+
+// githubThreadIDRe matches the Message-IDs GitHub gives notification
+// emails about an issue or pull request, e.g. <org/repo/issues/12@github.com>
+// and <org/repo/issues/12/2712345678@github.com> for a comment on it
+var githubThreadIDRe = regexp.MustCompile(`(?i)^<([^/<>\s]+/[^/<>\s]+)/(?:issues|pull)/(\d+)(?:/[^<>\s]*)?@github\.com>$`)
+
+// extractReferencedTarget returns the issue of GITHUB_PROJECT, or of a
+// repository of ROUTES, whose GitHub notification a message replies to,
+// going by the Message-IDs of In-Reply-To and then References, the most
+// recent first. Malformed Message-IDs are skipped.
+func extractReferencedTarget(inReplyTo, references string) ticketTarget {
+	ids := messageIDListRe.FindAllString(inReplyTo, -1)
+	refs := messageIDListRe.FindAllString(references, -1)
+	slices.Reverse(refs)
+	for _, id := range append(ids, refs...) {
+		if m := githubThreadIDRe.FindStringSubmatch(id); m != nil {
+			if repo := routedRepo(m[1]); repo != "" {
+				return ticketTarget{repo, m[2]}
+			}
+		}
+	}
+	return ticketTarget{}
+}
+
+// subjectIssueRe returns the pattern of an issue number in a subject:
+// "(#123)", "[#123]" or "[repo #123]", where repo is the name of the
+// project, with or without its owner. A number without the hash and
+// brackets, which could be anything, does not count.
+func subjectIssueRe(project string) *regexp.Regexp {
+	names := []string{}
+	if project != "" {
+		names = append(names, regexp.QuoteMeta(project))
+		if _, repo, ok := strings.Cut(project, "/"); ok {
+			names = append(names, regexp.QuoteMeta(repo))
+		}
+	}
+	prefix := ""
+	if len(names) > 0 {
+		prefix = `(?:(?:` + strings.Join(names, "|") + `) )?`
+	}
+	return regexp.MustCompile(`(?i)\(#(\d+)\)|\[` + prefix + `#(\d+)\]`)
+}
+
+// extractSubjectIssueNumber returns the issue number in a subject, e.g.
+// "Re: Broken cluster login (#123)", for replies that are not addressed to
+// the ticket address, or ""
+func extractSubjectIssueNumber(subject string) string {
+	m := subjectIssuePattern.FindStringSubmatch(subject)
+	if m == nil {
+		return ""
+	}
+	return m[1] + m[2]
+}
+
 // extractSenderDomain parses the From header and returns the domain (lowercased) or empty string.
 func extractSenderDomain(fromHeader string) string {
 	if fromHeader == "" {
 		return ""
 	}
-	addr, err := mail.ParseAddress(fromHeader)
+	addr, err := addressParser.Parse(fromHeader)
 	if err != nil {
 		// fallback regex-ish parse
 		if strings.Contains(fromHeader, "@") {
@@ -73,6 +435,93 @@ func extractSenderDomain(fromHeader string) string {
 	return strings.ToLower(parts[1])
 }
 
+// domainAllowed reports whether sender is the domain allowed or one of its
+// subdomains, ignoring case and a trailing dot: sub.example.com is allowed
+// by example.com, but notexample.com is not
+func domainAllowed(sender, allowed string) bool {
+	sender = strings.ToLower(strings.TrimSuffix(sender, "."))
+	allowed = strings.ToLower(strings.TrimSuffix(allowed, "."))
+	if sender == "" || allowed == "" {
+		return false
+	}
+	return sender == allowed || strings.HasSuffix(sender, "."+allowed)
+}
+
+// domainRe matches a domain name
+var domainRe = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]*[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]*[a-z0-9])?)*$`)
+
+// parseDomains parses a comma-separated list of domains, such as
+// WHITELIST_DOMAIN, lowercased and without a trailing dot. Empty entries
+// are skipped.
+func parseDomains(s string) ([]string, error) {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		if d == "" {
+			continue
+		}
+		if !domainRe.MatchString(d) {
+			return nil, fmt.Errorf("invalid domain %q", d)
+		}
+		if !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	return domains, nil
+}
+
+// anyDomainAllowed reports whether sender is allowed by any of the domains,
+// see domainAllowed
+func anyDomainAllowed(sender string, allowed []string) bool {
+	return slices.ContainsFunc(allowed, func(a string) bool { return domainAllowed(sender, a) })
+}
+
+// extractSenderAddress parses the From header and returns the address
+// (lowercased) or empty string
+func extractSenderAddress(fromHeader string) string {
+	addr, err := addressParser.Parse(fromHeader)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(addr.Address)
+}
+
+// parseAddresses parses a comma-separated list of email addresses, such as
+// SENDER_ALLOWLIST, lowercased. Empty entries are skipped.
+func parseAddresses(s string) ([]string, error) {
+	var addresses []string
+	for _, a := range strings.Split(s, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "" {
+			continue
+		}
+		local, domain, ok := strings.Cut(a, "@")
+		if !ok || local == "" || strings.ContainsAny(local, " <>\"") || !domainRe.MatchString(domain) {
+			return nil, fmt.Errorf("invalid address %q", a)
+		}
+		if !slices.Contains(addresses, a) {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses, nil
+}
+
+// senderRejection returns why a sender is not allowed to email tickets, or
+// "" if they are. SENDER_BLOCKLIST is checked first, then
+// SENDER_ALLOWLIST and then WHITELIST_DOMAIN, so a blocked address is
+// rejected even if it is also allowed.
+func senderRejection(address, domain string) string {
+	switch {
+	case address != "" && slices.Contains(senderBlocklist, address):
+		return fmt.Sprintf("%s is in SENDER_BLOCKLIST", address)
+	case address != "" && slices.Contains(senderAllowlist, address):
+		return ""
+	case !anyDomainAllowed(domain, whitelistDomains):
+		return fmt.Sprintf("%s is not at a WHITELIST_DOMAIN domain (%s)", domain, strings.Join(whitelistDomains, ", "))
+	}
+	return ""
+}
+
 func passesEmailAuth(h mail.Header) bool {
 	v := strings.ToLower(h.Get("Authentication-Results"))
 	return strings.Contains(v, "spf=pass") || strings.Contains(v, "dkim=pass")
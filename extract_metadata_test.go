@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"slices"
+	"strings"
+	"testing"
+)
 
 func setupTests(t *testing.T) {
 	t.Setenv("TICKET_DISPATCHER_DOMAIN", "issues.example.com")
@@ -8,6 +12,16 @@ func setupTests(t *testing.T) {
 	t.Setenv("GITHUB_PROJECT", "example/repo")
 	loadConfig()
 }
+
+// issuesOf returns the issue numbers of targets
+func issuesOf(targets []ticketTarget) []string {
+	var issues []string
+	for _, t := range targets {
+		issues = append(issues, t.issue)
+	}
+	return issues
+}
+
 func TestExtractIssueNumber(t *testing.T) {
 	setupTests(t)
 	tests := []struct {
@@ -20,13 +34,185 @@ func TestExtractIssueNumber(t *testing.T) {
 		{to: "John Doe <johndoe@example.com>, 123@issues.example.com",
 			want: "123",
 		},
+		{to: "support+0042@issues.example.com", want: ""},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.to, func(t *testing.T) {
-			got := extractIssueNumber(tc.to, "")
+			got := strings.Join(issuesOf(extractTargets(tc.to, "")), ",")
 			if got != tc.want {
-				t.Errorf("extractIssueNumber mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+				t.Errorf("extractTargets mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractTargets_Multiple(t *testing.T) {
+	setupTests(t)
+	defer func(p string) { ticketAddressPrefix = p }(ticketAddressPrefix)
+	ticketAddressPrefix = "support"
+	tests := []struct {
+		name, to, cc string
+		want         []string
+	}{
+		{"two issues", "12@issues.example.com, 34@issues.example.com", "", []string{"12", "34"}},
+		{"in To and Cc", "34@issues.example.com", "Ann <ann@example.com>, 12@issues.example.com", []string{"34", "12"}},
+		{"duplicate across To and Cc", "12@issues.example.com, 34@issues.example.com", "Issue 12 <12@issues.example.com>", []string{"12", "34"}},
+		{"leading zeros", "support+0012@issues.example.com", "12@issues.example.com, 34@issues.example.com", []string{"0012", "34"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// the order does not change between runs
+			for range 3 {
+				if got := issuesOf(extractTargets(tc.to, tc.cc)); !slices.Equal(got, tc.want) {
+					t.Fatalf("extractTargets(%q, %q) = %q, want %q", tc.to, tc.cc, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractIssueNumber_PlusAddress(t *testing.T) {
+	setupTests(t)
+	defer func(p, s string) { ticketAddressPrefix, ticketAddressSeparator = p, s }(ticketAddressPrefix, ticketAddressSeparator)
+	ticketAddressPrefix = "support"
+	tests := []struct {
+		to, separator, want string
+	}{
+		{"Support <support+0042@issues.example.com>", "+", "0042"},
+		{"support+42@example.com", "+", ""},
+		{"support+42@issues.example.com.evil.example", "+", ""},
+		{"123@issues.example.com", "+", "123"},
+		{"John Doe <johndoe@example.com>, support+7@issues.example.com", "+", "7"},
+		{"support+abc@issues.example.com", "+", ""},
+		{"helpdesk+42@issues.example.com", "+", ""},
+		{"support-42@issues.example.com", "-", "42"},
+		{"support+42@issues.example.com", "-", ""},
+		{"Support <support+42@Issues.Example.COM>", "+", "42"},
+		{"123@ISSUES.example.com", "+", "123"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.to, func(t *testing.T) {
+			ticketAddressSeparator = tc.separator
+			if got := strings.Join(issuesOf(extractTargets(tc.to, "")), ","); got != tc.want {
+				t.Errorf("extractTargets(%q) = %q, want %q", tc.to, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractSubjectIssueNumber(t *testing.T) {
+	setupTests(t)
+	tests := []struct {
+		subject, want string
+	}{
+		{"Re: Broken cluster login (#123)", "123"},
+		{"Re: Fwd: [#77] printer", "77"},
+		{"RE: [repo #0042] Licence renewal", "0042"},
+		{"Re: [example/repo #9] Disk quota", "9"},
+		{"Re: [other #9] Disk quota", ""},
+		{"Call me on 01865 270000 about ticket 123", ""},
+		{"Re: [214] Conda environment", ""},
+		{"Room #3 projector", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.subject, func(t *testing.T) {
+			if got := extractSubjectIssueNumber(tc.subject); got != tc.want {
+				t.Errorf("extractSubjectIssueNumber(%q) = %q, want %q", tc.subject, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindTargets(t *testing.T) {
+	setupTests(t)
+	defer func(b bool) { subjectIssueNumbers = b }(subjectIssueNumbers)
+	tests := []struct {
+		name, header string
+		subjects     bool
+		issue        string
+		source       string
+	}{
+		{"address and subject", "To: 123@issues.example.com\r\nSubject: Re: Broken cluster login (#45)\r\n", true, "123", ""},
+		{"subject", "To: Ann <ann@example.com>\r\nSubject: Re: Broken cluster login (#45)\r\n", true, "45", "subject"},
+		{"subject disabled", "To: Ann <ann@example.com>\r\nSubject: Re: Broken cluster login (#45)\r\n", false, "", ""},
+		{"no number", "To: Ann <ann@example.com>\r\nSubject: Re: Broken cluster login\r\n", true, "", ""},
+		{
+			"subject before references",
+			"To: Ann <ann@example.com>\r\nSubject: Re: Broken cluster login (#45)\r\nIn-Reply-To: <example/repo/issues/7@github.com>\r\n",
+			true, "45", "subject",
+		},
+		{
+			"most recent reference",
+			"To: Ann <ann@example.com>\r\nReferences: <example/repo/issues/7@github.com> <CAF1x2y3z@mail.example.com>\r\n" +
+				" <example/repo/pull/9/c2712345678@github.com> <malformed@\r\n",
+			true, "9", "GitHub notification replied to",
+		},
+		{
+			"another project",
+			"To: Ann <ann@example.com>\r\nIn-Reply-To: <other/repo/issues/7/2712345678@github.com>\r\n",
+			true, "", "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subjectIssueNumbers = tc.subjects
+			msg := mustMessage(t, tc.header+"\r\nbody\r\n")
+			if issues, source := findTargets(msg.Header); strings.Join(issuesOf(issues), ",") != tc.issue || source != tc.source {
+				t.Errorf("findTargets = %q, %q; want %q, %q", issues, source, tc.issue, tc.source)
+			}
+		})
+	}
+
+	t.Run("reply to a GitHub notification", func(t *testing.T) {
+		t.Setenv("GITHUB_PROJECT", "OxfordRSE/ticket-dispatcher")
+		loadConfig()
+		msg := mustFixture(t, "github-notification-reply.eml")
+		if issues, source := findTargets(msg.Header); strings.Join(issuesOf(issues), ",") != "123" || source != "GitHub notification replied to" {
+			t.Errorf("findTargets = %q, %q", issues, source)
+		}
+		if reason := headerLoopReason(msg.Header); reason != "" {
+			t.Errorf("reply taken for a mail loop: %s", reason)
+		}
+		body, err := extractBodyAsMarkdown(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reason := bodyLoopReason(body); reason != "" {
+			t.Errorf("reply taken for a mail loop: %s", reason)
+		}
+	})
+}
+
+func TestExtractEnvelopeTarget(t *testing.T) {
+	setupTests(t)
+	for fixture, want := range map[string]string{
+		"bcc-ticket-address.eml":  "123",
+		"list-received-chain.eml": "215",
+	} {
+		t.Run(fixture, func(t *testing.T) {
+			msg := mustFixture(t, fixture)
+			if issues, source := findTargets(msg.Header); strings.Join(issuesOf(issues), ",") != want || source != "envelope recipient" {
+				t.Errorf("findTargets = %q, %q; want %q from the envelope recipient", issues, source, want)
+			}
+		})
+	}
+
+	tests := []struct {
+		name, header, want string
+	}{
+		{"Delivered-To", "Delivered-To: 42@issues.example.com\r\nReceived: by mx for 7@issues.example.com;\r\n", "42"},
+		{"X-Original-To", "X-Original-To: <43@issues.example.com>\r\n", "43"},
+		{"unrelated Delivered-To", "Delivered-To: ann@example.com\r\nReceived: by mx for <44@issues.example.com>; Wed, 7 May 2025\r\n", "44"},
+		{"newest Received first", "Received: by mx for 45@issues.example.com;\r\nReceived: by relay for 46@issues.example.com;\r\n", "45"},
+		{"other domain", "Received: by mx for 47@issues.example.org;\r\nX-Original-To: 48@example.com\r\n", ""},
+		{"no for clause", "Received: from host.example.com by mx with SMTP id 49; Wed, 7 May 2025\r\n", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := mustMessage(t, tc.header+"\r\nbody\r\n")
+			if got := extractEnvelopeTarget(msg.Header).issue; got != tc.want {
+				t.Errorf("extractEnvelopeTarget = %q, want %q", got, tc.want)
 			}
 		})
 	}
@@ -41,6 +227,7 @@ func TestExtractSenderDomain(t *testing.T) {
 		{from: "John Doe <john.doe@example.com", want: "example.com"},
 		{from: "jane.doe@example.com", want: "example.com"},
 		{from: "rincewind@unseen.ac.uk", want: "unseen.ac.uk"},
+		{from: "=?iso-8859-1?Q?Jos=E9?= <jose@Example.com>", want: "example.com"},
 	}
 	for _, tc := range tests {
 		t.Run(tc.from, func(t *testing.T) {
@@ -51,3 +238,218 @@ func TestExtractSenderDomain(t *testing.T) {
 		})
 	}
 }
+
+func TestDomainAllowed(t *testing.T) {
+	tests := []struct {
+		sender, allowed string
+		want            bool
+	}{
+		{"example.com", "example.com", true},
+		{"sub.dept.example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com.", "example.com", true},
+		{"dept.example.com", "Example.com.", true},
+		{"evilexample.com", "example.com", false},
+		{"notexample.com", "example.com", false},
+		{"example.com.evil.example", "example.com", false},
+		{"example.org", "example.com", false},
+		{"", "example.com", false},
+		{"example.com", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.sender+"/"+tc.allowed, func(t *testing.T) {
+			if got := domainAllowed(tc.sender, tc.allowed); got != tc.want {
+				t.Errorf("domainAllowed(%q, %q) = %v, want %v", tc.sender, tc.allowed, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDomains(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"example.com, partner.ac.uk ,Other.Example.", []string{"example.com", "partner.ac.uk", "other.example"}},
+		{" example.com,, ,example.org,", []string{"example.com", "example.org"}},
+		{"example.com,EXAMPLE.com", []string{"example.com"}},
+		{" , ", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseDomains(tc.in)
+			if err != nil || !slices.Equal(got, tc.want) {
+				t.Errorf("parseDomains(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+			}
+		})
+	}
+	for _, in := range []string{"example.com;example.org", "ann@example.com", "example .com", "-example.com"} {
+		if _, err := parseDomains(in); err == nil {
+			t.Errorf("parseDomains(%q) did not fail", in)
+		}
+	}
+}
+
+func TestAnyDomainAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		sender  string
+		want    bool
+	}{
+		{"single value", "example.com", "dept.example.com", true},
+		{"single value, other domain", "example.com", "evilexample.com", false},
+		{"second of several", "example.com, partner.ac.uk, other.org", "cs.partner.ac.uk", true},
+		{"none of several", "example.com, partner.ac.uk, other.org", "partner.ac.uk.evil.example", false},
+		{"overlap, parent", "sub.example.com, example.com", "example.com", true},
+		{"overlap, subdomain", "example.com, sub.example.com", "a.sub.example.com", true},
+		{"subdomain only", "sub.example.com", "example.com", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, err := parseDomains(tc.allowed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := anyDomainAllowed(tc.sender, allowed); got != tc.want {
+				t.Errorf("anyDomainAllowed(%q, %q) = %v, want %v", tc.sender, allowed, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("loadConfig", func(t *testing.T) {
+		setupTests(t)
+		if !slices.Equal(whitelistDomains, []string{"example.com"}) {
+			t.Errorf("whitelistDomains = %q", whitelistDomains)
+		}
+		t.Setenv("WHITELIST_DOMAIN", "example.com, partner.ac.uk")
+		loadConfig()
+		if !slices.Equal(whitelistDomains, []string{"example.com", "partner.ac.uk"}) {
+			t.Errorf("whitelistDomains = %q", whitelistDomains)
+		}
+	})
+}
+
+func TestSenderRejection(t *testing.T) {
+	setupTests(t)
+	t.Setenv("SENDER_BLOCKLIST", "Spammer@example.com, both@example.com")
+	t.Setenv("SENDER_ALLOWLIST", " collaborator@partner.org,,both@example.com ")
+	loadConfig()
+	tests := []struct {
+		name, from, want string
+	}{
+		{"allowed domain", "Ann <ann@dept.example.com>", ""},
+		{"blocked address at an allowed domain", "Spam <SPAMMER@Example.com>", "spammer@example.com is in SENDER_BLOCKLIST"},
+		{"allowed address at a foreign domain", "Col <Collaborator@partner.org>", ""},
+		{"other address at a foreign domain", "Bob <bob@partner.org>", "partner.org is not at a WHITELIST_DOMAIN domain (example.com)"},
+		{"in both lists", "both@example.com", "both@example.com is in SENDER_BLOCKLIST"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := senderRejection(extractSenderAddress(tc.from), extractSenderDomain(tc.from))
+			if got != tc.want {
+				t.Errorf("senderRejection(%q) = %q, want %q", tc.from, got, tc.want)
+			}
+		})
+	}
+
+	for _, in := range []string{"spammer", "@example.com", "Spam <spammer@example.com>", "spammer@example .com"} {
+		if _, err := parseAddresses(in); err == nil {
+			t.Errorf("parseAddresses(%q) did not fail", in)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "Plain subject", want: "Plain subject"},
+		{in: "=?UTF-8?B?VGVzdCDDqcOo?=", want: "Test éè"},
+		{in: "=?iso-8859-1?Q?Jos=E9?= <jose@example.com>", want: "José <jose@example.com>"},
+		{
+			in:   "=?UTF-8?Q?Caf=C3=A9_?= =?iso-8859-15?Q?=A4uro?= =?Shift_JIS?B?k/qWe4zq?=",
+			want: "Café €uro日本語",
+		},
+		{in: "=?x-unknown?Q?abc?= def", want: "=?x-unknown?Q?abc?= def"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got := decodeHeader(tc.in)
+			if got != tc.want {
+				t.Errorf("decodeHeader mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHeaderParam(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: `attachment; filename="report.pdf"`, want: "report.pdf"},
+		{name: "token", in: `attachment; filename=report.pdf; size=10`, want: "report.pdf"},
+		{name: "quoted semicolon", in: `attachment; filename="a; b \"c\".txt"`, want: `a; b "c".txt`},
+		{name: "utf-8", in: `attachment; filename*=UTF-8''Ma%C3%9Fnahmen.pdf`, want: "Maßnahmen.pdf"},
+		{name: "latin-1", in: `attachment; filename*=iso-8859-1'de'Gr%FC%DFe.txt`, want: "Grüße.txt"},
+		{
+			name: "three segments",
+			in: "attachment;\r\n filename*0*=UTF-8''%E6%97%A5%E6%9C%AC;\r\n" +
+				" filename*1*=%E8%AA%9E%E3%81%AE;\r\n filename*2=\"report.pdf\"",
+			want: "日本語のreport.pdf",
+		},
+		{
+			name: "segments out of order",
+			in:   `attachment; filename*1="two"; filename*2="three"; filename*0="one-"`,
+			want: "one-twothree",
+		},
+		{
+			name: "extended preferred",
+			in:   `attachment; filename="Massnahmen.pdf"; filename*=UTF-8''Ma%C3%9Fnahmen.pdf`,
+			want: "Maßnahmen.pdf",
+		},
+		{name: "encoded-word", in: `attachment; filename="=?UTF-8?B?UmVjaG51bmcuZG9jeA==?="`, want: "Rechnung.docx"},
+		{name: "malformed escape", in: `attachment; filename*=UTF-8''100%.txt`, want: "100%.txt"},
+		{name: "missing", in: `inline`, want: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := headerParam(tc.in, "filename"); got != tc.want {
+				t.Errorf("headerParam mismatch: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "Tue, 5 Mar 2024 20:02:00 +0530", want: "2024-03-05 14:32 UTC"},
+		{in: "Tue, 05 Mar 2024 14:32:00 GMT", want: "2024-03-05 14:32 UTC"},
+		{in: "5 Mar 2024 14:32:00 +0000", want: "2024-03-05 14:32 UTC"},
+		{in: "Tue, 5 Mar 2024 09:32:00 EST", want: "2024-03-05 14:32 UTC"},
+		{in: "Tue, 5 Mar 2024 14:32:00 +0000 (UTC)", want: "2024-03-05 14:32 UTC"},
+		{in: "Tue,  5 Mar 2024 14:32 +0000", want: "2024-03-05 14:32 UTC"},
+		{in: "2024-03-05T14:32:00Z", want: "2024-03-05 14:32 UTC"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseDate(tc.in)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s := got.UTC().Format("2006-01-02 15:04 UTC"); s != tc.want {
+				t.Errorf("parseDate mismatch: got=%q want=%q", s, tc.want)
+			}
+		})
+	}
+	if _, err := parseDate("last Tuesday"); err == nil {
+		t.Errorf("expected an error for an unparseable date")
+	}
+}
@@ -0,0 +1,94 @@
+// Removes the disclaimers and confidentiality footers that mail gateways
+// append to every message, matched by FOOTER_PATTERNS
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// maxFooterShare is the share of the lines of the visible text above which
+// a footer pattern is taken to be too greedy and ignored. Lines are
+// counted rather than characters, as a disclaimer is often longer than
+// the message it is appended to.
+const maxFooterShare = 0.8
+
+// parseFooterPatterns compiles the regular expressions of FOOTER_PATTERNS,
+// one per line, skipping those that are not valid
+func parseFooterPatterns(s string) []*regexp.Regexp {
+	return parsePatterns("FOOTER_PATTERNS", s, "%s")
+}
+
+// parsePatterns compiles the regular expressions in s, one per line, each
+// formatted into format, skipping (and logging) those that are not valid.
+// name is the environment variable s was read from.
+func parsePatterns(name, s, format string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for line := range strings.SplitSeq(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(fmt.Sprintf(format, line))
+		if err != nil {
+			log.Printf("ignoring invalid %s pattern %q: %v", name, line, err)
+			continue
+		}
+		res = append(res, re)
+	}
+	return res
+}
+
+// stripFooter removes the footer from the visible text of a comment body:
+// from the first line matching one of footerPatterns, outside code and
+// <details> blocks, to the end of the text or the <details> block after it
+func stripFooter(text string) string {
+	for _, re := range footerPatterns {
+		lines := strings.Split(text, "\n")
+		start, end := -1, len(lines)
+		var st blockState
+		for i, line := range lines {
+			inBlock := st.open()
+			st.scan(line)
+			switch {
+			case inBlock:
+			case start == -1 && !st.open() && re.MatchString(line):
+				start = i
+			case start != -1 && strings.HasPrefix(strings.TrimSpace(line), "<details"):
+				end = i
+			}
+			if end != len(lines) {
+				break
+			}
+		}
+		if start == -1 {
+			continue
+		}
+		footer, visible := nonBlankLines(lines[start:end]), nonBlankLines(lines[:end])
+		if float64(footer) > maxFooterShare*float64(visible) {
+			log.Printf("warning: ignoring FOOTER_PATTERNS pattern %q, which would remove %d of %d lines", re, footer, visible)
+			continue
+		}
+		before := strings.TrimRight(strings.Join(lines[:start], "\n"), "\n")
+		after := strings.TrimLeft(strings.Join(lines[end:], "\n"), "\n")
+		if after == "" {
+			text = before
+		} else {
+			text = before + "\n\n" + after
+		}
+	}
+	return text
+}
+
+// nonBlankLines counts the lines that are not blank
+func nonBlankLines(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			n++
+		}
+	}
+	return n
+}
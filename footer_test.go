@@ -0,0 +1,60 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestStripFooter(t *testing.T) {
+	defer func(p []*regexp.Regexp) { footerPatterns = p }(footerPatterns)
+	footer := "This email and any attachments are confidential and intended solely for the addressee.\n" +
+		"If you have received it in error, please notify the sender and delete it.\n" +
+		"The University processes personal data in accordance with the UK GDPR;\n" +
+		"see https://www.example.ac.uk/privacy for details.\n" +
+		"Department of Physics, Parks Road, Oxford OX1 3PU"
+	quoted := "<details>\n<summary>Show quoted email</summary>\n\n> Can you send the job ID?\n>\n> " +
+		"This email and any attachments are confidential and intended solely for the addressee.\n\n</details>"
+	tests := []struct {
+		name, patterns, in, want string
+	}{
+		{
+			name:     "department footer",
+			patterns: `^This email and any attachments are confidential`,
+			in:       "The job ID is 123456.\n\nThanks,\nAnn\n\n" + footer,
+			want:     "The job ID is 123456.\n\nThanks,\nAnn",
+		},
+		{
+			name:     "footer before the quoted email",
+			patterns: "^Department of Physics, Parks Road\n^This email and any attachments are confidential",
+			in:       "The job ID is 123456.\n\nThanks,\nAnn\n\n" + footer + "\n\n" + quoted,
+			want:     "The job ID is 123456.\n\nThanks,\nAnn\n\n" + quoted,
+		},
+		{
+			name:     "over-greedy pattern",
+			patterns: `(?i)job`,
+			in:       "The job ID is 123456.\n\nThanks,\nAnn\n\n" + footer,
+			want:     "The job ID is 123456.\n\nThanks,\nAnn\n\n" + footer,
+		},
+		{
+			name:     "footer in a code block",
+			patterns: `^This email`,
+			in:       "The template says:\n\n```\nThis email is sent by the scheduler.\n```",
+			want:     "The template says:\n\n```\nThis email is sent by the scheduler.\n```",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			footerPatterns = parseFooterPatterns(tc.patterns)
+			if got := stripFooter(tc.in); got != tc.want {
+				t.Errorf("stripFooter:\n--- got ---\n%q\n--- want ---\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFooterPatterns(t *testing.T) {
+	res := parseFooterPatterns("^Confidential\n\n  [unclosed  \n(?i)disclaimer\n")
+	if len(res) != 2 || res[0].String() != "^Confidential" || res[1].String() != "(?i)disclaimer" {
+		t.Errorf("parseFooterPatterns = %v", res)
+	}
+}
@@ -2,28 +2,410 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html"
+	"iter"
+	"mime"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 )
 
-// htmlToPlain converts HTML to plain text with lightweight markdown-ish markup.
-// It preserves paragraphs, line breaks, headings, lists, bold/italic, code/pre, and links.
-// It intentionally skips <img> src embedding by default.
+// htmlMetaCharset returns the charset declared by a <meta charset> or
+// <meta http-equiv="Content-Type"> tag in the first 1024 bytes of an HTML
+// document, where browsers look for it, or "" if there is none
+func htmlMetaCharset(b []byte) string {
+	if len(b) > 1024 {
+		b = b[:1024]
+	}
+	z := xhtml.NewTokenizer(bytes.NewReader(b))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return ""
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" || !hasAttr {
+				continue
+			}
+			var label, content string
+			httpEquiv := false
+			for more := true; more; {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				switch string(k) {
+				case "charset":
+					label = string(v)
+				case "http-equiv":
+					httpEquiv = strings.EqualFold(string(v), "content-type")
+				case "content":
+					content = string(v)
+				}
+			}
+			if label == "" && httpEquiv {
+				if _, params, err := mime.ParseMediaType(content); err == nil {
+					label = params["charset"]
+				}
+			}
+			if _, name := charset.Lookup(strings.TrimSpace(label)); name != "" {
+				return name
+			}
+		}
+	}
+}
+
+// HTMLConvertOptions controls the conversion of HTML bodies to markdown.
+// DefaultHTMLConvertOptions returns the options used unless the
+// environment sets others.
+type HTMLConvertOptions struct {
+	// elements nested deeper than MaxDepth are written as plain text, and
+	// the conversion stops after MaxNodes nodes or MaxOutputBytes of text
+	MaxDepth       int64
+	MaxNodes       int64
+	MaxOutputBytes int64
+
+	// lines hard-wrapped with <br> are joined into paragraphs
+	ReflowBRParagraphs bool
+
+	// paragraphs in a large or bold font become markdown headings
+	StyledHeadings bool
+
+	// what is done with signatures marked up by the mail client:
+	// signatureDrop, signatureCollapse or signatureKeep
+	Signatures string
+
+	// Project is the GitHub project ("owner/repo") of the issues. Links
+	// to its issues whose text is the reference, e.g. #123, are written
+	// as the reference if ShortIssueLinks is set, else as the URL, which
+	// GitHub shortens in the same way.
+	Project         string
+	ShortIssueLinks bool
+}
+
+// DefaultHTMLConvertOptions returns the default options of ConvertHTML
+func DefaultHTMLConvertOptions() HTMLConvertOptions {
+	return HTMLConvertOptions{
+		MaxDepth:       defaultMaxHTMLDepth,
+		MaxNodes:       defaultMaxHTMLNodes,
+		MaxOutputBytes: defaultMaxHTMLOutputBytes,
+		StyledHeadings: true,
+		Signatures:     signatureCollapse,
+	}
+}
+
+// ConvertHTML converts HTML to plain text with lightweight markdown-ish
+// markup, as opts says. It preserves paragraphs, line breaks, headings,
+// lists, bold/italic, code/pre, and links; images become links or
+// placeholders.
+func ConvertHTML(src string, opts HTMLConvertOptions) (string, error) {
+	return convertHTML(context.Background(), src, nil, opts)
+}
+
+// htmlToPlain is ConvertHTML with the default options
 func htmlToPlain(htmlSrc string) (string, error) {
-	doc, err := xhtml.Parse(strings.NewReader(htmlSrc))
+	return ConvertHTML(htmlSrc, DefaultHTMLConvertOptions())
+}
+
+// convertHTML is ConvertHTML, resolving cid: image sources against the
+// inline images of the message (keyed by Content-ID). Images with an
+// uploaded URL are linked, others become a placeholder. The conversion
+// stops with the context's error once ctx is done, and with a note once
+// opts.MaxNodes nodes or opts.MaxOutputBytes of text are reached.
+func convertHTML(ctx context.Context, htmlSrc string, images map[string]inlineImage, opts HTMLConvertOptions) (string, error) {
+	doc, err := xhtml.Parse(newCtxReader(ctx, strings.NewReader(htmlSrc)))
+	if err != nil && ctx.Err() == nil {
+		// the parser rejects documents nested more than 512 elements
+		// deep, whose text is still worth showing
+		return bidiControls.Replace(htmlFlatText(htmlSrc, opts.MaxOutputBytes)), nil
+	}
 	if err != nil {
 		return "", err
 	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// relative links and images are resolved against the <base> element
+	base := documentBase(doc)
 
 	var buf bytes.Buffer
 	var listStack []string // "ul" or "ol"
+	var itemDepth int      // list items being rendered
 	var olCounters []int
+	var tableDepth int // data tables being rendered
+
+	// whitespace between inline content is written lazily, so that the
+	// space at the end of one text node and the start of the next, or
+	// inside an element, comes out once and in the right place
+	var pendingSpace bool
+	openAt := -1 // buffer length just after the last opening marker
+	// with opts.ReflowBRParagraphs, a <br> is written once the content after
+	// it shows whether it ends a line or breaks a hard-wrapped one
+	var softBreak bool
+	var flushBreak func(next string)
+	spaceBefore := func() {
+		flushBreak("")
+		if !pendingSpace {
+			return
+		}
+		pendingSpace = false
+		if buf.Len() == 0 || buf.Len() == openAt {
+			return
+		}
+		switch buf.Bytes()[buf.Len()-1] {
+		case '\n', ' ', '(':
+			return
+		}
+		buf.WriteByte(' ')
+	}
+	// atLineStart reports whether text written now starts a line of the
+	// output, or of a list item or quote rendered on its own from lineStart
+	lineStart := 0
+	atLineStart := func() bool {
+		return buf.Len() == lineStart || buf.Bytes()[buf.Len()-1] == '\n'
+	}
+	// flushBreak writes a pending <br> before the word next, or before
+	// other content if next is "", as a space if it breaks a line that
+	// looks hard-wrapped and next does not start a list, quote or table
+	flushBreak = func(next string) {
+		if !softBreak {
+			return
+		}
+		softBreak = false
+		if atLineStart() {
+			return
+		}
+		line := buf.Bytes()[max(lineStart, bytes.LastIndexByte(buf.Bytes(), '\n')+1):]
+		if next != "" && utf8.RuneCount(line) >= reflowMinWidth && !blockStartRe.MatchString(next) {
+			pendingSpace = true
+			return
+		}
+		pendingSpace = false
+		buf.WriteString("\n")
+	}
+	var inlineImages int // embedded images without alt text, numbered
+	var codeDepth int    // inline code elements being rendered
+	var quoteDepth int   // <q> elements being rendered
+	// open writes the opening marker of inline markup
+	open := func(marker string) {
+		spaceBefore()
+		buf.WriteString(marker)
+		openAt = buf.Len()
+	}
+
+	// check ctx every ctxCheckNodes nodes
+	const ctxCheckNodes = 1024
+	var nodes int
+	var ctxErr error
+	// the walk stops once the node or output limits are reached, and
+	// elements nested deeper than opts.MaxDepth are written as plain text
+	var depth int
+	var stopped bool
+	// the quote container of earlier messages being rendered
+	var quoteNode *xhtml.Node
+	// set inside an element with dir="rtl"
+	var rtl bool
 
 	var walk func(node *xhtml.Node)
+
+	// emphasize renders the children of n with the markers of emphasis e,
+	// leaving out emphasis already applied by an ancestor
+	var applied emphasis
+	emphasize := func(n *xhtml.Node, e emphasis) {
+		e = emphasis{bold: e.bold && !applied.bold, italic: e.italic && !applied.italic, strike: e.strike && !applied.strike}
+		m := e.marker()
+		outer := applied
+		applied = emphasis{bold: outer.bold || e.bold, italic: outer.italic || e.italic, strike: outer.strike || e.strike}
+		if m != "" {
+			open(m)
+		}
+		start := buf.Len()
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		applied = outer
+		if m == "" {
+			return
+		}
+		if content := string(buf.Bytes()[start:]); strings.TrimSpace(content) == "" {
+			// markers around nothing would be shown as they are
+			buf.Truncate(start - len(m))
+			buf.WriteString(content)
+			return
+		}
+		buf.WriteString(reverseMarker(m))
+	}
+
+	// flatten renders the children of n on their own, as a single line
+	flatten := func(n *xhtml.Node) string {
+		start := buf.Len()
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		text := strings.Join(strings.Fields(string(buf.Bytes()[start:])), " ")
+		buf.Truncate(start)
+		return text
+	}
+
+	// writeText writes inline text, collapsing runs of whitespace to a
+	// single space and escaping words that would be read as markdown
+	writeText := func(text string) {
+		text = invisibleChars.Replace(text)
+		words := strings.FieldsFunc(text, isCollapsible)
+		if strings.IndexFunc(text, isCollapsible) == 0 {
+			pendingSpace = true
+		}
+		for i, w := range words {
+			if i > 0 {
+				pendingSpace = true
+			}
+			flushBreak(w)
+			spaceBefore()
+			if codeDepth == 0 {
+				w = escapeMarkdown(unwrapURLs(w), atLineStart())
+			}
+			buf.WriteString(w)
+		}
+		if r, _ := utf8.DecodeLastRuneInString(text); isCollapsible(r) {
+			pendingSpace = true
+		}
+	}
+
+	// writeMsoList renders the list of consecutive Word list paragraphs
+	// starting at first as a markdown list
+	writeMsoList := func(first *xhtml.Node) {
+		ensureTwoNewlines(&buf)
+		var counters []int // item numbers of the current item at each level
+		var widths []int   // marker widths of the current item at each level
+		for p := first; isMsoListParagraph(p); p = nextElement(p) {
+			level := msoListLevel(p)
+			for len(counters) < level {
+				counters = append(counters, 0)
+			}
+			counters = counters[:level]
+			counters[level-1]++
+			prefix := "- "
+			if msoOrderedGlyphRe.MatchString(msoListGlyph(p)) {
+				prefix = fmt.Sprintf("%d. ", counters[level-1])
+			}
+			// levels skipped by the markup are indented as bullets
+			for len(widths) < level-1 {
+				widths = append(widths, 2)
+			}
+			widths = widths[:level-1]
+			indent := 0
+			for _, w := range widths {
+				indent += w
+			}
+			widths = append(widths, len(prefix))
+			start := buf.Len()
+			outer := lineStart
+			lineStart = start
+			for c := p.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+			lineStart = outer
+			item := normalizeBlankLines(strings.TrimSpace(string(buf.Bytes()[start:])))
+			buf.Truncate(start)
+			buf.WriteString(strings.Repeat(" ", indent) + prefix + indentLines(item, indent+len(prefix)) + "\n")
+		}
+		ensureTwoNewlines(&buf)
+	}
+
+	// writePre renders the preformatted text of n as a fenced code block
+	writePre := func(n *xhtml.Node) {
+		ensureTwoNewlines(&buf)
+		// dump raw text nodes inside pre
+		raw := gatherInnerText(n)
+		fence := codeFence(raw)
+		buf.WriteString(fence + codeLanguage(n) + "\n")
+		buf.WriteString(raw)
+		if !strings.HasSuffix(raw, "\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(fence + "\n")
+		ensureTwoNewlines(&buf)
+	}
+
+	// styledHeading renders a paragraph styled as a heading as a markdown
+	// heading, reporting whether it was one. Headings are not made inside
+	// list items and table cells.
+	bodySize := bodyFontSize(doc)
+	styledHeading := func(p *xhtml.Node) bool {
+		if !opts.StyledHeadings || itemDepth > 0 || tableDepth > 0 {
+			return false
+		}
+		level := styledHeadingLevel(p, bodySize)
+		if level == 0 {
+			return false
+		}
+		ensureTwoNewlines(&buf)
+		buf.WriteString(strings.Repeat("#", level) + " ")
+		// headings are bold already
+		outer := applied
+		applied.bold = true
+		for c := p.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		applied = outer
+		ensureTwoNewlines(&buf)
+		return true
+	}
+
+	// writeSignature renders a signature marked up by the sender's mail
+	// client as opts.Signatures says. If the whole message is in one, as
+	// some clients write it, it is kept.
+	signatureIsBody := !hasTextOutsideSignature(doc)
+	writeSignature := func(n *xhtml.Node) {
+		start := buf.Len()
+		outer := lineStart
+		lineStart = start
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		lineStart = outer
+		sig := normalizeBlankLines(strings.TrimSpace(string(buf.Bytes()[start:])))
+		buf.Truncate(start)
+		// a "--" separator would be taken for the start of the quoted
+		// part by hideQuotedPart
+		if first, rest, _ := strings.Cut(sig, "\n"); signatureSeparatorRe.MatchString(first) {
+			sig = strings.TrimSpace(rest)
+		}
+		if sig == "" || opts.Signatures == signatureDrop {
+			return
+		}
+		ensureTwoNewlines(&buf)
+		buf.WriteString("<details>\n<summary>Signature</summary>\n\n" + sig + "\n\n</details>")
+		ensureTwoNewlines(&buf)
+	}
+
 	walk = func(n *xhtml.Node) {
+		if nodes++; nodes%ctxCheckNodes == 0 && ctxErr == nil {
+			ctxErr = ctx.Err()
+		}
+		if nodes > int(opts.MaxNodes) || buf.Len() > int(opts.MaxOutputBytes) {
+			stopped = true
+		}
+		if ctxErr != nil || stopped {
+			return
+		}
+		if depth >= int(opts.MaxDepth) {
+			pendingSpace = true
+			writeText(nodeText(n))
+			pendingSpace = true
+			return
+		}
+		depth++
+		defer func() { depth-- }()
 		switch n.Type {
 		case xhtml.TextNode:
 			// collapse whitespace but keep newlines produced by blocks
@@ -32,41 +414,199 @@ func htmlToPlain(htmlSrc string) (string, error) {
 			if parentIsPre(n) {
 				buf.WriteString(text)
 			} else {
-				// collapse internal whitespace to single space
-				space := false
-				for _, r := range text {
-					if r == ' ' || r == '\n' || r == '\t' || r == '\r' {
-						space = true
-					} else {
-						if space {
-							buf.WriteByte(' ')
-							space = false
-						}
-						buf.WriteRune(r)
-					}
-				}
+				writeText(text)
 			}
 
 		case xhtml.ElementNode:
+			if isHidden(n) {
+				return
+			}
+			if !rtl && strings.EqualFold(attrValue(n, "dir"), "rtl") {
+				// GitHub sets the direction of each paragraph from its
+				// first letter, so right-to-left text is given
+				// paragraphs of its own
+				rtl = true
+				ensureTwoNewlines(&buf)
+				defer func() {
+					rtl = false
+					ensureTwoNewlines(&buf)
+				}()
+			}
+			if quoteNode == nil && isQuoteContainer(n) {
+				// the earlier messages of the thread: render them on
+				// their own and quote them, after a marker that
+				// hideQuotedPart splits at
+				start := buf.Len()
+				outer := lineStart
+				lineStart = start
+				quoteNode = n
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				quoteNode = nil
+				lineStart = outer
+				quoted := normalizeBlankLines(strings.TrimSpace(string(buf.Bytes()[start:])))
+				buf.Truncate(start)
+				if quoted == "" {
+					return
+				}
+				ensureTwoNewlines(&buf)
+				buf.WriteString(quotedEmailMarker + "\n" + quoteLines(quoted))
+				ensureTwoNewlines(&buf)
+				return
+			}
+			if opts.Signatures != signatureKeep && !signatureIsBody && quoteNode == nil {
+				if hasClass(n, "gmail_signature_prefix") {
+					// the "-- " Gmail writes before the signature
+					return
+				}
+				if isSignatureContainer(n) {
+					writeSignature(n)
+					return
+				}
+			}
+			if smiley := wingdingsSmiley(n); smiley != "" {
+				spaceBefore()
+				buf.WriteString(smiley)
+				return
+			}
+			if n.Parent == quoteNode && strings.EqualFold(n.Data, "blockquote") && isQuoteContainer(n) {
+				// the blockquote inside the quote container of Gmail
+				// or Proton Mail, which is already quoted
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				return
+			}
 			tag := strings.ToLower(n.Data)
 			switch tag {
 			case "br":
-				buf.WriteString("\n")
+				switch {
+				case buf.Len() == lineStart || bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) || endsBlock(n):
+					// next to the start or end of a block, or after a
+					// blank line, a <br> adds nothing
+				case opts.ReflowBRParagraphs && codeDepth == 0:
+					if softBreak {
+						// a blank line is kept
+						softBreak = false
+						buf.WriteString("\n\n")
+					} else {
+						softBreak = true
+					}
+				case itemDepth > 0 && bytes.HasSuffix(buf.Bytes(), []byte("  \n")):
+					// the second of two ends a paragraph of the item
+					buf.Truncate(buf.Len() - len("  \n"))
+					buf.WriteString("\n\n")
+				case itemDepth > 0 && codeDepth == 0:
+					// a markdown line break, which keeps the line in
+					// the item
+					buf.WriteString("  \n")
+				default:
+					buf.WriteString("\n")
+				}
+			case "head", "title", "style", "script", "noscript":
+				// not shown to the reader
+				return
+			case "hr":
+				// the blank line before keeps "---" from making the
+				// preceding line a setext heading
+				ensureTwoNewlines(&buf)
+				buf.WriteString("---")
+				ensureTwoNewlines(&buf)
 			case "p":
+				if isMsoListParagraph(n) {
+					// Word and Outlook lists are paragraphs with the
+					// bullet or number as text, rendered together by the
+					// first of them
+					if !isMsoListParagraph(prevElement(n)) {
+						writeMsoList(n)
+					}
+					return
+				}
+				if isPreformatted(n) {
+					writePre(n)
+					return
+				}
+				if styledHeading(n) {
+					return
+				}
 				// ensure blank line before paragraph unless at very start
 				ensureTwoNewlines(&buf)
-				for c := n.FirstChild; c != nil; c = c.NextSibling {
-					walk(c)
-				}
+				emphasize(n, blockEmphasis(n))
 				ensureTwoNewlines(&buf)
 				return
 			case "div":
+				if isPreformatted(n) {
+					writePre(n)
+					return
+				}
+				if styledHeading(n) {
+					return
+				}
 				// treat like paragraph-ish block
 				ensureTwoNewlines(&buf)
+				emphasize(n, blockEmphasis(n))
+				ensureTwoNewlines(&buf)
+				return
+			case "details":
+				// passed through, as GitHub renders it
+				ensureTwoNewlines(&buf)
+				buf.WriteString("<details")
+				if hasAttr(n, "open") {
+					buf.WriteString(" open")
+				}
+				buf.WriteString(">\n")
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
-					walk(c)
+					if c.Type == xhtml.ElementNode && strings.EqualFold(c.Data, "summary") {
+						// GitHub does not read markdown in the summary
+						var summary bytes.Buffer
+						collectText(&summary, c)
+						text := strings.Join(strings.FieldsFunc(summary.String(), isCollapsible), " ")
+						buf.WriteString("<summary>" + html.EscapeString(text) + "</summary>\n")
+						break
+					}
+				}
+				buf.WriteString("\n")
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					if c.Type != xhtml.ElementNode || !strings.EqualFold(c.Data, "summary") {
+						walk(c)
+					}
 				}
 				ensureTwoNewlines(&buf)
+				buf.WriteString("</details>")
+				ensureTwoNewlines(&buf)
+				return
+			case "video", "audio", "iframe", "embed", "object":
+				// recordings and embedded pages are linked, their
+				// fallback content is not shown
+				if src := embedSource(n, base); src != "" {
+					label := "embedded content"
+					if tag == "video" || tag == "audio" {
+						label = "embedded " + tag
+					}
+					spaceBefore()
+					buf.WriteString("[" + label + "](" + src + ")")
+				}
+				return
+			case "input":
+				// task list items, e.g. from GitHub notifications
+				if strings.EqualFold(attrValue(n, "type"), "checkbox") {
+					spaceBefore()
+					if hasAttr(n, "checked") {
+						buf.WriteString("[x]")
+					} else {
+						buf.WriteString("[ ]")
+					}
+					pendingSpace = true
+				}
+				return
+			case "span":
+				if inlineStyle(n)["mso-list"] == "ignore" {
+					// the bullet or number of a Word list item, which
+					// writeMsoList replaces
+					return
+				}
+				emphasize(n, styleEmphasis(n))
 				return
 			case "h1", "h2", "h3", "h4", "h5", "h6":
 				ensureTwoNewlines(&buf)
@@ -82,39 +622,97 @@ func htmlToPlain(htmlSrc string) (string, error) {
 				ensureTwoNewlines(&buf)
 				return
 			case "strong", "b":
-				buf.WriteString(" **")
+				emphasize(n, emphasis{bold: true})
+				return
+			case "em", "i":
+				emphasize(n, emphasis{italic: true})
+				return
+			case "s", "del", "strike":
+				emphasize(n, emphasis{strike: true})
+				return
+			case "cite":
+				emphasize(n, emphasis{italic: true})
+				return
+			case "q":
+				// quotes nested in a quote take single quotation marks
+				mark := `"`
+				if quoteDepth%2 == 1 {
+					mark = "'"
+				}
+				open(mark)
+				quoteDepth++
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
 					walk(c)
 				}
-				buf.WriteString("**")
+				quoteDepth--
+				buf.WriteString(mark)
 				return
-			case "em", "i":
-				buf.WriteString(" *")
+			case "abbr":
+				// keep the expansion, which is otherwise only a tooltip
+				start := buf.Len()
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				text := strings.TrimSpace(string(buf.Bytes()[start:]))
+				for _, a := range n.Attr {
+					if title := strings.Join(strings.Fields(a.Val), " "); strings.EqualFold(a.Key, "title") && title != "" && title != text {
+						buf.WriteString(" (" + escapeText(title, false) + ")")
+					}
+				}
+				return
+			case "sup", "sub":
+				// GitHub renders these tags as they are
+				open("<" + tag + ">")
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				buf.WriteString("</" + tag + ">")
+				return
+			case "u", "ins":
+				// no markdown equivalent, the text is kept as it is
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
 					walk(c)
 				}
-				buf.WriteString("*")
 				return
 			case "a":
 				// collect inner text and href
 				var inner bytes.Buffer
-				buf.WriteString(" ")
+				spaceBefore()
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
 					collectText(&inner, c)
 				}
 				href := ""
 				for _, attr := range n.Attr {
 					if strings.ToLower(attr.Key) == "href" {
-						href = strings.TrimSpace(attr.Val)
+						href = unwrapURL(resolveURL(base, strings.TrimSpace(attr.Val)))
 						break
 					}
 				}
-				plainText := strings.TrimSpace(inner.String())
-				if href == "" || href == plainText {
-					buf.WriteString(plainText)
+				plainText := unwrapURLs(strings.TrimSpace(inner.String()))
+				text := escapeText(plainText, atLineStart())
+				if addr, ok := mailtoAddress(href); ok {
+					// GitHub links bare addresses and <address>
+					switch {
+					case addr == "" || strings.EqualFold(strings.TrimPrefix(plainText, "mailto:"), addr):
+						buf.WriteString(text)
+					case plainText == "":
+						buf.WriteString(addr)
+					default:
+						buf.WriteString(text + " <" + addr + ">")
+					}
+				} else if href == "" || href == plainText {
+					buf.WriteString(text)
+				} else if isProjectURL(href, opts.Project) {
+					// GitHub shortens links to the project's issues,
+					// pull requests and commits, unless they have text
+					if opts.ShortIssueLinks && issueRefRe.MatchString(plainText) {
+						buf.WriteString(plainText)
+					} else {
+						buf.WriteString(href)
+					}
 				} else {
 					// format: text (url)
-					buf.WriteString(plainText)
+					buf.WriteString(text)
 					buf.WriteString(" (")
 					buf.WriteString(href)
 					buf.WriteString(")")
@@ -122,6 +720,9 @@ func htmlToPlain(htmlSrc string) (string, error) {
 				return
 			case "ul":
 				// unordered list
+				if len(listStack) == 0 {
+					ensureTwoNewlines(&buf)
+				}
 				listStack = append(listStack, "ul")
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
 					walk(c)
@@ -130,6 +731,9 @@ func htmlToPlain(htmlSrc string) (string, error) {
 				ensureTwoNewlines(&buf)
 				return
 			case "ol":
+				if len(listStack) == 0 {
+					ensureTwoNewlines(&buf)
+				}
 				listStack = append(listStack, "ol")
 				olCounters = append(olCounters, 1)
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
@@ -152,25 +756,27 @@ func htmlToPlain(htmlSrc string) (string, error) {
 						olCounters[i]++
 					}
 				}
-				// indent based on depth
-				indent := strings.Repeat("  ", len(listStack)-1)
-				buf.WriteString(indent + prefix)
+				// render the item on its own, so that paragraphs inside it
+				// do not split the list, then indent its continuation
+				// lines and sublists under the marker
+				start := buf.Len()
+				outer := lineStart
+				lineStart = start
+				itemDepth++
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
 					walk(c)
 				}
-				buf.WriteString("\n")
-				return
-			case "pre":
-				ensureTwoNewlines(&buf)
-				buf.WriteString("```\n")
-				// dump raw text nodes inside pre
-				raw := gatherInnerText(n)
-				buf.WriteString(raw)
-				if !strings.HasSuffix(raw, "\n") {
+				itemDepth--
+				lineStart = outer
+				item := normalizeBlankLines(strings.TrimSpace(string(buf.Bytes()[start:])))
+				buf.Truncate(start)
+				if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
 					buf.WriteString("\n")
 				}
-				buf.WriteString("```\n")
-				ensureTwoNewlines(&buf)
+				buf.WriteString(prefix + indentLines(item, len(prefix)) + "\n")
+				return
+			case "pre":
+				writePre(n)
 				return
 			case "code":
 				// inline code: wrap in backticks unless parent is pre
@@ -181,27 +787,158 @@ func htmlToPlain(htmlSrc string) (string, error) {
 					}
 					return
 				}
-				buf.WriteString(" `")
+				open("`")
+				codeDepth++
 				for c := n.FirstChild; c != nil; c = c.NextSibling {
 					walk(c)
 				}
+				codeDepth--
 				buf.WriteString("`")
 				return
+			case "blockquote":
+				// render the quote on its own, then prefix its lines
+				start := buf.Len()
+				outer := lineStart
+				lineStart = start
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				lineStart = outer
+				quoted := normalizeBlankLines(strings.TrimSpace(string(buf.Bytes()[start:])))
+				buf.Truncate(start)
+				if quoted == "" {
+					return
+				}
+				ensureTwoNewlines(&buf)
+				buf.WriteString(quoteLines(quoted))
+				ensureTwoNewlines(&buf)
+				return
+			case "table":
+				rows := tableRows(n)
+				if tableDepth > 0 || isLayoutTable(n, rows) {
+					// nested tables run on inside the cell, and layout
+					// tables are rendered as blocks
+					for c := n.FirstChild; c != nil; c = c.NextSibling {
+						walk(c)
+					}
+					ensureTwoNewlines(&buf)
+					return
+				}
+				// render each cell on its own, flattened to one line
+				tableDepth++
+				cells := make([][]string, len(rows))
+				for i, tr := range rows {
+					for _, td := range rowCells(tr) {
+						cells[i] = append(cells[i], flatten(td))
+					}
+				}
+				tableDepth--
+				ensureTwoNewlines(&buf)
+				buf.WriteString(renderTable(cells, isRegularTable(rows)))
+				ensureTwoNewlines(&buf)
+				return
+			case "dl":
+				// a line per term, e.g. the fields of a web form: the
+				// term in bold with its first definition, and any
+				// further definitions on the lines after
+				ensureTwoNewlines(&buf)
+				var lines []string
+				term := ""
+				for _, c := range definitionItems(n) {
+					switch strings.ToLower(c.Data) {
+					case "dt":
+						if term != "" {
+							lines = append(lines, term)
+						}
+						if term = flatten(c); term != "" {
+							term = "**" + strings.TrimSuffix(term, ":") + ":**"
+						}
+					case "dd":
+						if def := flatten(c); term != "" {
+							lines = append(lines, strings.TrimSpace(term+" "+def))
+							term = ""
+						} else if def != "" {
+							lines = append(lines, def)
+						}
+					}
+				}
+				if term != "" {
+					lines = append(lines, term)
+				}
+				buf.WriteString(strings.Join(lines, "\n"))
+				ensureTwoNewlines(&buf)
+				return
+			case "td", "th":
+				if tableDepth > 0 {
+					// a cell of a nested table
+					pendingSpace = true
+					for c := n.FirstChild; c != nil; c = c.NextSibling {
+						walk(c)
+					}
+					pendingSpace = true
+					return
+				}
+				// a cell of a layout table
+				ensureTwoNewlines(&buf)
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				ensureTwoNewlines(&buf)
+				return
 			case "img":
 				// skip images by default; optionally include alt text
 				alt := ""
 				src := ""
+				tiny := false
+				hasAlt := false
 				for _, a := range n.Attr {
 					k := strings.ToLower(a.Key)
 					if k == "alt" {
 						alt = a.Val
+						hasAlt = true
 					} else if k == "src" {
-						src = a.Val
+						src = resolveURL(base, strings.TrimSpace(a.Val))
+					} else if k == "width" || k == "height" {
+						v := strings.TrimSuffix(strings.TrimSpace(a.Val), "px")
+						tiny = tiny || v == "0" || v == "1"
 					}
 				}
-				if alt != "" {
-					buf.WriteString(" ![" + alt + "](" + src + ")")
+				if isEmoji(strings.TrimSpace(alt)) {
+					// an emoji drawn from a sprite, as Outlook and Gmail
+					// do with typed emoji
+					spaceBefore()
+					buf.WriteString(strings.TrimSpace(alt))
+					return
+				}
+				if src == "" || tiny || trackingImageRe.MatchString(src) {
+					// tracking pixels and spacers
+					return
+				}
+				lsrc := strings.ToLower(src)
+				if strings.HasPrefix(lsrc, "cid:") {
+					spaceBefore()
+					buf.WriteString(cidImage(src[len("cid:"):], alt, images))
+					return
+				}
+				alt = strings.TrimSpace(alt)
+				data := strings.HasPrefix(lsrc, "data:")
+				switch {
+				case data && alt == "" && (!hasAlt || len(src) > maxDataURIChars):
+					inlineImages++
+					spaceBefore()
+					buf.WriteString(fmt.Sprintf("[inline image %d]", inlineImages))
+				case data && len(src) > maxDataURIChars:
+					spaceBefore()
+					buf.WriteString("[inline image: " + alt + "]")
+				case alt != "":
+					spaceBefore()
+					buf.WriteString("![" + alt + "](" + src + ")")
+				case !hasAlt:
+					// named, so that the reader knows an image was there
+					spaceBefore()
+					buf.WriteString("[image: " + escapeText(imageName(src), false) + "]")
 				}
+				// an empty alt marks a decorative image
 				return
 			default:
 				// generic: descend
@@ -218,33 +955,334 @@ func htmlToPlain(htmlSrc string) (string, error) {
 		}
 	}
 
+	quoteOutlookReply(doc)
+	quoteCitePrefix(doc)
 	walk(doc)
-	out := strings.TrimSpace(buf.String())
+	if ctxErr != nil {
+		return "", ctxErr
+	}
+	// bidi controls are removed from code too, where they can hide
+	// what it does
+	out := strings.TrimSpace(bidiControls.Replace(buf.String()))
 	// Normalize multi-blank lines to two newlines
 	out = normalizeBlankLines(out)
+	if stopped {
+		out += htmlTruncatedMarker
+	}
 	return out, nil
 }
 
-// helper: write two newlines if buffer doesn't already end with one
-func ensureTwoNewlines(buf *bytes.Buffer) {
-	s := buf.String()
-	if strings.HasSuffix(s, "\n\n") {
-		return
-	}
-	if strings.HasSuffix(s, "\n") {
-		buf.WriteString("\n")
-		return
-	}
-	buf.WriteString("\n\n")
-}
+// defaultMaxHTMLDepth is the default depth of nested elements converted
+// with their markup, below which elements are written as plain text
+const defaultMaxHTMLDepth = 256
 
-// helper: collect text nodes into a buffer (used for anchors)
-func collectText(buf *bytes.Buffer, n *xhtml.Node) {
+// defaultMaxHTMLNodes is the default number of HTML nodes converted,
+// after which the conversion stops
+const defaultMaxHTMLNodes = 200000
+
+// defaultMaxHTMLOutputBytes is the default size of the converted text
+// after which the conversion stops, well over what fits in a comment
+const defaultMaxHTMLOutputBytes = 1 << 20
+
+// htmlTruncatedMarker is appended to the text of an HTML part whose
+// conversion stopped at its MaxNodes or MaxOutputBytes
+const htmlTruncatedMarker = "\n\n_… truncated, the rest of this HTML part was not converted_"
+
+// nodeText returns the text of n and its descendants, leaving out
+// scripts and styles. It walks the tree without recursion, however deep.
+func nodeText(n *xhtml.Node) string {
+	var b strings.Builder
+	for c := n; c != nil; {
+		switch {
+		case c.Type == xhtml.TextNode:
+			b.WriteString(html.UnescapeString(c.Data))
+			b.WriteByte(' ')
+		case c.Type == xhtml.ElementNode && (c.Data == "script" || c.Data == "style"):
+		case c.FirstChild != nil:
+			c = c.FirstChild
+			continue
+		}
+		// next node in document order within n
+		for c != n && c.NextSibling == nil {
+			c = c.Parent
+		}
+		if c == n {
+			break
+		}
+		c = c.NextSibling
+	}
+	return b.String()
+}
+
+// htmlFlatText returns the text of an HTML document the parser rejected,
+// as paragraphs split at block elements, without any other markup, up to
+// about maxBytes of it
+func htmlFlatText(src string, maxBytes int64) string {
+	var paras []string
+	var para strings.Builder
+	endPara := func() {
+		words := strings.FieldsFunc(para.String(), isCollapsible)
+		for i, w := range words {
+			words[i] = escapeMarkdown(unwrapURLs(w), i == 0)
+		}
+		if len(words) > 0 {
+			paras = append(paras, strings.Join(words, " "))
+		}
+		para.Reset()
+	}
+	size := 0
+	skip := false
+	z := xhtml.NewTokenizer(strings.NewReader(src))
+	for size <= int(maxBytes) {
+		switch tt := z.Next(); tt {
+		case xhtml.ErrorToken:
+			endPara()
+			return strings.Join(paras, "\n\n")
+		case xhtml.TextToken:
+			if !skip {
+				t := invisibleChars.Replace(string(z.Text()))
+				para.WriteString(t)
+				size += len(t)
+			}
+		case xhtml.StartTagToken, xhtml.EndTagToken, xhtml.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				skip = tt == xhtml.StartTagToken
+			case "p", "div", "br", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre", "table":
+				endPara()
+			case "td", "th":
+				para.WriteByte(' ')
+			}
+		}
+	}
+	endPara()
+	return strings.Join(paras, "\n\n") + htmlTruncatedMarker
+}
+
+// documentBase returns the URL of the first <base href> element of an
+// HTML document, if it is an absolute http(s) URL, or nil
+func documentBase(doc *xhtml.Node) *url.URL {
+	var find func(*xhtml.Node) *url.URL
+	find = func(n *xhtml.Node) *url.URL {
+		if n.Type == xhtml.ElementNode && strings.EqualFold(n.Data, "base") {
+			for _, a := range n.Attr {
+				if !strings.EqualFold(a.Key, "href") {
+					continue
+				}
+				u, err := url.Parse(strings.TrimSpace(a.Val))
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return nil
+				}
+				return u
+			}
+			return nil
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if u := find(c); u != nil {
+				return u
+			}
+		}
+		return nil
+	}
+	return find(doc)
+}
+
+// resolveURL resolves a link or image source against the document's base
+// URL, which may be nil. Protocol-relative URLs ("//host/path") are given
+// https, and absolute URLs and links to fragments of the email itself are
+// returned as they are.
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" {
+		return ref
+	}
+	if strings.HasPrefix(ref, "//") {
+		u.Scheme = "https"
+		return u.String()
+	}
+	if base == nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// embedSource returns the URL of a video, audio, iframe, embed or object
+// element, resolved against base: its src (data for objects), else the
+// first <source> child, else the poster of a video. Empty, javascript: and
+// about: sources are left out.
+func embedSource(n *xhtml.Node, base *url.URL) string {
+	srcs := []string{attrValue(n, "src"), attrValue(n, "data")}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xhtml.ElementNode && strings.EqualFold(c.Data, "source") {
+			srcs = append(srcs, attrValue(c, "src"))
+		}
+	}
+	srcs = append(srcs, attrValue(n, "poster"))
+	for _, src := range srcs {
+		src = strings.TrimSpace(src)
+		lower := strings.ToLower(src)
+		if src == "" || strings.HasPrefix(lower, "javascript:") || strings.HasPrefix(lower, "about:") {
+			continue
+		}
+		return resolveURL(base, src)
+	}
+	return ""
+}
+
+// reflowMinWidth is the length of a line ended by a <br> from which it is
+// taken to be hard-wrapped, and joined to the next by ReflowBRParagraphs
+const reflowMinWidth = 40
+
+// blockStartRe matches a word that starts a list item, quote, heading or
+// table row, before which a <br> is always kept
+var blockStartRe = regexp.MustCompile(`^(?:[-*+•]|\d+[.)])$|^[>#|]`)
+
+// issueRefRe matches a reference to an issue or pull request, e.g. #123
+var issueRefRe = regexp.MustCompile(`^#\d+$`)
+
+// isProjectURL reports whether href is a github.com link into project
+func isProjectURL(href, project string) bool {
+	if project == "" {
+		return false
+	}
+	u, err := url.Parse(href)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	prefix := "/" + strings.ToLower(strings.Trim(project, "/")) + "/"
+	return (host == "github.com" || host == "www.github.com") &&
+		strings.HasPrefix(strings.ToLower(u.Path), prefix)
+}
+
+// mailtoAddress returns the address of a mailto: URL, without the query
+// giving a subject or body, and whether href is a mailto: URL
+func mailtoAddress(href string) (string, bool) {
+	if len(href) < 7 || !strings.EqualFold(href[:7], "mailto:") {
+		return "", false
+	}
+	addr, _, _ := strings.Cut(href[7:], "?")
+	if a, err := url.PathUnescape(addr); err == nil {
+		addr = a
+	}
+	return strings.TrimSpace(addr), true
+}
+
+// trackingImageRe matches the sources of images used to track when an
+// email is opened, by the last segment of their path (open.gif, /pixel?id=1)
+// or a /track/ directory. Other tracking images are caught by their 1x1 size.
+var trackingImageRe = regexp.MustCompile(`(?i)/(?:open|pixel|track)(?:\.gif|\.png)?(?:[?#]|$)|/track/`)
+
+// maxDataURIChars is the longest data: URI image source that is kept;
+// larger embedded images would swamp the comment
+const maxDataURIChars = 256
+
+// maxEmojiRunes is the length of the longest emoji sequence taken from an
+// image's alt text, e.g. a family joined with zero width joiners
+const maxEmojiRunes = 12
+
+// isEmoji reports whether s is a short run of emoji, with the variation
+// selectors, skin tones and joiners that make up emoji sequences
+func isEmoji(s string) bool {
+	if s == "" || utf8.RuneCountInString(s) > maxEmojiRunes {
+		return false
+	}
+	symbols := 0
+	for _, r := range s {
+		switch {
+		case r >= 0x2000 && unicode.Is(unicode.So, r):
+			symbols++
+		case r == 0x200d, r == 0x20e3, r >= 0xfe00 && r <= 0xfe0f,
+			r >= 0x1f3fb && r <= 0x1f3ff, r >= 0xe0020 && r <= 0xe007f:
+			// joiner, keycap, variation selectors, skin tones and the
+			// tags of flags such as England's
+		default:
+			return false
+		}
+	}
+	return symbols > 0
+}
+
+// wingdingsSmileys are the emoji for the letters Outlook writes in the
+// Wingdings font for the smileys it autocorrects :) :| and :( to
+var wingdingsSmileys = map[string]string{"J": "🙂", "K": "😐", "L": "🙁"}
+
+// wingdingsSmiley returns the emoji for an element holding an Outlook
+// Wingdings smiley, or "" if it holds anything else
+func wingdingsSmiley(n *xhtml.Node) string {
+	font := inlineStyle(n)["font-family"]
+	if strings.EqualFold(n.Data, "font") {
+		font += attrValue(n, "face")
+	}
+	if !strings.Contains(strings.ToLower(font), "wingdings") {
+		return ""
+	}
+	return wingdingsSmileys[strings.TrimSpace(nodeText(n))]
+}
+
+// imageName returns the file name of an image URL for a placeholder, or
+// its host if the path has none
+func imageName(src string) string {
+	u, err := url.Parse(src)
+	if err != nil {
+		return src
+	}
+	if name := path.Base(u.Path); name != "." && name != "/" {
+		return name
+	}
+	if u.Host != "" {
+		return u.Host
+	}
+	return src
+}
+
+// cidImage renders an <img src="cid:..."> reference: a markdown image if
+// the part was uploaded, otherwise a placeholder naming the image
+func cidImage(ref, alt string, images map[string]inlineImage) string {
+	if u, err := url.PathUnescape(ref); err == nil {
+		ref = u
+	}
+	img, ok := images[contentID(ref)]
+	if ok && img.URL != "" {
+		if alt == "" {
+			alt = img.Name
+		}
+		return "![" + alt + "](" + img.URL + ")"
+	}
+	name := img.Name
+	if !ok {
+		name = alt
+	}
+	if name == "" {
+		name = contentID(ref)
+	}
+	return "[inline image: " + name + "]"
+}
+
+// helper: write two newlines if buffer doesn't already end with one
+func ensureTwoNewlines(buf *bytes.Buffer) {
+	s := buf.Bytes()
+	if bytes.HasSuffix(s, []byte("\n\n")) {
+		return
+	}
+	if bytes.HasSuffix(s, []byte("\n")) {
+		buf.WriteString("\n")
+		return
+	}
+	buf.WriteString("\n\n")
+}
+
+// helper: collect text nodes into a buffer (used for anchors)
+func collectText(buf *bytes.Buffer, n *xhtml.Node) {
 	if n == nil {
 		return
 	}
 	if n.Type == xhtml.TextNode {
-		buf.WriteString(html.UnescapeString(n.Data))
+		buf.WriteString(invisibleChars.Replace(html.UnescapeString(n.Data)))
 		return
 	}
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
@@ -252,23 +1290,711 @@ func collectText(buf *bytes.Buffer, n *xhtml.Node) {
 	}
 }
 
-// gatherInnerText returns the concatenated text inside a node (used for <pre>)
+// emphasis is the inline formatting given by a tag or style
+type emphasis struct {
+	bold, italic, strike bool
+}
+
+// marker returns the opening markdown marker for e, e.g. "***" for bold
+// italic text
+func (e emphasis) marker() string {
+	m := ""
+	if e.strike {
+		m += "~~"
+	}
+	if e.bold {
+		m += "**"
+	}
+	if e.italic {
+		m += "*"
+	}
+	return m
+}
+
+// reverseMarker returns the closing marker for an opening marker
+func reverseMarker(m string) string {
+	b := []byte(m)
+	slices.Reverse(b)
+	return string(b)
+}
+
+// styleEmphasis returns the emphasis given by the inline style of an
+// element, as Outlook and Word use for bold and italic text. Other style
+// properties are ignored.
+func styleEmphasis(n *xhtml.Node) emphasis {
+	var e emphasis
+	style := inlineStyle(n)
+	if v, ok := style["font-weight"]; ok {
+		w, err := strconv.Atoi(v)
+		e.bold = v == "bold" || v == "bolder" || (err == nil && w >= 600)
+	}
+	if v, ok := style["font-style"]; ok {
+		e.italic = v == "italic" || v == "oblique"
+	}
+	e.strike = strings.Contains(style["text-decoration"], "line-through") ||
+		strings.Contains(style["text-decoration-line"], "line-through")
+	return e
+}
+
+// inlineStyle returns the properties set by the style attribute of an
+// element, with lowercase names and values and without !important
+func inlineStyle(n *xhtml.Node) map[string]string {
+	style := map[string]string{}
+	for _, a := range n.Attr {
+		if !strings.EqualFold(a.Key, "style") {
+			continue
+		}
+		for _, decl := range strings.Split(a.Val, ";") {
+			prop, val, ok := strings.Cut(decl, ":")
+			if !ok {
+				continue
+			}
+			val = strings.ToLower(strings.TrimSpace(val))
+			style[strings.ToLower(strings.TrimSpace(prop))] = strings.TrimSpace(strings.TrimSuffix(val, "!important"))
+		}
+	}
+	return style
+}
+
+// isHidden reports whether an element is not shown to the reader, such
+// as the preheader text of templated emails: it is hidden by its inline
+// style, or has the hidden or aria-hidden attribute and holds no blocks
+func isHidden(n *xhtml.Node) bool {
+	style := inlineStyle(n)
+	zero := func(v string) bool {
+		v = strings.TrimSuffix(strings.TrimSuffix(v, "px"), "pt")
+		return v == "0" || v == "0.0"
+	}
+	maxHeight0 := zero(style["max-height"])
+	tiny := zero(style["font-size"]) || style["font-size"] == "1px"
+	switch {
+	case style["display"] == "none", style["visibility"] == "hidden":
+		return true
+	case maxHeight0 && (style["overflow"] == "hidden" || tiny):
+		return true
+	}
+	for _, a := range n.Attr {
+		k := strings.ToLower(a.Key)
+		if k == "hidden" || (k == "aria-hidden" && strings.EqualFold(a.Val, "true")) {
+			return !hasBlock(n)
+		}
+	}
+	return false
+}
+
+// blockEmphasis is styleEmphasis for a <p> or <div>, which is only applied
+// if the element holds no other blocks, as markers cannot span them
+func blockEmphasis(n *xhtml.Node) emphasis {
+	e := styleEmphasis(n)
+	if e == (emphasis{}) || hasBlock(n) {
+		return emphasis{}
+	}
+	return e
+}
+
+// styledHeadingLevel returns the level of the markdown heading that a
+// <p> or <div> stands for, or 0 if it is not one. Word and Outlook write
+// headings as short paragraphs in a larger font than the body text (of
+// bodySize points) or in bold. Paragraphs ending like a sentence, or in a
+// colon before a list, are not headings, and neither are bold paragraphs
+// not followed by a sentence or list, such as the name in a signature.
+func styledHeadingLevel(p *xhtml.Node, bodySize float64) int {
+	if hasBlock(p) {
+		return 0
+	}
+	var b bytes.Buffer
+	collectText(&b, p)
+	text := strings.Join(strings.FieldsFunc(b.String(), isCollapsible), " ")
+	if text == "" || utf8.RuneCountInString(text) > maxHeadingChars || strings.ContainsAny(text[len(text)-1:], ".!?,;") {
+		return 0
+	}
+	next := nextElement(p)
+	if strings.HasSuffix(text, ":") && isListStart(next) {
+		return 0
+	}
+	bold, size := true, 0.0
+	for t := range textNodes(p) {
+		if strings.TrimFunc(t.Data, isCollapsible) == "" {
+			continue
+		}
+		bold = bold && isBoldText(t, p)
+		if s := fontSize(t); size == 0 || s < size {
+			size = s
+		}
+	}
+	switch ratio := size / bodySize; {
+	case ratio >= 1.6:
+		return 1
+	case ratio >= 1.25:
+		return 2
+	case ratio >= 1.15 || (bold && startsSection(next)):
+		return 3
+	}
+	return 0
+}
+
+// maxHeadingChars is the length of the longest paragraph taken for a
+// styled heading
+const maxHeadingChars = 80
+
+// textNodes yields the text nodes under n, in document order
+func textNodes(n *xhtml.Node) iter.Seq[*xhtml.Node] {
+	return func(yield func(*xhtml.Node) bool) {
+		var visit func(*xhtml.Node) bool
+		visit = func(x *xhtml.Node) bool {
+			if x.Type == xhtml.TextNode {
+				return yield(x)
+			}
+			if x.Type == xhtml.ElementNode {
+				switch strings.ToLower(x.Data) {
+				case "head", "style", "script", "noscript":
+					return true
+				}
+			}
+			for c := x.FirstChild; c != nil; c = c.NextSibling {
+				if !visit(c) {
+					return false
+				}
+			}
+			return true
+		}
+		visit(n)
+	}
+}
+
+// isBoldText reports whether text node t is bold, by an element up to and
+// including p
+func isBoldText(t, p *xhtml.Node) bool {
+	for n := t.Parent; n != nil; n = n.Parent {
+		switch strings.ToLower(n.Data) {
+		case "b", "strong":
+			return true
+		}
+		if styleEmphasis(n).bold {
+			return true
+		}
+		if n == p {
+			break
+		}
+	}
+	return false
+}
+
+// isListStart reports whether n is a list, or the first item of a Word list
+func isListStart(n *xhtml.Node) bool {
+	return n != nil && (strings.EqualFold(n.Data, "ul") || strings.EqualFold(n.Data, "ol") || isMsoListParagraph(n))
+}
+
+// startsSection reports whether n, the element after a bold paragraph,
+// is a list or holds a sentence, making the paragraph a heading
+func startsSection(n *xhtml.Node) bool {
+	if n == nil {
+		return false
+	}
+	if isListStart(n) {
+		return true
+	}
+	var b bytes.Buffer
+	collectText(&b, n)
+	return strings.ContainsAny(b.String(), ".!?:")
+}
+
+// legacyFontSizes are the sizes in points of <font size="1"> to "7"
+var legacyFontSizes = []float64{7.5, 10, 12, 13.5, 18, 24, 36}
+
+// fontSize returns the size in points of the font of text node t, set by
+// the font-size style or <font size> of its nearest ancestor giving one
+// in absolute units, or 12pt if none does
+func fontSize(t *xhtml.Node) float64 {
+	for n := t.Parent; n != nil; n = n.Parent {
+		if n.Type != xhtml.ElementNode {
+			continue
+		}
+		v := inlineStyle(n)["font-size"]
+		scale := 0.0
+		switch {
+		case strings.HasSuffix(v, "pt"):
+			scale = 1
+		case strings.HasSuffix(v, "px"):
+			scale = 0.75
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v[:max(len(v)-2, 0)]), 64); scale > 0 && err == nil && f > 0 {
+			return f * scale
+		}
+		if strings.EqualFold(n.Data, "font") {
+			if i, err := strconv.Atoi(attrValue(n, "size")); err == nil && i >= 1 && i <= len(legacyFontSizes) {
+				return legacyFontSizes[i-1]
+			}
+		}
+	}
+	return 12
+}
+
+// bodyFontSize returns the size in points of the font most of the text
+// of an HTML document is in. Code, often in a smaller monospaced font, is
+// left out.
+func bodyFontSize(doc *xhtml.Node) float64 {
+	chars := map[float64]int{}
+	best := 12.0
+	for t := range textNodes(doc) {
+		n := utf8.RuneCountInString(strings.TrimFunc(t.Data, isCollapsible))
+		if n == 0 || inCode(t) {
+			continue
+		}
+		size := fontSize(t)
+		chars[size] += n
+		if chars[size] > chars[best] {
+			best = size
+		}
+	}
+	return best
+}
+
+// inCode reports whether node n is inside code or preformatted text
+func inCode(n *xhtml.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type != xhtml.ElementNode {
+			continue
+		}
+		switch strings.ToLower(p.Data) {
+		case "pre", "code":
+			return true
+		}
+		if isPreformatted(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// values of HTMLConvertOptions.Signatures, for signatures marked up by the mail client
+const (
+	signatureDrop     = "drop"
+	signatureCollapse = "collapse"
+	signatureKeep     = "keep"
+)
+
+// signatureSeparatorRe matches the conventional "-- " line before a
+// signature, as converted from HTML
+var signatureSeparatorRe = regexp.MustCompile(`^\\?--\s*$`)
+
+// isSignatureContainer reports whether n holds a signature marked up by
+// the sender's mail client: Gmail's gmail_signature, Outlook's Signature
+// and Thunderbird's moz-signature
+func isSignatureContainer(n *xhtml.Node) bool {
+	return hasClass(n, "gmail_signature") || hasClass(n, "moz-signature") ||
+		strings.EqualFold(attrValue(n, "id"), "signature")
+}
+
+// hasTextOutsideSignature reports whether an HTML document has any text
+// that is not inside a signature container
+func hasTextOutsideSignature(doc *xhtml.Node) bool {
+	for t := range textNodes(doc) {
+		if strings.TrimFunc(t.Data, isCollapsible) == "" {
+			continue
+		}
+		inSignature := false
+		for n := t.Parent; n != nil && !inSignature; n = n.Parent {
+			inSignature = n.Type == xhtml.ElementNode && isSignatureContainer(n)
+		}
+		if !inSignature {
+			return true
+		}
+	}
+	return false
+}
+
+// endsBlock reports whether nothing but whitespace follows a <br> before
+// the end of its block, or before a block element
+func endsBlock(br *xhtml.Node) bool {
+	for n := br; n != nil; n = n.Parent {
+		for s := n.NextSibling; s != nil; s = s.NextSibling {
+			switch {
+			case s.Type == xhtml.TextNode && strings.TrimFunc(s.Data, isCollapsible) == "":
+				continue
+			case s.Type == xhtml.ElementNode && isBlock(s):
+				return true
+			case s.Type == xhtml.ElementNode || s.Type == xhtml.TextNode:
+				return false
+			}
+		}
+		if p := n.Parent; p == nil || p.Type != xhtml.ElementNode || isBlock(p) {
+			return true
+		}
+	}
+	return true
+}
+
+// isBlock reports whether element n starts a block of its own
+func isBlock(n *xhtml.Node) bool {
+	switch strings.ToLower(n.Data) {
+	case "p", "div", "table", "tr", "td", "th", "ul", "ol", "li", "dl", "dt", "dd", "blockquote", "pre", "hr",
+		"h1", "h2", "h3", "h4", "h5", "h6", "details", "summary", "body", "html":
+		return true
+	}
+	return false
+}
+
+// hasBlock reports whether any element inside n is a block element
+func hasBlock(n *xhtml.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != xhtml.ElementNode {
+			continue
+		}
+		switch strings.ToLower(c.Data) {
+		case "p", "div", "table", "ul", "ol", "blockquote", "pre", "hr", "h1", "h2", "h3", "h4", "h5", "h6":
+			return true
+		}
+		if hasBlock(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// codeLanguage returns the language of a <pre> block for its fence, from
+// a language-* or highlight-source-* class on the pre or its <code> child,
+// or "" if none is given
+func codeLanguage(pre *xhtml.Node) string {
+	nodes := []*xhtml.Node{pre}
+	for c := pre.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xhtml.ElementNode && strings.EqualFold(c.Data, "code") {
+			nodes = append(nodes, c)
+			break
+		}
+		if c.Type != xhtml.TextNode || strings.TrimSpace(c.Data) != "" {
+			break
+		}
+	}
+	for _, n := range nodes {
+		for _, a := range n.Attr {
+			if !strings.EqualFold(a.Key, "class") {
+				continue
+			}
+			for _, class := range strings.Fields(a.Val) {
+				for _, prefix := range []string{"language-", "highlight-source-"} {
+					if lang, ok := strings.CutPrefix(class, prefix); ok && codeLanguageRe.MatchString(lang) {
+						return strings.ToLower(lang)
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// codeLanguageRe matches language names that are safe in a code fence
+var codeLanguageRe = regexp.MustCompile(`^[A-Za-z0-9_+#.-]+$`)
+
+// isPreformatted reports whether block n is styled white-space:pre, as
+// code pasted into some webmail is, so that it is rendered like <pre>
+func isPreformatted(n *xhtml.Node) bool {
+	return strings.EqualFold(strings.TrimSpace(inlineStyle(n)["white-space"]), "pre")
+}
+
+// gatherInnerText returns the concatenated text inside a node (used for
+// <pre>). Pasted code often has <br> or a block per line and &nbsp; for
+// indentation, which become newlines and spaces.
 func gatherInnerText(n *xhtml.Node) string {
 	var b bytes.Buffer
+	lineEnd := func() {
+		if b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
 	var g func(*xhtml.Node)
 	g = func(x *xhtml.Node) {
 		if x.Type == xhtml.TextNode {
-			b.WriteString(x.Data)
+			b.WriteString(strings.ReplaceAll(x.Data, "\u00a0", " "))
 			return
 		}
+		block := false
+		if x.Type == xhtml.ElementNode {
+			switch strings.ToLower(x.Data) {
+			case "br":
+				b.WriteByte('\n')
+				return
+			case "script", "style":
+				return
+			}
+			block = x != n && isBlock(x)
+		}
+		if block {
+			lineEnd()
+		}
 		for c := x.FirstChild; c != nil; c = c.NextSibling {
 			g(c)
 		}
+		if block {
+			lineEnd()
+		}
 	}
 	g(n)
 	return b.String()
 }
 
+// quotedEmailMarker starts the earlier messages of a thread, quoted by
+// htmlToPlain, so that hideQuotedPart can hide them whatever the language
+// of the reply header. GitHub does not show it.
+const quotedEmailMarker = "<!-- quoted email -->"
+
+// outlookQuoteClass is the class of the container quoteOutlookReply moves
+// the quoted messages of an Outlook reply into
+const outlookQuoteClass = "ticket-dispatcher-outlook-quote"
+
+// isQuoteContainer reports whether n holds the earlier messages of a
+// thread: Gmail's gmail_quote element, the <blockquote type="cite"> of
+// Apple Mail and Thunderbird, the quote of Yahoo Mail or Proton Mail, or
+// the container of an Outlook reply
+func isQuoteContainer(n *xhtml.Node) bool {
+	switch {
+	case hasClass(n, "gmail_quote") || hasClass(n, "gmail_quote_container") || hasClass(n, outlookQuoteClass):
+		return true
+	case hasClass(n, "yahoo_quoted") || hasClass(n, "protonmail_quote"):
+		return true
+	}
+	return strings.EqualFold(n.Data, "blockquote") && strings.EqualFold(attrValue(n, "type"), "cite")
+}
+
+// quoteCitePrefix moves the "On ... wrote:" line Thunderbird puts before a
+// <blockquote type="cite">, in a moz-cite-prefix <div>, into the
+// blockquote, so that it is quoted with the message it introduces
+func quoteCitePrefix(n *xhtml.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == xhtml.ElementNode && hasClass(c, "moz-cite-prefix") {
+			q := next
+			for q != nil && q.Type == xhtml.TextNode && strings.TrimSpace(q.Data) == "" {
+				q = q.NextSibling
+			}
+			if q != nil && q.Type == xhtml.ElementNode && isQuoteContainer(q) {
+				n.RemoveChild(c)
+				q.InsertBefore(c, q.FirstChild)
+			}
+		} else {
+			quoteCitePrefix(c)
+		}
+		c = next
+	}
+}
+
+// hasAttr reports whether element n has the attribute key
+func hasAttr(n *xhtml.Node, key string) bool {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// attrValue returns the value of the attribute key of element n, or ""
+func attrValue(n *xhtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hasClass reports whether element n has the given class
+func hasClass(n *xhtml.Node, class string) bool {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, "class") && slices.Contains(strings.Fields(a.Val), class) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutlookReplyHeader reports whether n is the header Outlook puts above
+// the message being replied to or forwarded: the divRplyFwdMsg <div> of
+// Outlook on the web, or the <div> with a top border holding the bold
+// "From:", "Sent:" etc. labels of Outlook for Windows
+func isOutlookReplyHeader(n *xhtml.Node) bool {
+	if n.Type != xhtml.ElementNode || !strings.EqualFold(n.Data, "div") {
+		return false
+	}
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, "id") && a.Val == "divRplyFwdMsg" {
+			return true
+		}
+	}
+	if !strings.Contains(inlineStyle(n)["border-top"], "solid") {
+		return false
+	}
+	// the first bold text is a label, in the sender's language
+	var label func(*xhtml.Node) (string, bool)
+	label = func(x *xhtml.Node) (string, bool) {
+		for c := x.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == xhtml.ElementNode && (strings.EqualFold(c.Data, "b") || strings.EqualFold(c.Data, "strong")) {
+				var b bytes.Buffer
+				collectText(&b, c)
+				return strings.TrimSpace(b.String()), true
+			}
+			if l, ok := label(c); ok {
+				return l, true
+			}
+		}
+		return "", false
+	}
+	l, _ := label(n)
+	return strings.HasSuffix(l, ":")
+}
+
+// quoteOutlookReply moves the header of an Outlook reply, and everything
+// after it in the document, into a container that is quoted like Gmail's.
+// Outlook does not wrap the message being replied to in an element of its
+// own, it follows the header to the end of the document. The <hr> Outlook
+// on the web puts before the header is dropped.
+func quoteOutlookReply(doc *xhtml.Node) {
+	var find func(*xhtml.Node) *xhtml.Node
+	find = func(n *xhtml.Node) *xhtml.Node {
+		if isOutlookReplyHeader(n) {
+			return n
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if h := find(c); h != nil {
+				return h
+			}
+		}
+		return nil
+	}
+	h := find(doc)
+	if h == nil {
+		return
+	}
+	quote := &xhtml.Node{Type: xhtml.ElementNode, Data: "div", Attr: []xhtml.Attribute{{Key: "class", Val: outlookQuoteClass}}}
+	parent := h.Parent
+	prev := h.PrevSibling
+	for prev != nil && prev.Type == xhtml.TextNode && strings.TrimSpace(prev.Data) == "" {
+		prev = prev.PrevSibling
+	}
+	if prev != nil && prev.Type == xhtml.ElementNode && strings.EqualFold(prev.Data, "hr") {
+		parent.RemoveChild(prev)
+	}
+	move := func(from *xhtml.Node) {
+		for c := from; c != nil; {
+			next := c.NextSibling
+			c.Parent.RemoveChild(c)
+			quote.AppendChild(c)
+			c = next
+		}
+	}
+	move(h)
+	// then what follows each ancestor, up to the <body>
+	n := parent
+	for n.Parent != nil && !strings.EqualFold(n.Data, "body") {
+		move(n.NextSibling)
+		n = n.Parent
+	}
+	n.AppendChild(quote)
+}
+
+// isMsoListParagraph reports whether n is an item of a list written by
+// Word or Outlook: a <p> with an mso-list style, or with the
+// MsoListParagraph class and a bullet or number. Word also uses the class
+// for paragraphs that are only indented.
+func isMsoListParagraph(n *xhtml.Node) bool {
+	if n == nil || n.Type != xhtml.ElementNode || !strings.EqualFold(n.Data, "p") {
+		return false
+	}
+	if strings.Contains(inlineStyle(n)["mso-list"], "level") {
+		return true
+	}
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, "class") && strings.HasPrefix(a.Val, "MsoListParagraph") {
+			return msoListGlyph(n) != ""
+		}
+	}
+	return false
+}
+
+// msoListLevelRe matches the level in an mso-list style, e.g. "l0 level2 lfo1"
+var msoListLevelRe = regexp.MustCompile(`level(\d+)`)
+
+// msoListLevel returns the nesting level, from 1, of a Word list
+// paragraph: the level of its mso-list style, or else one level for every
+// 36pt (half an inch) of its left margin
+func msoListLevel(p *xhtml.Node) int {
+	style := inlineStyle(p)
+	if m := msoListLevelRe.FindStringSubmatch(style["mso-list"]); m != nil {
+		if level, err := strconv.Atoi(m[1]); err == nil && level > 0 {
+			return min(level, 9)
+		}
+	}
+	margin := style["margin-left"]
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(margin, "in"):
+		unit = 72
+	case strings.HasSuffix(margin, "cm"):
+		unit = 72 / 2.54
+	case !strings.HasSuffix(margin, "pt"):
+		return 1
+	}
+	pt, err := strconv.ParseFloat(margin[:len(margin)-2], 64)
+	if err != nil {
+		return 1
+	}
+	return min(max(int(pt*unit/36+0.5), 1), 9)
+}
+
+// msoListGlyph returns the bullet or number Word wrote for a list
+// paragraph, in a span with the mso-list:Ignore style, or "" if there is none
+func msoListGlyph(p *xhtml.Node) string {
+	var glyph func(*xhtml.Node) (string, bool)
+	glyph = func(n *xhtml.Node) (string, bool) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != xhtml.ElementNode {
+				continue
+			}
+			if inlineStyle(c)["mso-list"] == "ignore" {
+				var b bytes.Buffer
+				collectText(&b, c)
+				return strings.TrimSpace(b.String()), true
+			}
+			if g, ok := glyph(c); ok {
+				return g, true
+			}
+		}
+		return "", false
+	}
+	g, _ := glyph(p)
+	return g
+}
+
+// msoOrderedGlyphRe matches the number of an ordered Word list item, such
+// as "1.", "a)" or "iv."
+var msoOrderedGlyphRe = regexp.MustCompile(`^[0-9A-Za-z]+[.)]$`)
+
+// prevElement returns the element before n among its siblings, or nil
+func prevElement(n *xhtml.Node) *xhtml.Node {
+	for c := n.PrevSibling; c != nil; c = c.PrevSibling {
+		if c.Type == xhtml.ElementNode {
+			return c
+		}
+		if c.Type == xhtml.TextNode && strings.TrimSpace(c.Data) != "" {
+			return nil
+		}
+	}
+	return nil
+}
+
+// nextElement returns the element after n among its siblings, or nil
+func nextElement(n *xhtml.Node) *xhtml.Node {
+	for c := n.NextSibling; c != nil; c = c.NextSibling {
+		if c.Type == xhtml.ElementNode {
+			return c
+		}
+		if c.Type == xhtml.TextNode && strings.TrimSpace(c.Data) != "" {
+			return nil
+		}
+	}
+	return nil
+}
+
 // parentIsPre detects if any ancestor is <pre>
 func parentIsPre(n *xhtml.Node) bool {
 	for p := n.Parent; p != nil; p = p.Parent {
@@ -287,3 +2013,224 @@ func normalizeBlankLines(s string) string {
 	}
 	return s
 }
+
+// isCollapsible reports whether r is whitespace that HTML collapses, or
+// that we collapse with it: non-breaking and other Unicode spaces, which
+// Outlook uses for indentation and empty paragraphs
+func isCollapsible(r rune) bool {
+	return r == ' ' || r == '\n' || r == '\t' || r == '\r' || unicode.Is(unicode.Zs, r)
+}
+
+// escapeMarkdown backslash-escapes the characters of a word of text that
+// GitHub would read as markdown: *, _, ~, ` and | anywhere, and #, -, +, >
+// or a list number such as "1." at the start of a line, where they would
+// begin a heading, list or quote. A < that would begin a tag or comment
+// is escaped too, so that text such as "<details>" or "<!--", written as
+// &lt; in the email, is not HTML on GitHub. URLs and email addresses, autolinked in angle brackets, are
+// left alone so that they are still linked.
+func escapeMarkdown(word string, lineStart bool) string {
+	if strings.Contains(word, "://") || strings.HasPrefix(strings.ToLower(word), "www.") || strings.Contains(word, "@") {
+		return word
+	}
+	var b strings.Builder
+	if lineStart {
+		switch {
+		case strings.ContainsRune("#-+>", rune(word[0])):
+			b.WriteByte('\\')
+		case word[0] >= '0' && word[0] <= '9':
+			i := strings.IndexFunc(word, func(r rune) bool { return r < '0' || r > '9' })
+			if i > 0 && i == len(word)-1 && (word[i] == '.' || word[i] == ')') {
+				b.WriteString(word[:i] + "\\")
+				word = word[i:]
+			}
+		}
+	}
+	for i, r := range word {
+		if strings.ContainsRune("*_~`|", r) || r == '<' && startsHTML(word[i+1:]) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// startsHTML reports whether s, following a <, would make it the start of
+// an HTML tag, comment or processing instruction
+func startsHTML(s string) bool {
+	if s == "" {
+		return false
+	}
+	c := s[0]
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '/' || c == '!' || c == '?'
+}
+
+// escapeText escapes each word of text as escapeMarkdown does
+func escapeText(text string, lineStart bool) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = escapeMarkdown(w, lineStart && i == 0)
+	}
+	return strings.Join(words, " ")
+}
+
+// indentLines indents all but the first line of text by n spaces, leaving
+// blank lines empty
+func indentLines(text string, n int) string {
+	lines := strings.Split(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			lines[i] = strings.Repeat(" ", n) + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// quoteLines prefixes each line of text with "> ", or ">" if it is
+// blank, so that quotes nested inside it stack
+func quoteLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		if l = strings.TrimRight(l, " "); l == "" {
+			lines[i] = ">"
+		} else {
+			lines[i] = "> " + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// tableRows returns the rows of a table that have cells, including those in
+// <thead>, <tbody> and <tfoot> but not those of nested tables
+func tableRows(table *xhtml.Node) []*xhtml.Node {
+	var rows []*xhtml.Node
+	var add func(*xhtml.Node)
+	add = func(n *xhtml.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != xhtml.ElementNode {
+				continue
+			}
+			switch strings.ToLower(c.Data) {
+			case "thead", "tbody", "tfoot":
+				add(c)
+			case "tr":
+				if len(rowCells(c)) > 0 {
+					rows = append(rows, c)
+				}
+			}
+		}
+	}
+	add(table)
+	return rows
+}
+
+// rowCells returns the <td> and <th> cells of a table row
+func rowCells(tr *xhtml.Node) []*xhtml.Node {
+	var cells []*xhtml.Node
+	for c := tr.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xhtml.ElementNode && (strings.EqualFold(c.Data, "td") || strings.EqualFold(c.Data, "th")) {
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
+
+// isLayoutTable reports whether a table is only used to lay out the email,
+// as one marked role="presentation" is, and a table with a single row or a
+// single column, or with tables nested in it but no header cells, usually
+// is. Outlook and Exchange templates nest layout tables several deep.
+func isLayoutTable(table *xhtml.Node, rows []*xhtml.Node) bool {
+	for _, a := range table.Attr {
+		if strings.EqualFold(a.Key, "role") && strings.EqualFold(a.Val, "presentation") {
+			return true
+		}
+	}
+	if len(rows) < 2 {
+		return true
+	}
+	columns, header, nested := 0, false, false
+	for _, tr := range rows {
+		cells := rowCells(tr)
+		columns = max(columns, len(cells))
+		for _, td := range cells {
+			header = header || strings.EqualFold(td.Data, "th")
+			nested = nested || hasTable(td)
+		}
+	}
+	return columns < 2 || (nested && !header)
+}
+
+// definitionItems returns the visible <dt> and <dd> elements of a
+// definition list, including those grouped in <div>s
+func definitionItems(dl *xhtml.Node) []*xhtml.Node {
+	var items []*xhtml.Node
+	for c := dl.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != xhtml.ElementNode || isHidden(c) {
+			continue
+		}
+		switch strings.ToLower(c.Data) {
+		case "dt", "dd":
+			items = append(items, c)
+		case "div":
+			items = append(items, definitionItems(c)...)
+		}
+	}
+	return items
+}
+
+// hasTable reports whether there is a table inside n
+func hasTable(n *xhtml.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == xhtml.ElementNode && strings.EqualFold(c.Data, "table") || hasTable(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRegularTable reports whether every row of a table has the same number
+// of cells and none spans several rows or columns, so that it can be
+// rendered as a markdown table
+func isRegularTable(rows []*xhtml.Node) bool {
+	for _, tr := range rows {
+		cells := rowCells(tr)
+		if len(cells) != len(rowCells(rows[0])) {
+			return false
+		}
+		for _, td := range cells {
+			for _, a := range td.Attr {
+				k := strings.ToLower(a.Key)
+				if (k == "rowspan" || k == "colspan") && strings.TrimSpace(a.Val) != "1" {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// renderTable renders the text of table cells as a GitHub-flavored
+// markdown table with the first row as its header, or if the table is not
+// regular, as a line per row with the cells separated by " | "
+func renderTable(rows [][]string, regular bool) string {
+	var b strings.Builder
+	if !regular {
+		for _, row := range rows {
+			b.WriteString(strings.Join(row, " | ") + "\n")
+		}
+		return b.String()
+	}
+	line := func(cells []string) {
+		b.WriteString("|")
+		for _, c := range cells {
+			// pipes in the text are already escaped
+			b.WriteString(" " + c + " |")
+		}
+		b.WriteString("\n")
+	}
+	line(rows[0])
+	b.WriteString(strings.Repeat("| --- ", len(rows[0])) + "|\n")
+	for _, row := range rows[1:] {
+		line(row)
+	}
+	return b.String()
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestHtmlToPlain(t *testing.T) {
-	t.Setenv("TICKET_DISPATCHER_DOMAIN", "issues.example.com")
-	t.Setenv("WHITELIST_DOMAIN", "example.ac.uk")
-	t.Setenv("GITHUB_PROJECT", "example/repo")
-	loadConfig()
+	opts := DefaultHTMLConvertOptions()
+	opts.Project = "example/repo"
 
 	tests := []struct {
 		name string
@@ -30,6 +30,162 @@ func TestHtmlToPlain(t *testing.T) {
 			in:   `This is <b>bold</b> and <i>italic</i> and <code>inline()</code>`,
 			want: "This is **bold** and *italic* and `inline()`",
 		},
+		{
+			name: "emphasis mid-word",
+			in:   `<p>Please re<b>start</b> the <i>job</i>s</p>`,
+			want: "Please re**start** the *job*s",
+		},
+		{
+			name: "emphasis and links at line start",
+			in:   `<p><b>Note:</b> see below</p><p><a href="https://example.com/docs">Docs</a> and <code>make</code></p>`,
+			want: "**Note:** see below\n\nDocs (https://example.com/docs) and `make`",
+		},
+		{
+			name: "emphasis next to punctuation",
+			in:   `Run it again (<b>note</b>: as root), then <i> check</i>.`,
+			want: "Run it again (**note**: as root), then *check*.",
+		},
+		{
+			name: "markdown characters in text",
+			in: `<p>Run python -m __main__ from pkg/__init__.py</p><p>#include &lt;stdio.h&gt;</p>
+<p>1. not a list</p><div>* not a bullet either | or a table</div>`,
+			want: "Run python -m \\_\\_main\\_\\_ from pkg/\\_\\_init\\_\\_.py\n\n\\#include \\<stdio.h>\n\n" +
+				"1\\. not a list\n\n\\* not a bullet either \\| or a table",
+		},
+		{
+			name: "markdown characters in code, links and addresses",
+			in: `<p><code>__init__.py</code> is at <a href="https://example.com/a_b">https://example.com/a_b</a>,
+ask first_last@example.ac.uk</p><pre>*/5 * * * * run_job</pre>`,
+			want: "`__init__.py` is at https://example.com/a_b, ask first_last@example.ac.uk\n\n```\n*/5 * * * * run_job\n```",
+		},
+		{
+			name: "code block with language",
+			in:   `<pre><code class="language-python">print("hi")</code></pre><pre class="highlight-source-go">fmt.Println()</pre>`,
+			want: "```python\nprint(\"hi\")\n```\n\n```go\nfmt.Println()\n```",
+		},
+		{
+			name: "code block without language",
+			in:   `<pre><code class="hljs">make all</code></pre><p>then <code class="language-sh">make install</code></p>`,
+			want: "```\nmake all\n```\n\nthen `make install`",
+		},
+		{
+			name: "escaped HTML in text",
+			in:   `<p>see &lt;details&gt; here</p><p>then &lt;!-- this &lt;/b&gt; stays, as do 1 &lt; 2 and &lt;3</p>`,
+			want: "see \\<details> here\n\nthen \\<!-- this \\</b> stays, as do 1 < 2 and <3",
+		},
+		{
+			name: "code block containing a fence",
+			in:   "<pre>README.md:\n```\n# Setup @octocat\n```</pre><p>done</p>",
+			want: "````\nREADME.md:\n```\n# Setup @octocat\n```\n````\n\ndone",
+		},
+		{
+			name: "emphasis from inline styles",
+			in: `<p><span style="FONT-WEIGHT: 600; color: red">Urgent</span> and <span style="font-style:italic;font-weight:bold">both</span>` +
+				` and <span style="font-family:Calibri">plain</span></p><div style="font-style: italic !important">All italic</div>`,
+			want: "**Urgent** and ***both*** and plain\n\n*All italic*",
+		},
+		{
+			name: "hidden elements",
+			in: `<div hidden>preview text</div><p>Shown <span style="display: none !important">not shown</span>` +
+				`<span style="font-size:0;max-height:0">tiny</span></p><div aria-hidden="true"><p>Kept, it has blocks</p></div>`,
+			want: "Shown\n\nKept, it has blocks",
+		},
+		{
+			name: "SafeLinks link",
+			in:   `<a href="https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fdocs&amp;data=05%7C01&amp;reserved=0">docs</a>`,
+			want: "docs (https://example.com/docs)",
+		},
+		{
+			name: "tracking pixels and spacers",
+			in: `<p>Hello<img src="https://t.example.com/open.gif?id=1" alt="">` +
+				`<img src="https://img.example.com/s.gif" width="1" height="1" alt="*">` +
+				`<img src="https://mail.example.com/track/abc.png" alt="logo"><img src="spacer.gif" alt=" ">` +
+				`<img src="https://t.example.com/pixel.gif" alt="x"><img src="https://t.example.com/e/pixel?u=1" alt="x"></p>`,
+			want: "Hello",
+		},
+		{
+			name: "images named pixel kept",
+			in: `<p><img src="https://files.example.com/pixel-art.png" alt="art"> ` +
+				`<img src="https://files.example.com/pixels/render.png" alt="render"> ` +
+				`<img src="https://pixel.example.com/1920x1080-pixelated.jpg" alt="shot"></p>`,
+			want: "![art](https://files.example.com/pixel-art.png) ![render](https://files.example.com/pixels/render.png) " +
+				"![shot](https://pixel.example.com/1920x1080-pixelated.jpg)",
+		},
+		{
+			name: "data URI image",
+			in:   `<p>Chart: <img alt="chart" src="data:image/png;base64,` + strings.Repeat("iVBORw0KGgo", 50) + `"></p>`,
+			want: "Chart: [inline image: chart]",
+		},
+		{
+			name: "screenshot kept",
+			in:   `<p>Error: <img src="https://files.example.com/screenshot.png" alt="Screenshot" width="800" height="600"></p>`,
+			want: "Error: ![Screenshot](https://files.example.com/screenshot.png)",
+		},
+		{
+			name: "mailto link with the address as text",
+			in:   `Email <a href="mailto:support@dept.ox.ac.uk">support@dept.ox.ac.uk</a> today`,
+			want: "Email support@dept.ox.ac.uk today",
+		},
+		{
+			name: "mailto link with other text",
+			in:   `Please <a href="MAILTO:support@dept.ox.ac.uk">contact us</a>.`,
+			want: "Please contact us <support@dept.ox.ac.uk>.",
+		},
+		{
+			name: "mailto link with a query",
+			in:   `<a href="mailto:help%2Bhpc@example.ac.uk?subject=Account%20request&amp;cc=ann@example.ac.uk">Request an account</a>`,
+			want: "Request an account <help+hpc@example.ac.uk>",
+		},
+		{
+			name: "link to a project issue",
+			in:   `See <a href="https://github.com/example/repo/issues/12">#12</a> and <a href="https://github.com/Example/Repo/pull/14">the fix</a>`,
+			want: "See https://github.com/example/repo/issues/12 and https://github.com/Example/Repo/pull/14",
+		},
+		{
+			name: "link to a project commit",
+			in:   `Fixed in <a href="https://github.com/example/repo/commit/0a1b2c3d4e5f60718293a4b5c6d7e8f901234567">0a1b2c3</a>`,
+			want: "Fixed in https://github.com/example/repo/commit/0a1b2c3d4e5f60718293a4b5c6d7e8f901234567",
+		},
+		{
+			name: "link to another GitHub project",
+			in:   `Like <a href="https://github.com/other/repo/issues/3">this issue</a>`,
+			want: "Like this issue (https://github.com/other/repo/issues/3)",
+		},
+		{
+			name: "inline quotation",
+			in:   `<p>She said <q>it works <q>most</q> of the time</q>.</p>`,
+			want: "She said \"it works 'most' of the time\".",
+		},
+		{
+			name: "inline quotation in blockquote",
+			in:   `<blockquote><p>The error was <q>disk quota exceeded</q></p></blockquote>`,
+			want: "> The error was \"disk quota exceeded\"",
+		},
+		{
+			name: "citation",
+			in:   `<p>As described in <cite>The Slurm Guide</cite>, see <a href="https://example.com/g"><cite>chapter 2</cite></a></p>`,
+			want: "As described in *The Slurm Guide*, see chapter 2 (https://example.com/g)",
+		},
+		{
+			name: "abbreviation",
+			in:   `<p>Use the <b><abbr title="High Performance Computing">HPC</abbr></b> cluster, not the <abbr>VM</abbr></p>`,
+			want: "Use the **HPC (High Performance Computing)** cluster, not the VM",
+		},
+		{
+			name: "strikethrough and underline",
+			in:   `<p>The job is <u>running</u>, <del>not queued</del>.</p>`,
+			want: "The job is running, ~~not queued~~.",
+		},
+		{
+			name: "superscript and subscript",
+			in:   `Fit x<sup>2</sup> to the CO<sub>2</sub> data`,
+			want: "Fit x<sup>2</sup> to the CO<sub>2</sub> data",
+		},
+		{
+			name: "strikethrough in list items and links",
+			in:   `<ul><li><s>Install</s> done</li><li><a href="https://example.com/x"><strike>old</strike> docs</a></li></ul>`,
+			want: "- ~~Install~~ done\n- old docs (https://example.com/x)",
+		},
 		{
 			name: "link with href different from text",
 			in:   `See <a href="https://example.com">project</a> updates.`,
@@ -47,6 +203,33 @@ func TestHtmlToPlain(t *testing.T) {
 </ol>`,
 			want: "- one\n- two\n\n1. first\n2. second",
 		},
+		{
+			name: "nested unordered list",
+			in:   `<ul><li>Storage<ul><li>home</li><li>scratch</li></ul></li><li>Compute</li></ul>`,
+			want: "- Storage\n  - home\n  - scratch\n- Compute",
+		},
+		{
+			name: "paragraphs in ordered list items",
+			in: `<p>Steps:</p><ol><li><p class=MsoListParagraph>Log in</p></li>
+<li><p>Run the job</p><p>It takes an hour.</p></li><li><p>Check the output</p></li></ol>`,
+			want: "Steps:\n\n1. Log in\n2. Run the job\n\n   It takes an hour.\n3. Check the output",
+		},
+		{
+			name: "three level list",
+			in: `<ul><li>Cluster<ul><li>Partitions<ol><li>short</li><li>long</li></ol></li>
+<li>Nodes</li></ul></li></ul>`,
+			want: "- Cluster\n  - Partitions\n    1. short\n    2. long\n  - Nodes",
+		},
+		{
+			name: "horizontal rule between paragraphs",
+			in:   `<p>See you then.</p><hr><p>Research Computing</p>`,
+			want: "See you then.\n\n---\n\nResearch Computing",
+		},
+		{
+			name: "horizontal rule after text",
+			in:   `Thanks<br><hr style="display:inline-block;width:98%">From: Ann`,
+			want: "Thanks\n\n---\n\nFrom: Ann",
+		},
 		{
 			name: "image with alt text",
 			in:   `<p>Look: <img src="https://img.example/x.png" alt="logo"></p>`,
@@ -62,17 +245,344 @@ func TestHtmlToPlain(t *testing.T) {
 			in:   `Visit <a href="https://example.com">https://example.com</a> now.`,
 			want: "Visit https://example.com now.",
 		},
+		{
+			name: "blockquote",
+			in:   `<p>Agreed.</p><blockquote><p>Can we move the meeting?</p><p>Tuesday works.</p></blockquote>`,
+			want: "Agreed.\n\n> Can we move the meeting?\n>\n> Tuesday works.",
+		},
+		{
+			name: "nested blockquotes",
+			in:   `<blockquote>Fine by me<blockquote><div>First</div><div>Second</div></blockquote></blockquote>`,
+			want: "> Fine by me\n>\n> > First\n> >\n> > Second",
+		},
+		{
+			name: "simple table",
+			in: `<p>Status:</p><table>
+<tr><td>Job</td><td>State</td><td>Notes</td></tr>
+<tr><td>run-1</td><td><b>done</b></td><td>a|b</td></tr>
+</table><p>Thanks</p>`,
+			want: "Status:\n\n| Job | State | Notes |\n| --- | --- | --- |\n| run-1 | **done** | a\\|b |\n\nThanks",
+		},
+		{
+			name: "table with thead and tbody",
+			in: `<table><thead><tr><th>Node</th><th>Load</th></tr></thead>
+<tbody><tr><td>n1</td><td>0.5</td></tr><tr><td>n2</td><td>
+  <p class=MsoNormal>1.2</p></td></tr></tbody></table>`,
+			want: "| Node | Load |\n| --- | --- |\n| n1 | 0.5 |\n| n2 | 1.2 |",
+		},
+		{
+			name: "table with colspan",
+			in: `<table><tr><th colspan="2">Quota</th></tr>
+<tr><td>home</td><td>20 GB</td></tr></table>`,
+			want: "Quota\nhome | 20 GB",
+		},
+		{
+			name: "nested table",
+			in: `<table><tr><th>Host</th><th>Disks</th></tr>
+<tr><td>h1</td><td><table><tr><td>sda</td><td>sdb</td></tr></table></td></tr></table>`,
+			want: "| Host | Disks |\n| --- | --- |\n| h1 | sda sdb |",
+		},
+		{
+			name: "layout table",
+			in:   `<table><tr><td><p>Dear all,</p><p>The cluster is back.</p></td></tr></table>`,
+			want: "Dear all,\n\nThe cluster is back.",
+		},
+		{
+			name: "relative links resolved against base",
+			in: `<html><head><base href="https://example.org/news/issue-12/"></head><body>` +
+				`<p><a href="article.html">Read more</a> or <a href="/archive">the archive</a>.</p>` +
+				`<p><img src="img/chart.png" alt="Chart"></p></body></html>`,
+			want: "Read more (https://example.org/news/issue-12/article.html) or the archive (https://example.org/archive).\n\n" +
+				"![Chart](https://example.org/news/issue-12/img/chart.png)",
+		},
+		{
+			name: "protocol-relative and absolute links",
+			in: `<base href="https://example.org/"><p><a href="//cdn.example.net/guide.pdf">Guide</a>, ` +
+				`<a href="http://other.example.com/x">other</a>, <a href="#top">top</a></p>`,
+			want: "Guide (https://cdn.example.net/guide.pdf), other (http://other.example.com/x), top (#top)",
+		},
+		{
+			name: "relative links without base",
+			in:   `<p><a href="/docs/start">Start</a> and <a href="//example.org/a">A</a></p>`,
+			want: "Start (/docs/start) and A (https://example.org/a)",
+		},
+		{
+			name: "GitHub task list",
+			in: `<ul class="contains-task-list">
+<li class="task-list-item"><input type="checkbox" id="" disabled="" class="task-list-item-checkbox" checked=""> Update the docs</li>
+<li class="task-list-item"><input type="checkbox" id="" disabled="" class="task-list-item-checkbox"> Release <mark>v2.1</mark></li>
+</ul>`,
+			want: "- [x] Update the docs\n- [ ] Release v2.1",
+		},
+		{
+			name: "details and summary",
+			in:   `<p>Job failed.</p><details><summary>Full <b>log</b> &lt;stderr&gt;</summary><pre>Segmentation fault</pre><p>Exit code *139*</p></details><p>Any ideas?</p>`,
+			want: "Job failed.\n\n<details>\n<summary>Full log &lt;stderr&gt;</summary>\n\n```\nSegmentation fault\n```\n\nExit code \\*139\\*\n\n</details>\n\nAny ideas?",
+		},
+		{
+			name: "details open without summary",
+			in:   `<details open><p>Hidden text</p></details>`,
+			want: "<details open>\n\nHidden text\n\n</details>",
+		},
+		{
+			name: "iframe",
+			in:   `<p>Recording of the demo:</p><iframe src="https://player.example.com/embed/abc123" width="640" height="360">Your client does not support frames.</iframe>`,
+			want: "Recording of the demo:\n\n[embedded content](https://player.example.com/embed/abc123)",
+		},
+		{
+			name: "video with a source child",
+			in:   `<p>Watch <video controls><source src="https://media.example.com/clip.mp4" type="video/mp4">No video support.</video> before the call.</p>`,
+			want: "Watch [embedded video](https://media.example.com/clip.mp4) before the call.",
+		},
+		{
+			name: "video poster, javascript and empty sources",
+			in:   `<p><video poster="https://media.example.com/poster.jpg"></video> <iframe src="javascript:alert(1)"></iframe><audio src=""></audio><object data="/media/talk.mp3"></object></p>`,
+			want: "[embedded video](https://media.example.com/poster.jpg) [embedded content](/media/talk.mp3)",
+		},
+		{
+			name: "images with alt, empty alt and no alt",
+			in: `<p>Before: <img src="https://example.org/shots/before.png" alt="Error dialog"></p>` +
+				`<p><img src="https://example.org/spacer.gif" alt=""> After: <img src="https://example.org/shots/after_fix.png?v=2"></p>` +
+				`<p><img src="data:image/png;base64,iVBORw0KGgo="> <img src="data:image/png;base64,iVBORw0KGgo=" alt=""> <img src="data:image/gif;base64,R0lGODlh"></p>`,
+			want: "Before: ![Error dialog](https://example.org/shots/before.png)\n\n" +
+				"After: [image: after\\_fix.png]\n\n[inline image 1] [inline image 2]",
+		},
+		{
+			name: "div styled white-space:pre",
+			in: `<p>The config:</p><div style="white-space: pre; font-family: monospace">[job]<br>` +
+				`<div>&nbsp;&nbsp;cores = 4</div><div>&nbsp;&nbsp;mem = 8G</div></div>` +
+				`<p>Tab <span class="Apple-tab-span" style="white-space:pre">	</span>stays inline</p>`,
+			want: "The config:\n\n```\n[job]\n  cores = 4\n  mem = 8G\n```\n\nTab stays inline",
+		},
+		{
+			name: "Gmail emoji images",
+			in: `<div dir="ltr">Thanks, that worked <img data-emoji="🎉" class="an1" alt="🎉" aria-label="🎉" src="https://fonts.gstatic.com/s/e/notoemoji/15.0/1f389/32.png" loading="lazy">` +
+				`<img alt="👍🏽" src="https://fonts.gstatic.com/s/e/notoemoji/15.0/1f44d_1f3fd/32.png"></div>`,
+			want: "Thanks, that worked 🎉👍🏽",
+		},
+		{
+			name: "Outlook Wingdings smileys",
+			in: `<p class="MsoNormal">Back up now <span style="font-family:Wingdings">J</span> but the queue is long ` +
+				`<span style="font-family:Wingdings;mso-ascii-font-family:Calibri">L</span></p>` +
+				`<p class="MsoNormal"><span style="font-family:Calibri">J</span> is not a smiley</p>`,
+			want: "Back up now 🙂 but the queue is long 🙁\n\nJ is not a smiley",
+		},
+		{
+			name: "right-to-left span in English text",
+			in:   `<p>The user's name is <span dir="rtl">דוד לוי</span> in the portal.</p>`,
+			want: "The user's name is\n\nדוד לוי\n\nin the portal.",
+		},
+		{
+			name: "right-to-left blocks",
+			in:   `<div dir="rtl"><p>שלום, החשבון שלי נעול.</p><p>תודה <b>רבה</b>, <span dir="ltr">Dana</span></p></div><p>Sent from the portal</p>`,
+			want: "שלום, החשבון שלי נעול.\n\nתודה **רבה**, Dana\n\nSent from the portal",
+		},
+		{
+			name: "bidi override characters removed",
+			in:   "<p>Please run invoice\u202Efdp.exe or <a href=\"https://example.org/\u2066x\">this&#x202d; link</a>.</p><pre>ls \u2067-la\u2069</pre>",
+			want: "Please run invoicefdp.exe or this link (https://example.org/x).\n\n```\nls -la\n```",
+		},
+		{
+			name: "runs of br make one blank line",
+			in:   `<div>First paragraph<br><br><br><br>Second paragraph<br>next line</div>`,
+			want: "First paragraph\n\nSecond paragraph\nnext line",
+		},
+		{
+			name: "br at the start and end of blocks",
+			in:   `<div><br>One<br></div><div><br><br>Two<br><br></div><p><span>Three<br></span></p>Four<br><ul><li>item</li></ul>`,
+			want: "One\n\nTwo\n\nThree\n\nFour\n\n- item",
+		},
+		{
+			name: "br in list items",
+			in:   `<ul><li><br>first line<br>second line<br></li><li>para one<br><br>para two</li></ul>`,
+			want: "- first line  \n  second line\n- para one\n\n  para two",
+		},
+		{
+			name: "br in blockquote",
+			in:   `<blockquote><br>quoted<br>text<br><br><br>more<br></blockquote><p>reply</p>`,
+			want: "> quoted\n> text\n>\n> more\n\nreply",
+		},
+		{
+			name: "Word numbered list with a bulleted sublist",
+			in: `<p>Steps:</p>` +
+				`<p class="MsoListParagraphCxSpFirst" style="mso-list:l0 level1 lfo1"><span style="mso-list:Ignore">1.<span>&nbsp;&nbsp; </span></span>Log in</p>` +
+				`<p class="MsoListParagraphCxSpMiddle" style="mso-list:l0 level2 lfo1"><span style="mso-list:Ignore">o<span>&nbsp; </span></span>with your SSO account</p>` +
+				`<p class="MsoListParagraphCxSpLast" style="mso-list:l0 level1 lfo1"><span style="mso-list:Ignore">2.<span>&nbsp;&nbsp; </span></span>Run <b>sbatch</b> job.sh</p>` +
+				`<p>Done.</p>`,
+			want: "Steps:\n\n1. Log in\n   - with your SSO account\n2. Run **sbatch** job.sh\n\nDone.",
+		},
+		{
+			name: "Word list levels from the left margin",
+			in: `<p class="MsoListParagraph" style="margin-left:36.0pt"><span style="mso-list:Ignore">·</span>One</p>` +
+				`<p class="MsoListParagraph" style="margin-left:1.0in"><span style="mso-list:Ignore">§</span>Two</p>` +
+				`<p class="MsoListParagraph" style="margin-left:36.0pt"><span style="mso-list:Ignore">·</span>Three</p>`,
+			want: "- One\n  - Two\n- Three",
+		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got, err := htmlToPlain(tc.in)
+			got, err := ConvertHTML(tc.in, opts)
 			if err != nil {
-				t.Fatalf("htmlToPlain returned error: %v", err)
+				t.Fatalf("ConvertHTML returned error: %v", err)
 			}
 			if got != tc.want {
-				t.Errorf("htmlToPlain mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
+				t.Errorf("ConvertHTML mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, tc.want)
 			}
 		})
 	}
 }
+
+func TestConvertHTML_ShortIssueLinks(t *testing.T) {
+	src := `See <a href="https://github.com/example/repo/issues/12">#12</a> and <a href="https://github.com/other/repo/issues/3">#3</a>`
+	opts := DefaultHTMLConvertOptions()
+	opts.Project = "example/repo"
+	opts.ShortIssueLinks = true
+	got, err := ConvertHTML(src, opts)
+	if err != nil {
+		t.Fatalf("ConvertHTML returned error: %v", err)
+	}
+	if want := "See #12 and #3 (https://github.com/other/repo/issues/3)"; got != want {
+		t.Errorf("ConvertHTML = %q, want %q", got, want)
+	}
+}
+
+func TestHtmlToPlain_GmailQuoteHidden(t *testing.T) {
+	src := `<div dir="ltr">That fixed it, thanks!</div><br>
+<div class="gmail_quote"><blockquote class="gmail_quote" style="margin:0px 0px 0px 0.8ex">
+<div>Please try restarting the job.</div><div><br></div><div>Regards,<br>Research Computing</div>
+</blockquote></div>`
+	md, err := htmlToPlain(src)
+	if err != nil {
+		t.Fatalf("htmlToPlain returned error: %v", err)
+	}
+	if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != "That fixed it, thanks!\n" {
+		t.Errorf("quote not hidden:\n--- markdown ---\n%s\n--- got ---\n%q", md, got)
+	}
+	got := hideQuotedPart(md, quotedCollapse, defaultQuoteOptions())
+	if !strings.Contains(got, "<details>") || !strings.Contains(got, "> Please try restarting the job.") {
+		t.Errorf("quote not collapsed into details, got:\n%s", got)
+	}
+}
+
+func TestHtmlToPlain_DeepNesting(t *testing.T) {
+	opts := DefaultHTMLConvertOptions()
+	opts.MaxDepth = 20
+	deep := func(n int) string {
+		return strings.Repeat("<div><b>", n) + "deep *text*" + strings.Repeat("</b></div>", n)
+	}
+
+	// deeper than MaxDepth: the inner content is written as text
+	got, err := ConvertHTML("<p>Before</p>"+deep(100)+"<p>After</p>", opts)
+	if err != nil {
+		t.Fatalf("ConvertHTML returned error: %v", err)
+	}
+	if !strings.Contains(got, `deep \*text\*`) || !strings.Contains(got, "Before") || !strings.Contains(got, "After") {
+		t.Errorf("deep content missing, got:\n%s", got)
+	}
+
+	// deeper than the parser allows: the document is converted flat
+	got, err = ConvertHTML("<p>Before</p>"+deep(2000)+"<p>After</p>", opts)
+	if err != nil {
+		t.Fatalf("ConvertHTML returned error: %v", err)
+	}
+	if want := "Before\n\ndeep \\*text\\*\n\nAfter"; got != want {
+		t.Errorf("ConvertHTML(deep) = %q, want %q", got, want)
+	}
+}
+
+func TestHtmlToPlain_Limits(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&b, "<p>Paragraph %d of a very long message</p>", i)
+	}
+	huge := b.String()
+
+	opts := DefaultHTMLConvertOptions()
+	opts.MaxOutputBytes = 4096
+	got, err := ConvertHTML(huge, opts)
+	if err != nil {
+		t.Fatalf("ConvertHTML returned error: %v", err)
+	}
+	if len(got) > 5000 || !strings.HasSuffix(got, htmlTruncatedMarker) || !strings.HasPrefix(got, "Paragraph 0 ") {
+		t.Errorf("output not cut at MaxOutputBytes, got %d bytes ending %q", len(got), got[max(0, len(got)-100):])
+	}
+
+	opts = DefaultHTMLConvertOptions()
+	opts.MaxNodes = 1000
+	got, err = ConvertHTML(huge, opts)
+	if err != nil {
+		t.Fatalf("ConvertHTML returned error: %v", err)
+	}
+	if !strings.HasSuffix(got, htmlTruncatedMarker) || strings.Contains(got, "Paragraph 1000 ") {
+		t.Errorf("conversion not stopped at MaxNodes, got %d bytes ending %q", len(got), got[max(0, len(got)-100):])
+	}
+
+	got, err = htmlToPlain(huge)
+	if err != nil {
+		t.Fatalf("htmlToPlain returned error: %v", err)
+	}
+	if strings.Contains(got, "truncated") || !strings.HasSuffix(got, "Paragraph 9999 of a very long message") {
+		t.Errorf("conversion within limits was cut, got %d bytes ending %q", len(got), got[max(0, len(got)-100):])
+	}
+}
+
+func TestHtmlToPlain_Signatures(t *testing.T) {
+	gmail := `<div dir="ltr">The job ran fine, thanks.</div><br clear="all"><div><br></div>` +
+		`<span class="gmail_signature_prefix">-- </span><br><div dir="ltr" class="gmail_signature" data-smartmail="gmail_signature">` +
+		`<div dir="ltr"><b>Dr Sam Okafor</b><div>Department of Chemistry</div><div>+44 1865 000000</div></div></div>`
+	outlook := `<div>Please close the ticket.</div><div><br></div>` +
+		`<div id="Signature"><p>Kind regards,<br>Alex Chen</p><p><img src="https://example.ac.uk/logo.png" alt="University logo"></p>` +
+		`<p style="font-size:8pt">This email is confidential.</p></div>`
+	whole := `<div id="Signature"><div>Can I get access to the GPU nodes?</div><div>Thanks, Priya</div></div>`
+	tests := []struct {
+		mode, in, want string
+	}{
+		{signatureCollapse, gmail, "The job ran fine, thanks.\n\n<details>\n<summary>Signature</summary>\n\n" +
+			"**Dr Sam Okafor**\n\nDepartment of Chemistry\n\n\\+44 1865 000000\n\n</details>"},
+		{signatureDrop, gmail, "The job ran fine, thanks."},
+		{signatureKeep, gmail, "The job ran fine, thanks.\n\n\\--\n\n**Dr Sam Okafor**\n\nDepartment of Chemistry\n\n\\+44 1865 000000"},
+		{signatureCollapse, outlook, "Please close the ticket.\n\n<details>\n<summary>Signature</summary>\n\n" +
+			"Kind regards,\nAlex Chen\n\n![University logo](https://example.ac.uk/logo.png)\n\nThis email is confidential.\n\n</details>"},
+		{signatureDrop, outlook, "Please close the ticket."},
+		{signatureCollapse, whole, "Can I get access to the GPU nodes?\n\nThanks, Priya"},
+		{signatureDrop, whole, "Can I get access to the GPU nodes?\n\nThanks, Priya"},
+	}
+	for _, tc := range tests {
+		opts := DefaultHTMLConvertOptions()
+		opts.Signatures = tc.mode
+		got, err := ConvertHTML(tc.in, opts)
+		if err != nil {
+			t.Fatalf("ConvertHTML returned error: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("ConvertHTML(%.40q) with %s:\n--- got ---\n%q\n--- want ---\n%q", tc.in, tc.mode, got, tc.want)
+		}
+	}
+
+	// the collapsed signature is not taken for the quoted part
+	md, _ := htmlToPlain(gmail)
+	if got := hideQuotedPart(md, quotedRemove, defaultQuoteOptions()); got != md {
+		t.Errorf("hideQuotedPart changed the collapsed signature: %q", got)
+	}
+}
+
+func TestHTMLMetaCharset(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`<html><head><meta charset="shift_jis"></head>`, "shift_jis"},
+		{`<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=iso-8859-1">`, "windows-1252"},
+		{`<meta name="viewport" content="width=device-width"><meta charset=euc-jp>`, "euc-jp"},
+		{`<meta content="text/html; charset=utf-8">`, ""},
+		{`<meta charset="not-a-charset">`, ""},
+		{strings.Repeat(" ", 1024) + `<meta charset="shift_jis">`, ""},
+		{`<p>no declaration</p>`, ""},
+	}
+	for _, tc := range tests {
+		if got := htmlMetaCharset([]byte(tc.src)); got != tc.want {
+			t.Errorf("htmlMetaCharset(%.60q) = %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
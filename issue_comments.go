@@ -3,25 +3,90 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type ghComment struct {
 	Body string `json:"body"`
 }
 
-func postIssueComment(issueNumber, msgId, comment string) error {
-	exists, err := commentWithMessageIDExists(issueNumber, msgId)
+// defaultMaxCommentChars is GitHub's limit on the length of a comment body
+const defaultMaxCommentChars = 65536
+
+// minCommentChars is the smallest MAX_COMMENT_CHARS accepted; below it a
+// split comment would be posted as a great many parts
+const minCommentChars = 1000
+
+// errAlreadyPosted is returned when a comment for a Message-ID exists
+var errAlreadyPosted = errors.New("already posted")
+
+// messageIDLine is the first line of every posted comment, used to detect
+// emails that have already been posted. Comments split into parts carry
+// a "(part N/M)" suffix; part 0 is an unsplit comment.
+func messageIDLine(msgId string, part, parts int) string {
+	if part == 0 {
+		return fmt.Sprintf("Message-ID: %s\n", msgId)
+	}
+	return fmt.Sprintf("Message-ID: %s (part %d/%d)\n", msgId, part, parts)
+}
+
+// parseMessageIDLine parses the first line of a comment written by
+// messageIDLine, returning the Message-ID and part number
+func parseMessageIDLine(line string) (msgId string, part int, ok bool) {
+	line = strings.TrimSpace(line)
+	msgId, ok = strings.CutPrefix(line, "Message-ID: ")
+	if !ok {
+		return "", 0, false
+	}
+	if i := strings.LastIndex(msgId, " (part "); i >= 0 && strings.HasSuffix(msgId, ")") {
+		var n, m int
+		if _, err := fmt.Sscanf(msgId[i:], " (part %d/%d)", &n, &m); err == nil {
+			return strings.TrimSpace(msgId[:i]), n, true
+		}
+	}
+	return strings.TrimSpace(msgId), 0, true
+}
+
+// postIssueComment posts a comment to an issue of repo, owner/repo
+func postIssueComment(repo, issueNumber, msgId, comment string) error {
+	return postIssueCommentPart(repo, issueNumber, msgId, 0, 0, comment)
+}
+
+// postIssueCommentParts posts the parts of a split comment in order,
+// skipping parts that were already posted. Remaining parts are not
+// posted if one fails.
+func postIssueCommentParts(repo, issueNumber, msgId string, parts []string) error {
+	for i, p := range parts {
+		err := postIssueCommentPart(repo, issueNumber, msgId, i+1, len(parts), p)
+		if errors.Is(err, errAlreadyPosted) {
+			log.Printf("%v, skipping", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("part %d/%d: %w", i+1, len(parts), err)
+		}
+	}
+	return nil
+}
+
+// postIssueCommentPart posts one part of a comment, or the whole comment
+// if part is 0
+func postIssueCommentPart(repo, issueNumber, msgId string, part, parts int, comment string) error {
+	exists, err := commentWithMessageIDExists(repo, issueNumber, msgId, part)
 	// only suppress posting if we get confirmation that Message-ID was found
 	// better to post twice than silently fail
 	if exists {
-		return fmt.Errorf("Message-ID: %s already posted", msgId)
+		return fmt.Errorf("%s: %w", strings.TrimSpace(messageIDLine(msgId, part, parts)), errAlreadyPosted)
 	}
 	if err != nil {
 		log.Printf("error from commentWithMessageIDExists: %v", err)
@@ -33,10 +98,10 @@ func postIssueComment(issueNumber, msgId, comment string) error {
 
 	url := fmt.Sprintf(
 		"https://api.github.com/repos/%s/issues/%s/comments",
-		githubProject, issueNumber,
+		repo, issueNumber,
 	)
 	payload := map[string]string{
-		"body": fmt.Sprintf("Message-ID: %s\n", msgId) + comment,
+		"body": messageIDLine(msgId, part, parts) + comment,
 	}
 
 	b, err := json.Marshal(payload)
@@ -71,62 +136,348 @@ func postIssueComment(issueNumber, msgId, comment string) error {
 }
 
 // commentWithMessageIDExists checks whether an issue already has a comment
-// whose first line contains the given Message-ID (exact match or contains).
-func commentWithMessageIDExists(issueNumber, messageID string) (bool, error) {
+// whose first line contains the given Message-ID. For part N of a split
+// comment, this is either part N or the whole unsplit comment; for an
+// unsplit comment (part 0), it is any comment for the Message-ID.
+func commentWithMessageIDExists(repo, issueNumber, messageID string, part int) (bool, error) {
+	messageID = strings.TrimSpace(messageID)
+	for page := 1; ; page++ {
+		comments, err := listIssueComments(repo, issueNumber, page)
+		if err != nil {
+			return false, err
+		}
+		// no more pages
+		if len(comments) == 0 {
+			return false, nil
+		}
+
+		for _, c := range comments {
+			firstLine := c.Body
+			if i := strings.IndexByte(c.Body, '\n'); i >= 0 {
+				firstLine = c.Body[:i]
+			}
+			if postedMessageID(firstLine, messageID, part) {
+				return true, nil
+			}
+		}
+	}
+}
+
+// lastIssueComment returns the body of the latest comment on an issue, or
+// "" if it has none
+func lastIssueComment(repo, issueNumber string) (string, error) {
+	last := ""
+	for page := 1; ; page++ {
+		comments, err := listIssueComments(repo, issueNumber, page)
+		if err != nil {
+			return "", err
+		}
+		if len(comments) == 0 {
+			return last, nil
+		}
+		last = comments[len(comments)-1].Body
+	}
+}
+
+// listIssueComments returns a page, counted from 1, of the comments on an
+// issue of repo, oldest first
+func listIssueComments(repo, issueNumber string, page int) ([]ghComment, error) {
 	token := os.Getenv("GITHUB_TOKEN")
 
 	if token == "" {
-		return false, fmt.Errorf("missing environment variable GITHUB_TOKEN")
+		return nil, fmt.Errorf("missing environment variable GITHUB_TOKEN")
 	}
 
-	needle := strings.TrimSpace("Message-ID: " + messageID)
 	client := &http.Client{Timeout: 15 * time.Second}
+	url := fmt.Sprintf(
+		"https://api.github.com/repos/%s/issues/%s/comments?per_page=100&page=%d",
+		repo, issueNumber, page,
+	)
 
-	page := 1
-	for {
-		url := fmt.Sprintf(
-			"https://api.github.com/repos/%s/issues/%s/comments?per_page=100&page=%d",
-			githubProject, issueNumber, page,
-		)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "ticket-dispatcher")
 
-		req, err := http.NewRequest(http.MethodGet, url, nil)
-		if err != nil {
-			return false, err
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("github list comments failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var comments []ghComment
+	if err := json.Unmarshal(body, &comments); err != nil {
+		return nil, fmt.Errorf("decode comments: %w", err)
+	}
+	return comments, nil
+}
+
+// quotesComment reports whether quoted, the quoted part of an email,
+// quotes a posted comment: whether its words, after the "On ... wrote:"
+// line or header block, start with the words of the comment after its
+// Message-ID line and From/Sent header. Markup and quote marks are
+// ignored, as the comment is markdown converted from the email quoted.
+func quotesComment(quoted, comment string) bool {
+	lines := strings.Split(comment, "\n")
+	if len(lines) > 0 {
+		if _, _, ok := parseMessageIDLine(lines[0]); ok {
+			lines = lines[1:]
 		}
-		req.Header.Set("Authorization", "token "+token)
-		req.Header.Set("Accept", "application/vnd.github+json")
-		req.Header.Set("User-Agent", "ticket-dispatcher")
+	}
+	for len(lines) > 0 && (strings.HasPrefix(lines[0], "From: ") || strings.HasPrefix(lines[0], "Sent: ")) {
+		lines = lines[1:]
+	}
+	want := textWords(strings.Join(lines, "\n"))
+	got := textWords(strings.Join(skipQuoteHeader(unquoteLines(quoted)), "\n"))
+	return len(want) > 0 && len(got) >= len(want) && slices.Equal(got[:len(want)], want)
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return false, err
+// unquoteLines returns the lines of text without their ">" quote marks
+func unquoteLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		for strings.HasPrefix(l, ">") || strings.HasPrefix(l, `\>`) {
+			l = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(l, `\`), ">"))
 		}
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		lines[i] = l
+	}
+	return lines
+}
 
-		if resp.StatusCode != http.StatusOK {
-			return false, fmt.Errorf("github list comments failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+// skipQuoteHeader drops the "On ... wrote:" line or the header block that
+// quoted messages start with
+func skipQuoteHeader(lines []string) []string {
+	for len(lines) > 0 {
+		switch {
+		case lines[0] == "":
+			lines = lines[1:]
+		case replyLineRe.MatchString(lines[0]) || originalMessageRe.MatchString(lines[0]):
+			lines = lines[1:]
+		case len(lines) > 1 && replyLineRe.MatchString(lines[0]+" "+lines[1]):
+			lines = lines[2:]
+		case isHeaderLine(lines[0]):
+			lines = lines[1:]
+		default:
+			return lines
 		}
+	}
+	return lines
+}
+
+// textWords returns the words of text, leaving out punctuation and markup
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ReplaceAll(text, zeroWidthJoiner, ""), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// postedMessageID reports whether a comment with the given first line
+// covers part of the message with the given Message-ID
+func postedMessageID(firstLine, messageID string, part int) bool {
+	id, p, ok := parseMessageIDLine(firstLine)
+	return ok && id == messageID && (part == 0 || p == 0 || p == part)
+}
 
-		var comments []ghComment
-		if err := json.Unmarshal(body, &comments); err != nil {
-			return false, fmt.Errorf("decode comments: %w", err)
+// truncateComment shortens comment to at most limit characters, cutting at
+// a paragraph boundary where possible and appending a marker with the
+// number of characters omitted, and a link to fullURL if it is set. Open
+// code fences and <details> blocks are closed before the marker.
+func truncateComment(comment string, limit int, fullURL string) string {
+	total := utf8.RuneCountInString(comment)
+	if total <= limit {
+		return comment
+	}
+	end := runeOffset(comment, limit)
+	for end > 0 {
+		cut := paragraphCut(comment[:end])
+		head := strings.TrimRight(comment[:cut], "\n")
+		head += closeOpenBlocks(head)
+		omitted := total - utf8.RuneCountInString(comment[:cut])
+		out := head + truncationMarker(omitted, fullURL)
+		over := utf8.RuneCountInString(out) - limit
+		if over <= 0 {
+			return out
 		}
+		end = runeOffset(comment, utf8.RuneCountInString(comment[:cut])-over)
+	}
+	return strings.TrimLeft(truncationMarker(total, fullURL), "\n")
+}
 
-		// no more pages
-		if len(comments) == 0 {
-			return false, nil
+// truncationMarker is appended to a truncated comment
+func truncationMarker(omitted int, fullURL string) string {
+	m := fmt.Sprintf("\n\n_… truncated, %d characters omitted_", omitted)
+	if fullURL != "" {
+		m += fmt.Sprintf(" ([full message](%s))", fullURL)
+	}
+	return m
+}
+
+// paragraphCut returns the offset at which to truncate s: the last
+// paragraph break, or failing that the last line break, in the second
+// half of s, or else the end of s
+func paragraphCut(s string) int {
+	if i := strings.LastIndex(s, "\n\n"); i > len(s)/2 {
+		return i
+	}
+	if i := strings.LastIndexByte(s, '\n'); i > len(s)/2 {
+		return i
+	}
+	return len(s)
+}
+
+// closeOpenBlocks returns the lines needed to close any fenced code block
+// or <details> block left open at the end of md
+func closeOpenBlocks(md string) string {
+	var st blockState
+	for _, line := range strings.Split(md, "\n") {
+		st.scan(line)
+	}
+	return st.closers()
+}
+
+// blockState tracks the fenced code block and <details> blocks open at a
+// point in a markdown document
+type blockState struct {
+	fenceLine string // opening line of the open code fence, if any
+	fence     string // its fence marker, e.g. "```"
+	details   int
+}
+
+// scan updates the state with the next line of the document
+func (st *blockState) scan(line string) {
+	t := strings.TrimSpace(line)
+	switch {
+	case st.fence != "":
+		if strings.HasPrefix(t, st.fence) && strings.Trim(t, st.fence[:1]) == "" {
+			st.fence, st.fenceLine = "", ""
 		}
+	case strings.HasPrefix(t, "```") || strings.HasPrefix(t, "~~~"):
+		n := 3
+		for n < len(t) && t[n] == t[0] {
+			n++
+		}
+		st.fence, st.fenceLine = t[:n], line
+	case strings.HasPrefix(t, "<details"):
+		st.details++
+	case t == "</details>" && st.details > 0:
+		st.details--
+	}
+}
 
-		for _, c := range comments {
-			firstLine := c.Body
-			if i := strings.IndexByte(c.Body, '\n'); i >= 0 {
-				firstLine = c.Body[:i]
+// open reports whether a code fence or <details> block is open
+func (st blockState) open() bool {
+	return st.fence != "" || st.details > 0
+}
+
+// closers returns the lines that close the open blocks
+func (st blockState) closers() string {
+	var b strings.Builder
+	if st.fence != "" {
+		b.WriteString("\n" + st.fence)
+	}
+	for range st.details {
+		b.WriteString("\n\n</details>")
+	}
+	return b.String()
+}
+
+// reopeners returns the lines that reopen the blocks closed by closers
+func (st blockState) reopeners() string {
+	var b strings.Builder
+	for range st.details {
+		b.WriteString("<details>\n<summary>Show quoted email (continued)</summary>\n\n")
+	}
+	if st.fence != "" {
+		b.WriteString(st.fenceLine + "\n")
+	}
+	return b.String()
+}
+
+// splitReserve is the room left in a part for closing and reopening
+// blocks when a part has to be split inside one
+const splitReserve = 200
+
+// splitComment splits comment into parts of at most limit characters.
+// Parts end at a blank line outside any code fence or <details> block
+// where possible, or else at the end of a line outside them. A block
+// that does not fit in a part on its own is closed at the end of the
+// part and reopened at the start of the next.
+func splitComment(comment string, limit int) []string {
+	var parts []string
+	rest := comment
+	// rest starts with this many bytes of reopened blocks, which are not
+	// part of the comment and must not make up a part on their own
+	reopened := 0
+	for utf8.RuneCountInString(rest) > limit {
+		window := rest[:runeOffset(rest, limit)]
+		blank, line := -1, -1
+		var st blockState
+		for off := 0; ; {
+			i := strings.IndexByte(window[off:], '\n')
+			if i < 0 {
+				break
 			}
-			if strings.TrimSpace(firstLine) == needle {
-				return true, nil
+			text := window[off : off+i]
+			st.scan(text)
+			off += i + 1
+			if !st.open() {
+				line = off
+				if strings.TrimSpace(text) == "" {
+					blank = off
+				}
 			}
 		}
-		page++
+		cut := blank
+		if cut < len(window)/4 {
+			cut = line
+		}
+		if cut > reopened {
+			parts = append(parts, strings.TrimRight(rest[:cut], "\n"))
+			rest = strings.TrimLeft(rest[cut:], "\n")
+			reopened = 0
+			continue
+		}
+		// inside a block that does not fit in a part: cut at the last
+		// line break leaving room to close and reopen it, or inside a
+		// line longer than a part
+		window = rest[:runeOffset(rest, max(limit-splitReserve, limit/2, 1))]
+		cut = strings.LastIndexByte(window, '\n') + 1
+		if cut <= reopened {
+			cut = len(window)
+		}
+		if cut <= reopened {
+			cut = reopened + runeOffset(rest[reopened:], 1)
+		}
+		st = blockState{}
+		for _, l := range strings.Split(strings.TrimSuffix(rest[:cut], "\n"), "\n") {
+			st.scan(l)
+		}
+		parts = append(parts, strings.TrimRight(rest[:cut], "\n")+st.closers())
+		rest = st.reopeners() + rest[cut:]
+		reopened = len(st.reopeners())
+	}
+	return append(parts, rest)
+}
+
+// runeOffset returns the byte offset of the n-th rune of s
+func runeOffset(s string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
 	}
+	return len(s)
 }
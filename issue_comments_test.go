@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTruncateComment_Short(t *testing.T) {
+	in := "From: a@example.com\n\nShort body"
+	if got := truncateComment(in, 100, ""); got != in {
+		t.Errorf("short comment changed: %q", got)
+	}
+}
+
+func TestTruncateComment(t *testing.T) {
+	para := strings.Repeat("lorem ipsum dolor sit amet ", 20) + "\n\n"
+	code := "```go\n" + strings.Repeat("fmt.Println(\"hello\")\n", 40) + "```\n\n"
+	details := "<details>\n<summary>Show quoted email</summary>\n\n" + strings.Repeat("> quoted line\n", 100) + "\n</details>"
+	tests := []struct {
+		name    string
+		comment string
+		limit   int
+		fullURL string
+	}{
+		{name: "paragraphs", comment: strings.Repeat(para, 50), limit: 2000},
+		{name: "inside fence", comment: para + code + code + para, limit: 1000},
+		{name: "inside tilde fence", comment: para + strings.ReplaceAll(code, "```", "~~~~") + para, limit: 800},
+		{name: "inside details", comment: para + details, limit: 900},
+		{name: "single long line", comment: strings.Repeat("é", 5000), limit: 1000},
+		{name: "with link", comment: strings.Repeat(para, 50), limit: 2000, fullURL: "https://example.com/full-message.md"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := truncateComment(tc.comment, tc.limit, tc.fullURL)
+			if n := utf8.RuneCountInString(got); n > tc.limit {
+				t.Errorf("truncated comment is %d characters, limit %d", n, tc.limit)
+			}
+			if !strings.Contains(got, "characters omitted") {
+				t.Errorf("missing truncation marker:\n%s", got)
+			}
+			if tc.fullURL != "" && !strings.Contains(got, "[full message]("+tc.fullURL+")") {
+				t.Errorf("missing full message link:\n%s", got)
+			}
+			if strings.Count(got, "```")%2 != 0 || strings.Count(got, "~~~~")%2 != 0 {
+				t.Errorf("unbalanced code fence:\n%s", got)
+			}
+			if strings.Count(got, "<details>") != strings.Count(got, "</details>") {
+				t.Errorf("unbalanced details block:\n%s", got)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncated comment is not valid UTF-8")
+			}
+		})
+	}
+}
+
+func TestTruncateComment_OmittedCount(t *testing.T) {
+	in := strings.Repeat("a", 600) + "\n\n" + strings.Repeat("b", 600)
+	got := truncateComment(in, 700, "")
+	want := strings.Repeat("a", 600) + "\n\n_… truncated, 602 characters omitted_"
+	if got != want {
+		t.Errorf("truncateComment mismatch:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+	}
+}
+
+func TestSplitComment(t *testing.T) {
+	para := strings.Repeat("lorem ipsum dolor sit amet ", 20) + "\n\n"
+	code := "```go\n" + strings.Repeat("fmt.Println(\"hello\")\n", 20) + "```\n\n"
+	details := "<details>\n<summary>Show quoted email</summary>\n\n" + strings.Repeat("> quoted line\n", 30) + "\n</details>"
+	tests := []struct {
+		name    string
+		comment string
+		limit   int
+	}{
+		{name: "paragraphs", comment: strings.Repeat(para, 20), limit: 2000},
+		{name: "code blocks", comment: strings.Repeat(para+code, 10), limit: 1500},
+		{name: "details", comment: strings.Repeat(para, 5) + details, limit: 1500},
+		{name: "oversized fence", comment: para + "```\n" + strings.Repeat("x = 1\n", 500) + "```\n\n" + para, limit: 1000},
+		{name: "oversized details", comment: para + "<details>\n<summary>Show quoted email</summary>\n\n" + strings.Repeat("> quoted line\n", 300) + "\n</details>", limit: 1000},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			parts := splitComment(tc.comment, tc.limit)
+			if len(parts) < 2 {
+				t.Fatalf("expected several parts, got %d", len(parts))
+			}
+			for i, p := range parts {
+				if n := utf8.RuneCountInString(p); n > tc.limit {
+					t.Errorf("part %d is %d characters, limit %d", i+1, n, tc.limit)
+				}
+				if strings.Count(p, "```")%2 != 0 {
+					t.Errorf("part %d has an unbalanced code fence:\n%s", i+1, p)
+				}
+				if strings.Count(p, "<details>") != strings.Count(p, "</details>") {
+					t.Errorf("part %d has an unbalanced details block:\n%s", i+1, p)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitComment_LongLineInFence(t *testing.T) {
+	// minified JSON, one line longer than a part
+	line := strings.Repeat(`{"a":1},`, 1000)
+	comment := "Log:\n\n```json\n" + line + "\n```\n\nThanks"
+	parts := splitComment(comment, 1000)
+	if len(parts) < 8 {
+		t.Fatalf("expected the line to be split over several parts, got %d", len(parts))
+	}
+	commas := 0
+	for i, p := range parts {
+		if n := utf8.RuneCountInString(p); n > 1000 {
+			t.Errorf("part %d is %d characters, limit 1000", i+1, n)
+		}
+		if strings.Count(p, "```")%2 != 0 {
+			t.Errorf("part %d has an unbalanced code fence:\n%s", i+1, p)
+		}
+		commas += strings.Count(p, ",")
+	}
+	if commas != 1000 {
+		t.Errorf("parts have %d of the 1000 commas of the line", commas)
+	}
+	if !strings.HasSuffix(parts[len(parts)-1], "Thanks") {
+		t.Errorf("last part is %q", parts[len(parts)-1])
+	}
+}
+
+func TestSplitComment_BlankLineBoundaries(t *testing.T) {
+	para := strings.Repeat("word ", 99) + "word\n\n"
+	comment := strings.TrimSpace(strings.Repeat(para, 10))
+	parts := splitComment(comment, 1200)
+	for i, p := range parts {
+		if strings.HasPrefix(p, " ") || !strings.HasSuffix(p, "word") {
+			t.Errorf("part %d not split at a paragraph boundary: %q...%q", i+1, p[:10], p[len(p)-10:])
+		}
+	}
+	if got := strings.Join(parts, "\n\n"); got != comment {
+		t.Errorf("parts do not rejoin to the original comment")
+	}
+}
+
+func TestPostedMessageID(t *testing.T) {
+	tests := []struct {
+		firstLine string
+		part      int
+		want      bool
+	}{
+		{firstLine: "Message-ID: <a@example.com>", part: 0, want: true},
+		{firstLine: "Message-ID: <a@example.com>", part: 2, want: true},
+		{firstLine: "Message-ID: <a@example.com> (part 2/3)", part: 2, want: true},
+		{firstLine: "Message-ID: <a@example.com> (part 2/3)", part: 0, want: true},
+		{firstLine: "Message-ID: <a@example.com> (part 1/3)", part: 2, want: false},
+		{firstLine: "Message-ID: <b@example.com> (part 2/3)", part: 2, want: false},
+		{firstLine: "From: <a@example.com>", part: 0, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.firstLine, func(t *testing.T) {
+			if got := postedMessageID(tc.firstLine, "<a@example.com>", tc.part); got != tc.want {
+				t.Errorf("postedMessageID(%q, part %d) = %v, want %v", tc.firstLine, tc.part, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMessageIDLine_RoundTrip(t *testing.T) {
+	id, part, ok := parseMessageIDLine(messageIDLine("<a@example.com>", 2, 3))
+	if !ok || id != "<a@example.com>" || part != 2 {
+		t.Errorf("parseMessageIDLine = %q, %d, %v", id, part, ok)
+	}
+}
+
+func TestQuotesComment(t *testing.T) {
+	comment := messageIDLine("<abc@example.ac.uk>", 0, 0) +
+		commentHeader("Research Computing <support@example.ac.uk>", time.Date(2025, 3, 18, 17, 3, 0, 0, time.UTC)) +
+		"Hi Ann,\n\nPlease run `module load Anaconda3` **before** activating the environment.\n\nResearch Computing"
+	tests := []struct {
+		name, quoted string
+		want         bool
+	}{
+		{"Gmail quote", "On Tue, 18 Mar 2025 at 17:03, Research Computing <support@example.ac.uk> wrote:\n" +
+			"> Hi Ann,\n>\n> Please run module load Anaconda3 before activating the environment.\n>\n> Research Computing", true},
+		{"Outlook quote with older messages", "From: Research Computing <support@example.ac.uk>\nSent: 18 March 2025 17:03\n" +
+			"To: Ann Example <ann@example.ac.uk>\nSubject: RE: Conda\n\nHi Ann,\n\nPlease run module load Anaconda3 before " +
+			"activating the environment.\n\nResearch Computing\n\nFrom: Ann Example\nSent: 18 March 2025 12:00\n\nMy environment fails.", true},
+		{"another message", "On Mon, 17 Mar 2025 at 09:00, Research Computing <support@example.ac.uk> wrote:\n" +
+			"> Hi Ann,\n>\n> Your account is ready.", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := quotesComment(tc.quoted, comment); got != tc.want {
+				t.Errorf("quotesComment() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
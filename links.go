@@ -0,0 +1,104 @@
+// Unwraps links rewritten by mail security gateways (Microsoft Defender
+// SafeLinks and Proofpoint URLDefense), which hide the original URL
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// wrappedURLRe matches URLs in text that may be wrapped
+var wrappedURLRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// unwrapURLs replaces the wrapped links in text with their original URLs
+func unwrapURLs(text string) string {
+	return wrappedURLRe.ReplaceAllStringFunc(text, unwrapURL)
+}
+
+// unwrapURL returns the original URL of a SafeLinks or URLDefense link,
+// or u itself if it is not one or cannot be decoded
+func unwrapURL(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	host := strings.ToLower(p.Hostname())
+	var orig string
+	switch {
+	case strings.HasSuffix(host, ".safelinks.protection.outlook.com"),
+		strings.HasSuffix(host, ".safelinks.protection.office365.us"):
+		orig = p.Query().Get("url")
+	case host == "urldefense.proofpoint.com" && strings.HasPrefix(p.Path, "/v1/"):
+		orig = p.Query().Get("u")
+	case host == "urldefense.proofpoint.com" && strings.HasPrefix(p.Path, "/v2/"):
+		orig = urlDefenseV2(p.Query().Get("u"))
+	case host == "urldefense.com" || host == "urldefense.proofpoint.com":
+		orig = urlDefenseV3(u)
+	}
+	if o, err := url.Parse(orig); err != nil || (o.Scheme != "http" && o.Scheme != "https" && o.Scheme != "mailto") {
+		return u
+	}
+	return orig
+}
+
+// urlDefenseV2 decodes the u parameter of a URLDefense v2 link, in which
+// "-" stands for "%" and "_" for "/"
+func urlDefenseV2(u string) string {
+	s, err := url.PathUnescape(strings.NewReplacer("-", "%", "_", "/").Replace(u))
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// urlDefenseV3Re matches a URLDefense v3 link: the URL, with some
+// characters replaced by "*", and the replaced characters in base64
+var urlDefenseV3Re = regexp.MustCompile(`/v3/__(.+?)__;([^!]*)!`)
+
+// urlDefenseV3Runs maps the character after "**" to the length of the run
+// of replaced characters it stands for
+const urlDefenseV3Runs = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// urlDefenseV3 decodes a URLDefense v3 link. A "*" in the URL is the next
+// replaced character, and "**" followed by a character from
+// urlDefenseV3Runs is the next run of 2 to 65 of them.
+func urlDefenseV3(u string) string {
+	m := urlDefenseV3Re.FindStringSubmatch(u)
+	if m == nil {
+		return ""
+	}
+	enc := m[2]
+	if n := len(enc) % 4; n != 0 {
+		enc += strings.Repeat("=", 4-n)
+	}
+	dec, err := base64.URLEncoding.DecodeString(enc)
+	if err != nil || !utf8.Valid(dec) {
+		return ""
+	}
+	replaced := []rune(string(dec))
+	var b strings.Builder
+	s := m[1]
+	for i := 0; i < len(s); i++ {
+		if s[i] != '*' {
+			b.WriteByte(s[i])
+			continue
+		}
+		n := 1
+		if i+2 < len(s) && s[i+1] == '*' {
+			n = strings.IndexByte(urlDefenseV3Runs, s[i+2]) + 2
+			if n < 2 {
+				return ""
+			}
+			i += 2
+		}
+		if n > len(replaced) {
+			return ""
+		}
+		b.WriteString(string(replaced[:n]))
+		replaced = replaced[n:]
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestUnwrapURL(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "SafeLinks",
+			in: "https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fgithub.com%2Foxfordrse%2Fticket-dispatcher%3Ftab%3Dreadme" +
+				"&data=05%7C01%7Cann%40example.ac.uk%7C1234&sdata=abc%3D&reserved=0",
+			want: "https://github.com/oxfordrse/ticket-dispatcher?tab=readme",
+		},
+		{
+			name: "URLDefense v2",
+			in:   "https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_docs-3Fpage-3D2&d=DwMFaQ&c=abc&r=xyz&m=1&s=2&e=",
+			want: "https://example.com/docs?page=2",
+		},
+		{
+			name: "URLDefense v3",
+			in:   "https://urldefense.com/v3/__https://example.com/report*id=1**Aend__;PyZ4!!ABCD!efgh$",
+			want: "https://example.com/report?id=1&xend",
+		},
+		{
+			name: "URLDefense v3 with nothing replaced",
+			in:   "https://urldefense.com/v3/__https://example.com/__;!!ABCD!efgh$",
+			want: "https://example.com/",
+		},
+		{
+			name: "not wrapped",
+			in:   "https://example.com/?url=https%3A%2F%2Fother.example.com",
+			want: "https://example.com/?url=https%3A%2F%2Fother.example.com",
+		},
+		{
+			name: "undecodable",
+			in:   "https://urldefense.com/v3/__https://example.com/*__;!!!",
+			want: "https://urldefense.com/v3/__https://example.com/*__;!!!",
+		},
+		{
+			name: "SafeLinks to a non-web URL",
+			in:   "https://nam12.safelinks.protection.outlook.com/?url=javascript%3Aalert(1)",
+			want: "https://nam12.safelinks.protection.outlook.com/?url=javascript%3Aalert(1)",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := unwrapURL(tc.in); got != tc.want {
+				t.Errorf("unwrapURL(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnwrapURLs(t *testing.T) {
+	in := "See <https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fdocs&data=05%7C01> and\n" +
+		"https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_faq&d=DwMFaQ for details."
+	want := "See <https://example.com/docs> and\nhttps://example.com/faq for details."
+	if got := unwrapURLs(in); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -2,14 +2,20 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/mail"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -18,29 +24,246 @@ import (
 )
 
 var (
-	ticketDomain    string
-	githubProject   string
-	whitelistDomain string
-	s3Client        *s3.Client
+	ticketDomain     string
+	githubProject    string
+	whitelistDomains []string
+	s3Client         *s3.Client
+
+	// addresses that are rejected, or accepted whatever their domain, set
+	// by SENDER_BLOCKLIST and SENDER_ALLOWLIST
+	senderBlocklist []string
+	senderAllowlist []string
+
+	// plus-addressed tickets, e.g. issues+123@example.com, enabled by
+	// TICKET_ADDRESS_PREFIX
+	ticketAddressPrefix    string
+	ticketAddressSeparator = defaultTicketAddressSeparator
+
+	// ticket addresses of other repositories, e.g. hpc-123@ or
+	// 123@hpc. for the route hpc, set by ROUTES
+	routes map[string]string
+
+	// replies not addressed to the ticket address are dispatched to the
+	// issue in their subject, unless DISABLE_SUBJECT_ISSUE_NUMBER is set
+	subjectIssueNumbers = true
+	subjectIssuePattern = subjectIssueRe("")
+
+	// optional attachment upload, enabled by ATTACHMENT_BUCKET
+	attachmentBucket    string
+	attachmentPrefix    string
+	attachmentPublicURL string
+	maxAttachmentBytes  int64
+	maxAttachmentsBytes int64
+
+	// larger text parts are truncated rather than read into memory
+	maxDecodedBytes int64 = defaultMaxDecodedBytes
+
+	// charset used for bodies that are not valid in their declared
+	// charset; detected if unset
+	fallbackCharset string
+
+	// use the text/html part even when there is a text/plain part
+	preferHTML bool
+
+	// show small text attachments in the comment
+	inlineTextAttachments bool
+	maxInlineTextBytes    int64 = defaultMaxInlineTextBytes
+
+	// message/partial fragments are logged instead of getting a notice
+	logPartialMessages bool
+
+	// later messages of a multipart/digest are left out
+	maxDigestMessages int64 = defaultMaxDigestMessages
+
+	// how HTML bodies are converted to markdown
+	htmlOptions = DefaultHTMLConvertOptions()
+
+	// @mentions and #123 references in emails are posted as they are
+	keepMentions bool
+
+	// signatures after a "-- " line are removed rather than collapsed
+	stripSignatures bool
+
+	// footers appended by mail gateways, removed from the visible text
+	footerPatterns []*regexp.Regexp
+
+	// one-line trailers of mail apps, removed from the end of the visible
+	// text
+	trailerPatterns = parseTrailerPatterns("")
+
+	// how the quoted part of a message is found
+	quoteOpts = defaultQuoteOptions()
+
+	// what is done with the quoted part of a message
+	quotedText = quotedRemove
+
+	// replies with fewer letters and digits besides the quoted text are
+	// not posted
+	minReplyChars int64 = defaultMinReplyChars
+
+	// longer comments are truncated, or split if splitLongComments is set
+	maxCommentChars   int64
+	splitLongComments bool
 )
 
 func loadConfig() {
+	var err error
 	// read env vars
 	ticketDomain = os.Getenv("TICKET_DISPATCHER_DOMAIN")
-	whitelistDomain = os.Getenv("WHITELIST_DOMAIN")
 	githubProject = os.Getenv("GITHUB_PROJECT")
+	subjectIssueNumbers = os.Getenv("DISABLE_SUBJECT_ISSUE_NUMBER") == ""
+	subjectIssuePattern = subjectIssueRe(githubProject)
+	ticketAddressPrefix = os.Getenv("TICKET_ADDRESS_PREFIX")
+	ticketAddressSeparator = defaultTicketAddressSeparator
+	if sep := os.Getenv("TICKET_ADDRESS_SEPARATOR"); sep != "" {
+		ticketAddressSeparator = sep
+	}
 
 	if ticketDomain == "" {
 		log.Fatalf("TICKET_DISPATCHER_DOMAIN is not set, example: issues.example.com")
 	}
 
-	if whitelistDomain == "" {
-		log.Fatalf("WHITELIST_DOMAIN is unset, set to a domain that is allowed to send emails")
+	whitelistDomains, err = parseDomains(os.Getenv("WHITELIST_DOMAIN"))
+	if err != nil {
+		log.Fatalf("invalid WHITELIST_DOMAIN: %v", err)
+	}
+	if len(whitelistDomains) == 0 {
+		log.Fatalf("WHITELIST_DOMAIN is unset, set to a domain, or a comma-separated list of domains, that is allowed to send emails")
+	}
+
+	if senderBlocklist, err = parseAddresses(os.Getenv("SENDER_BLOCKLIST")); err != nil {
+		log.Fatalf("invalid SENDER_BLOCKLIST: %v", err)
+	}
+	if senderAllowlist, err = parseAddresses(os.Getenv("SENDER_ALLOWLIST")); err != nil {
+		log.Fatalf("invalid SENDER_ALLOWLIST: %v", err)
 	}
 
 	if githubProject == "" {
 		fmt.Println("GITHUB_PROJECT not set, will not comment on issues, only writing metadata")
 	}
+
+	if routes, err = parseRoutes(os.Getenv("ROUTES")); err != nil {
+		log.Fatalf("invalid ROUTES: %v", err)
+	}
+
+	attachmentBucket = os.Getenv("ATTACHMENT_BUCKET")
+	attachmentPrefix = os.Getenv("ATTACHMENT_PREFIX")
+	attachmentPublicURL = os.Getenv("ATTACHMENT_PUBLIC_URL")
+	maxAttachmentBytes = envInt64("MAX_ATTACHMENT_BYTES", 10<<20)
+	maxAttachmentsBytes = envInt64("MAX_ATTACHMENTS_BYTES", 25<<20)
+	// MAX_PART_BYTES is the older name
+	maxDecodedBytes = envInt64("MAX_DECODED_BYTES", envInt64("MAX_PART_BYTES", defaultMaxDecodedBytes))
+	fallbackCharset = os.Getenv("FALLBACK_CHARSET")
+	preferHTML = os.Getenv("PREFER_HTML") != ""
+	inlineTextAttachments = os.Getenv("INLINE_TEXT_ATTACHMENTS") != ""
+	maxInlineTextBytes = envInt64("MAX_INLINE_TEXT_BYTES", defaultMaxInlineTextBytes)
+	maxDigestMessages = envInt64("MAX_DIGEST_MESSAGES", defaultMaxDigestMessages)
+	logPartialMessages = os.Getenv("LOG_PARTIAL_MESSAGES") != ""
+	keepMentions = os.Getenv("KEEP_MENTIONS") != ""
+	stripSignatures = os.Getenv("STRIP_SIGNATURES") != ""
+	footerPatterns = parseFooterPatterns(os.Getenv("FOOTER_PATTERNS"))
+	trailerPatterns = parseTrailerPatterns(os.Getenv("TRAILER_PATTERNS"))
+	quoteOpts = quoteOptionsFromEnv()
+	quotedText = quotedTextModeFromEnv()
+	minReplyChars = envInt64("MIN_REPLY_CHARS", defaultMinReplyChars)
+	htmlOptions = htmlOptionsFromEnv()
+	maxCommentChars = envInt64("MAX_COMMENT_CHARS", defaultMaxCommentChars)
+	if maxCommentChars < minCommentChars {
+		log.Printf("invalid MAX_COMMENT_CHARS=%d, less than %d, using default %d", maxCommentChars, minCommentChars, defaultMaxCommentChars)
+		maxCommentChars = defaultMaxCommentChars
+	}
+	splitLongComments = os.Getenv("SPLIT_LONG_COMMENTS") != ""
+}
+
+// htmlOptionsFromEnv returns the options for converting HTML bodies set by
+// the environment
+func htmlOptionsFromEnv() HTMLConvertOptions {
+	opts := HTMLConvertOptions{
+		MaxDepth:           envInt64("MAX_HTML_DEPTH", defaultMaxHTMLDepth),
+		MaxNodes:           envInt64("MAX_HTML_NODES", defaultMaxHTMLNodes),
+		MaxOutputBytes:     envInt64("MAX_HTML_OUTPUT_BYTES", defaultMaxHTMLOutputBytes),
+		ReflowBRParagraphs: os.Getenv("REFLOW_BR_PARAGRAPHS") != "",
+		StyledHeadings:     os.Getenv("DISABLE_STYLED_HEADINGS") == "",
+		Signatures:         os.Getenv("HTML_SIGNATURES"),
+		Project:            githubProject,
+		// a bare #123 would be escaped by escapeMentions
+		ShortIssueLinks: keepMentions,
+	}
+	switch opts.Signatures {
+	case signatureDrop, signatureCollapse, signatureKeep:
+	default:
+		if opts.Signatures != "" {
+			log.Printf("unknown HTML_SIGNATURES %q, collapsing signatures", opts.Signatures)
+		}
+		opts.Signatures = signatureCollapse
+	}
+	return opts
+}
+
+// quotedTextModeFromEnv returns the QUOTED_TEXT_MODE, exiting if it is not
+// one of remove, collapse or keep. SHOW_QUOTED_TEXT, which it replaces,
+// still collapses quotes when it is not set.
+func quotedTextModeFromEnv() quotedTextMode {
+	mode := quotedTextMode(os.Getenv("QUOTED_TEXT_MODE"))
+	switch mode {
+	case quotedRemove, quotedCollapse, quotedKeep:
+		return mode
+	case "":
+		if os.Getenv("SHOW_QUOTED_TEXT") != "" {
+			log.Printf("SHOW_QUOTED_TEXT is deprecated, set QUOTED_TEXT_MODE=collapse instead")
+			return quotedCollapse
+		}
+		return quotedRemove
+	}
+	log.Fatalf("unknown QUOTED_TEXT_MODE %q, must be remove, collapse or keep", mode)
+	return ""
+}
+
+// quoteOptionsFromEnv returns the options for finding the quoted part of
+// messages set by the environment, exiting if QUOTE_PATTERNS_EXTRA is not
+// a JSON array of valid regular expressions
+func quoteOptionsFromEnv() quoteOptions {
+	opts := defaultQuoteOptions()
+	if n := envInt64("QUOTE_MIN_LINES", defaultQuoteMinLines); n > 0 {
+		opts.minLines = int(n)
+	}
+	opts.replacePatterns = os.Getenv("QUOTE_PATTERNS_REPLACE") != ""
+	if opts.replacePatterns {
+		opts.patterns = nil
+	}
+	v := os.Getenv("QUOTE_PATTERNS_EXTRA")
+	if v == "" {
+		return opts
+	}
+	var extra []string
+	if err := json.Unmarshal([]byte(v), &extra); err != nil {
+		log.Fatalf("QUOTE_PATTERNS_EXTRA must be a JSON array of regular expressions: %v", err)
+	}
+	// a copy, so that the defaults are not appended to
+	opts.patterns = slices.Clone(opts.patterns)
+	for _, p := range extra {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			log.Fatalf("invalid QUOTE_PATTERNS_EXTRA pattern %q: %v", p, err)
+		}
+		opts.patterns = append(opts.patterns, re)
+	}
+	return opts
+}
+
+// envInt64 reads an integer environment variable, returning def if it
+// is unset or invalid
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s=%q, using default %d", name, v, def)
+		return def
+	}
+	return n
 }
 
 func initS3() {
@@ -52,64 +275,356 @@ func initS3() {
 }
 
 func handler(ctx context.Context, s3Event events.S3Event) error {
-	quoteConfig := os.Getenv("SHOW_QUOTED_TEXT")
-	removeQuotes := quoteConfig == ""
 	for _, rec := range s3Event.Records {
 		bucket := rec.S3.Bucket.Name
 		key := rec.S3.Object.Key
 		log.Printf("processing s3://%s/%s", bucket, key)
 
-		objOut, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
-		})
+		msg, err := openMessage(ctx, bucket, key)
 		if err != nil {
-			log.Printf("failed get object: %v", err)
+			logFailure(key, err)
 			continue
 		}
-		raw, err := io.ReadAll(objOut.Body)
-		objOut.Body.Close()
-		if err != nil {
-			log.Printf("failed read object body: %v", err)
+
+		if b, ok := detectBounce(msg.Message); ok {
+			msg.Close()
+			logBounce(key, msg.Header.Get("Message-ID"), b)
 			continue
 		}
-		msg, err := mail.ReadMessage(bytes.NewReader(raw))
 
 		msgId := msg.Header.Get("Message-ID")
 		toHeader := msg.Header.Get("To")
 		ccHeader := msg.Header.Get("Cc")
 		fromHeader := msg.Header.Get("From")
-		subject := msg.Header.Get("Subject")
+		subject := decodeHeader(msg.Header.Get("Subject"))
 		auth := msg.Header.Get("Authentication-Results")
 
-		issue := extractIssueNumber(toHeader, ccHeader)
+		targets, source := findTargets(msg.Header)
+		if source != "" {
+			log.Printf("%s issue %s from the %s", msgId, targets[0], source)
+		}
+		senderAddress := extractSenderAddress(fromHeader)
 		senderDomain := extractSenderDomain(fromHeader)
 
+		// before the sender checks, which our own mail would fail
+		if reason := headerLoopReason(msg.Header); reason != "" {
+			msg.Close()
+			log.Printf("%s skipped, mail loop: %s", msgId, reason)
+			continue
+		}
 		if !strings.Contains(auth, "spf=pass") && !strings.Contains(auth, "dkim=pass") {
 			log.Fatalf("%s authentication failure, possibly spoofed", msgId)
 		}
-		if !strings.HasSuffix(senderDomain, whitelistDomain) {
-			log.Fatalf("sender does not have a '%s' email address", whitelistDomain)
+		if reason := senderRejection(senderAddress, senderDomain); reason != "" {
+			log.Fatalf("%s sender rejected, %s", msgId, reason)
+		}
+		if len(targets) == 0 {
+			log.Fatalf("no issue number found in To:, Cc:, the envelope recipients, Subject:, In-Reply-To: or References:")
+		}
+		log.Printf("%s | From: %s; To: %s; Cc: %s; Subject: %s\n", msgId,
+			decodeHeader(fromHeader), decodeHeader(toHeader), decodeHeader(ccHeader), subject)
+		// fragments are never reassembled, so don't decode anything
+		if p, ok := detectPartial(msg.Header); ok {
+			msg.Close()
+			if logPartialMessages {
+				log.Printf("%s skipped: %s", msgId, partialNotice(p))
+				continue
+			}
+			log.Printf("%s is a message/partial fragment, posting notice", msgId)
+			header := commentHeader(decodeHeader(fromHeader), sentTime(msg.Header.Get("Date"), msg.LastModified))
+			postToIssues(targets, msgId, func(t ticketTarget) error {
+				return postIssueComment(t.repo, t.issue, msgId, renderComment(header, partialNotice(p), nil, nil))
+			})
+			os.Exit(0)
+		}
+		var links []attachmentLink
+		if attachmentBucket != "" {
+			// don't hold the message stream open while uploading
+			msg.Close()
+			links = uploadMessageAttachments(ctx, bucket, key, msgId)
+			msg, err = openMessage(ctx, bucket, key)
+			if err != nil {
+				log.Fatalf("%s %v", msgId, err)
+			}
+		}
+		decodeCtx, cancel := decodeContext(ctx)
+		extracted, err := extractEmail(decodeCtx, msg.Message, inlineImageURLs(links))
+		cancel()
+		msg.Close()
+		var timeout *DecodeTimeoutError
+		if errors.As(err, &timeout) {
+			// the error names the part being decoded
+			logFailure(key, err)
+			continue
+		}
+		for _, w := range extracted.Warnings {
+			log.Printf("%s warning: %s", msgId, w)
+		}
+		body := extracted.Body
+		if errors.Is(err, errNoTextPart) {
+			err = nil
+		}
+		if reason := bodyLoopReason(body); reason != "" {
+			log.Printf("%s skipped, mail loop: %s", msgId, reason)
+			continue
 		}
-		if issue == "" {
-			log.Fatalf("no issue number found in To: or Cc:")
+		// in inline text mode, files that are not inlined are listed (see
+		// renderComment), and a file used as the body is listed too
+		listAttachments := inlineTextAttachments || extracted.BodyFromAttachment
+		if errors.Is(err, errEncrypted) {
+			log.Printf("%s is encrypted, posting notice", msgId)
+			body = encryptedNotice(decodeHeader(fromHeader), msg.Header.Get("Date"))
+			err = nil
+		} else if err == nil && !hasTextContent(body) {
+			log.Printf("%s has no text content, posting notice", msgId)
+			body = noTextNotice(extracted)
+			listAttachments = true
+		}
+		if err == nil && links == nil && listAttachments && len(extracted.Attachments) > 0 {
+			// list the attachments even though they are not uploaded
+			links = listMessageAttachments(ctx, bucket, key, msgId)
 		}
-		log.Printf("%s | From: %s; To: %s; Subject: %s\n", msgId, fromHeader, toHeader, subject)
-		body, err := extractBodyAsMarkdown(msg)
 		if err != nil {
 			log.Fatalf("error in extracting message body")
 		} else {
-			header := fmt.Sprintf("From: %s\n\n", fromHeader)
-			err := postIssueComment(issue, msgId, header+hideQuotedPart(body, removeQuotes))
-			if err != nil {
-				log.Printf("postIssueComment err=%v", err)
+			parts := SplitQuoted(body, quoteOpts)
+			if n := utf8.RuneCountInString(parts.Quoted); n > 0 {
+				log.Printf("%s hiding %d characters of quoted text", msgId, n)
+			}
+			hasAttachments := len(links) > 0 || len(extracted.TextAttachments) > 0
+			if isEmptyReply(parts, hasAttachments, int(minReplyChars)) {
+				log.Printf("%s empty reply skipped", msgId)
+				continue
+			}
+			// an accidental send of the previous message, when empty
+			// replies are posted
+			onlyQuotes := !hasLetter(parts.Visible) && parts.Quoted != ""
+			header := commentHeader(decodeHeader(fromHeader), sentTime(msg.Header.Get("Date"), msg.LastModified))
+			comment := renderComment(header, stripFooter(parts.render(quotedText)), extracted.TextAttachments, links)
+			limit := int(maxCommentChars) - utf8.RuneCountInString(messageIDLine(msgId, 0, 0))
+			n := utf8.RuneCountInString(comment)
+			var post func(t ticketTarget) error
+			switch {
+			case n > limit && splitLongComments:
+				// room for the longest part suffix we expect
+				limit = int(maxCommentChars) - utf8.RuneCountInString(messageIDLine(msgId, 999, 999))
+				commentParts := splitComment(comment, limit)
+				log.Printf("%s comment is %d characters, posting as %d parts", msgId, n, len(commentParts))
+				post = func(t ticketTarget) error { return postIssueCommentParts(t.repo, t.issue, msgId, commentParts) }
+			case n > limit:
+				log.Printf("%s comment is %d characters, truncating to %d", msgId, n, limit)
+				fullURL := ""
+				if attachmentBucket != "" {
+					fullURL = uploadFullComment(ctx, msgId, comment)
+				}
+				truncated := truncateComment(comment, limit, fullURL)
+				post = func(t ticketTarget) error { return postIssueComment(t.repo, t.issue, msgId, truncated) }
+			default:
+				post = func(t ticketTarget) error { return postIssueComment(t.repo, t.issue, msgId, comment) }
 			}
+			postToIssues(targets, msgId, func(t ticketTarget) error {
+				if onlyQuotes {
+					if prev, err := lastIssueComment(t.repo, t.issue); err != nil {
+						log.Printf("%s failed to get the previous comment of issue %s: %v", msgId, t, err)
+					} else if quotesComment(parts.Quoted, prev) {
+						return errOnlyQuotes
+					}
+				}
+				return post(t)
+			})
 		}
 		os.Exit(0)
 	}
 	return nil
 }
 
+// renderComment assembles the comment posted for an email: the header,
+// the body, the text attachments shown inline and the list of the other
+// attachments. Mentions are escaped in all of it, as the sender's name and
+// the filenames are the sender's text too.
+func renderComment(header, body string, inlined []textAttachment, links []attachmentLink) string {
+	return escapeMentions(header + body + renderTextAttachments(inlined) + renderAttachmentLinks(withoutInlined(links, inlined)))
+}
+
+// errOnlyQuotes is returned for an email that only quotes the previous
+// comment of an issue, which is not posted to it
+var errOnlyQuotes = errors.New("only quotes the previous comment")
+
+// postToIssues posts an email to each of the issues it is addressed to
+// with post, logging whether it was posted to each one
+func postToIssues(targets []ticketTarget, msgId string, post func(t ticketTarget) error) {
+	for _, t := range targets {
+		switch err := post(t); {
+		case errors.Is(err, errOnlyQuotes), errors.Is(err, errAlreadyPosted):
+			log.Printf("%s skipped for issue %s, %v", msgId, t, err)
+		case err != nil:
+			log.Printf("%s failed to post to issue %s: postIssueComment err=%v", msgId, t, err)
+		default:
+			log.Printf("%s posted to issue %s", msgId, t)
+		}
+	}
+}
+
+// decodeMargin is how long before the Lambda deadline the extraction of
+// a body is stopped, leaving time to log which message and part it was
+const decodeMargin = 5 * time.Second
+
+// decodeContext returns the context to extract a body under, which ends
+// decodeMargin before the deadline of ctx
+func decodeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, d.Add(-decodeMargin))
+	}
+	return context.WithCancel(ctx)
+}
+
+// commentHeader is the start of a comment, giving the sender and the
+// time the email was sent
+func commentHeader(from string, sent time.Time) string {
+	if sent.IsZero() {
+		return fmt.Sprintf("From: %s\n\n", from)
+	}
+	return fmt.Sprintf("From: %s\nSent: %s\n\n", from, sent.UTC().Format("2006-01-02 15:04 UTC"))
+}
+
+// sentTime returns the time an email was sent from its Date header,
+// or fallback if the header is missing or cannot be parsed
+func sentTime(date string, fallback time.Time) time.Time {
+	if date == "" {
+		return fallback
+	}
+	t, err := parseDate(date)
+	if err != nil {
+		log.Printf("unparseable Date header %q, using %v: %v", date, fallback, err)
+		return fallback
+	}
+	return t
+}
+
+// logBounce writes a structured log record for a bounce that was not posted
+func logBounce(key, msgId string, b bounce) {
+	rec, _ := json.Marshal(struct {
+		Key       string `json:"key"`
+		MessageID string `json:"message_id"`
+		bounce
+	}{key, msgId, b})
+	log.Printf("bounce detected %s", rec)
+}
+
+// logFailure writes a structured log record for a message that could
+// not be processed
+func logFailure(key string, err error) {
+	rec, _ := json.Marshal(struct {
+		Key   string `json:"key"`
+		Error string `json:"error"`
+	}{key, err.Error()})
+	log.Printf("failed to process message %s", rec)
+}
+
+// encryptedNotice is posted in place of the body of an encrypted email
+func encryptedNotice(from, date string) string {
+	if date == "" {
+		date = "an unknown date"
+	}
+	return fmt.Sprintf("An encrypted email was received from %s on %s but its contents could not be read.", from, date)
+}
+
+// noTextNotice is posted in place of the body of an email with no text
+func noTextNotice(b ExtractedEmail) string {
+	switch n := len(b.images()); {
+	case n == 1:
+		return "The sender sent an image with no text content."
+	case n > 1:
+		return fmt.Sprintf("The sender sent %d images with no text content.", n)
+	case len(b.Attachments) > 0:
+		return "The sender sent an email with no text content."
+	}
+	return "The sender sent an empty email."
+}
+
+// storedMessage is an email being read from S3
+type storedMessage struct {
+	*mail.Message
+	LastModified time.Time
+	stream       io.Closer
+}
+
+// Close closes the stream the message body is read from
+func (m *storedMessage) Close() error {
+	return m.stream.Close()
+}
+
+// openMessage fetches an email from S3 and parses its header. The body
+// is streamed from S3 rather than held in memory, so it can only be read
+// once; the message must be closed to close the stream.
+func openMessage(ctx context.Context, bucket, key string) (*storedMessage, error) {
+	objOut, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed get object: %w", err)
+	}
+	msg, err := readMessage(objOut.Body)
+	if err != nil {
+		objOut.Body.Close()
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+	m := &storedMessage{Message: msg, stream: objOut.Body}
+	if objOut.LastModified != nil {
+		m.LastModified = *objOut.LastModified
+	}
+	return m, nil
+}
+
+// messageAttachments extracts attachments from the email stored in S3
+func messageAttachments(ctx context.Context, bucket, key, msgId string) []attachment {
+	msg, err := openMessage(ctx, bucket, key)
+	if err != nil {
+		log.Printf("%s failed to re-read message for attachments: %v", msgId, err)
+		return nil
+	}
+	defer msg.Close()
+	atts, err := extractAttachments(msg.Message, maxAttachmentBytes, maxAttachmentsBytes)
+	if err != nil {
+		// keep whatever was extracted before the error
+		log.Printf("%s error extracting attachments: %v", msgId, err)
+	}
+	return atts
+}
+
+// listMessageAttachments extracts attachments from the email without
+// uploading them, so that they can be listed in the comment
+func listMessageAttachments(ctx context.Context, bucket, key, msgId string) []attachmentLink {
+	atts := messageAttachments(ctx, bucket, key, msgId)
+	links := make([]attachmentLink, 0, len(atts))
+	for _, a := range atts {
+		links = append(links, attachmentLink{Attachment: a})
+	}
+	return links
+}
+
+// uploadMessageAttachments extracts attachments from the email and
+// uploads them to the attachment bucket
+func uploadMessageAttachments(ctx context.Context, bucket, key, msgId string) []attachmentLink {
+	return uploadAttachments(ctx, messageAttachments(ctx, bucket, key, msgId))
+}
+
+// uploadFullComment uploads the untruncated comment to the attachment
+// bucket, returning its URL or "" if the upload failed
+func uploadFullComment(ctx context.Context, msgId, comment string) string {
+	links := uploadAttachments(ctx, []attachment{{
+		Filename:    "full-message.md",
+		ContentType: "text/markdown; charset=utf-8",
+		Size:        int64(len(comment)),
+		Data:        []byte(comment),
+	}})
+	if len(links) == 0 || links[0].Err != nil {
+		return ""
+	}
+	return links[0].URL
+}
+
 func main() {
 	loadConfig()
 	initS3()
@@ -127,14 +642,17 @@ func debugMain() {
 	}
 	defer file.Close()
 
-	msg, err := mail.ReadMessage(file)
+	msg, err := readMessage(file)
 	if err != nil {
 		log.Fatalf("error parsing email: %v", err)
 	}
-	body, err := extractBodyAsMarkdown(msg)
+	extracted, err := ExtractEmail(context.Background(), msg)
+	for _, w := range extracted.Warnings {
+		log.Printf("warning: %s", w)
+	}
 	if err != nil {
 		log.Fatalf("error extracting body: %v", err)
-	} else {
-		fmt.Println(hideQuotedPart(body, true))
 	}
+	log.Printf("body from %s part (charset %q), %d attachments", extracted.SourceType, extracted.Charset, len(extracted.Attachments))
+	fmt.Println(escapeMentions(stripFooter(hideQuotedPart(extracted.Body, quotedRemove, quoteOpts))))
 }
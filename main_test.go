@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommentHeader(t *testing.T) {
+	lastModified := time.Date(2024, 3, 5, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		date string
+		want string
+	}{
+		{name: "offset", date: "Tue, 5 Mar 2024 20:02:00 +0530", want: "From: Alice <alice@example.com>\nSent: 2024-03-05 14:32 UTC\n\n"},
+		{name: "missing", date: "", want: "From: Alice <alice@example.com>\nSent: 2024-03-05 18:00 UTC\n\n"},
+		{name: "unparseable", date: "soon", want: "From: Alice <alice@example.com>\nSent: 2024-03-05 18:00 UTC\n\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := commentHeader("Alice <alice@example.com>", sentTime(tc.date, lastModified))
+			if got != tc.want {
+				t.Errorf("commentHeader mismatch: got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+	if got := commentHeader("alice@example.com", time.Time{}); got != "From: alice@example.com\n\n" {
+		t.Errorf("expected no Sent line without a time, got %q", got)
+	}
+}
+
+func TestNoTextNotice(t *testing.T) {
+	tests := []struct {
+		name string
+		b    ExtractedEmail
+		want string
+	}{
+		{name: "empty", want: "The sender sent an empty email."},
+		{name: "attachment", b: ExtractedEmail{Attachments: []AttachmentMeta{{Filename: "scan.pdf", ContentType: "application/pdf"}}}, want: "The sender sent an email with no text content."},
+		{name: "image", b: ExtractedEmail{Attachments: []AttachmentMeta{{Filename: "IMG_0042.jpeg", ContentType: "image/jpeg"}}}, want: "The sender sent an image with no text content."},
+		{name: "images", b: ExtractedEmail{Attachments: []AttachmentMeta{{"a.jpeg", "image/jpeg"}, {"b.pdf", "application/pdf"}, {"c.jpeg", "image/jpeg"}}}, want: "The sender sent 2 images with no text content."},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := noTextNotice(tc.b); got != tc.want {
+				t.Errorf("got=%q want=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQuoteOptionsFromEnv(t *testing.T) {
+	t.Setenv("QUOTE_MIN_LINES", "2")
+	t.Setenv("QUOTE_PATTERNS_EXTRA", `["^Reply from the service desk:", "(?i)^-+ ?reply above this line ?-+$"]`)
+	opts := quoteOptionsFromEnv()
+	if opts.minLines != 2 || opts.replacePatterns || len(opts.patterns) != len(defaultQuotePatterns)+2 {
+		t.Errorf("quoteOptionsFromEnv() = %+v", opts)
+	}
+	if len(defaultQuotePatterns) != 1 {
+		t.Errorf("defaultQuotePatterns changed: %v", defaultQuotePatterns)
+	}
+
+	t.Setenv("QUOTE_PATTERNS_REPLACE", "1")
+	opts = quoteOptionsFromEnv()
+	if !opts.replacePatterns || len(opts.patterns) != 2 {
+		t.Errorf("quoteOptionsFromEnv() with QUOTE_PATTERNS_REPLACE = %+v", opts)
+	}
+}
+
+func TestQuotedTextModeFromEnv(t *testing.T) {
+	tests := []struct {
+		mode, show string
+		want       quotedTextMode
+	}{
+		{"", "", quotedRemove},
+		{"remove", "", quotedRemove},
+		{"collapse", "", quotedCollapse},
+		{"keep", "", quotedKeep},
+		{"", "1", quotedCollapse},
+		{"remove", "1", quotedRemove},
+	}
+	for _, tc := range tests {
+		t.Setenv("QUOTED_TEXT_MODE", tc.mode)
+		t.Setenv("SHOW_QUOTED_TEXT", tc.show)
+		if got := quotedTextModeFromEnv(); got != tc.want {
+			t.Errorf("QUOTED_TEXT_MODE=%q SHOW_QUOTED_TEXT=%q: got %q, want %q", tc.mode, tc.show, got, tc.want)
+		}
+	}
+}
+
+func TestMaxCommentCharsFromEnv(t *testing.T) {
+	for v, want := range map[string]int64{
+		"":      defaultMaxCommentChars,
+		"0":     defaultMaxCommentChars,
+		"200":   defaultMaxCommentChars,
+		"999":   defaultMaxCommentChars,
+		"-5":    defaultMaxCommentChars,
+		"1000":  1000,
+		"20000": 20000,
+	} {
+		t.Run(v, func(t *testing.T) {
+			t.Setenv("MAX_COMMENT_CHARS", v)
+			setupTests(t)
+			if maxCommentChars != want {
+				t.Errorf("MAX_COMMENT_CHARS=%q gives %d, want %d", v, maxCommentChars, want)
+			}
+		})
+	}
+}
+
+func TestRenderComment_InlinedAttachmentsNotListed(t *testing.T) {
+	defer func(b bool) { inlineTextAttachments = b }(inlineTextAttachments)
+	inlineTextAttachments = true
+	raw := "From: Ann <ann@example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=B\r\n\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"Log attached\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1; name=\"error.log\"\r\n" +
+		"Content-Disposition: attachment; filename=\"error.log\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"RmVobGVyOiBHcvbfZSAwDQo=\r\n" +
+		"--B\r\n" +
+		"Content-Type: text/plain; name=\"copy/error.log\"\r\n" +
+		"Content-Disposition: attachment; filename=\"error.log\"\r\n\r\n" +
+		strings.Repeat("x", int(maxInlineTextBytes)+1) + "\r\n" +
+		"--B\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n\r\n" +
+		"%PDF\r\n" +
+		"--B--\r\n"
+	extracted, err := ExtractEmail(context.Background(), mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// as listMessageAttachments lists them
+	atts, err := extractAttachments(mustMessage(t, raw), 10<<20, 25<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var links []attachmentLink
+	for _, a := range atts {
+		links = append(links, attachmentLink{Attachment: a})
+	}
+	comment := renderComment("From: Ann\n\n", extracted.Body, extracted.TextAttachments, links)
+	want := "From: Ann\n\nLog attached\n\n" +
+		"<details>\n<summary>error.log</summary>\n\n```\nFehler: Größe 0\n```\n\n</details>\n\n" +
+		"**Attachments:**\n\n" +
+		"- error.log (" + formatSize(maxInlineTextBytes+1) + ")\n" +
+		"- report.pdf (4 B)"
+	if comment != want {
+		t.Errorf("comment:\n--- got ---\n%s\n--- want ---\n%s", comment, want)
+	}
+}
+
+func TestRenderComment_EscapesMentions(t *testing.T) {
+	defer func(b bool) { keepMentions = b }(keepMentions)
+	keepMentions = false
+	header := commentHeader("@octocat <ann@example.com>", time.Time{})
+	links := []attachmentLink{
+		{Attachment: attachment{Filename: "@octocat notes #42.pdf", Size: 4}},
+		{Attachment: attachment{Filename: "PO #1234.pdf", Size: 4}, URL: "https://files.example.com/a/PO%20%231234.pdf"},
+	}
+	inlined := []textAttachment{{Filename: "ping @octocat #42.log", Text: "@octocat see #42"}}
+	got := renderComment(header, "Hi @octocat, see #42", inlined, links)
+	for _, want := range []string{
+		"Hi @" + zeroWidthJoiner + "octocat, see #" + zeroWidthJoiner + "42",
+		"From: @" + zeroWidthJoiner + "octocat <ann@example.com>",
+		"<summary>ping @" + zeroWidthJoiner + "octocat #" + zeroWidthJoiner + "42.log</summary>",
+		"```\n@octocat see #42\n```",
+		"- @" + zeroWidthJoiner + "octocat notes #" + zeroWidthJoiner + "42.pdf (4 B)",
+		"- [PO #" + zeroWidthJoiner + "1234.pdf](https://files.example.com/a/PO%20%231234.pdf) (4 B)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("comment does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestPostToIssues(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	var posted []string
+	targets := []ticketTarget{{"example/repo", "12"}, {"example/repo", "34"}, {"example/repo", "56"}, {"example/hpc", "78"}}
+	postToIssues(targets, "<m@example.com>", func(t ticketTarget) error {
+		switch t.issue {
+		case "34":
+			return errors.New("github status 500")
+		case "56":
+			return fmt.Errorf("Message-ID: <m@example.com>: %w", errAlreadyPosted)
+		case "78":
+			return errOnlyQuotes
+		}
+		posted = append(posted, t.issue)
+		return nil
+	})
+	if !slices.Equal(posted, []string{"12"}) {
+		t.Errorf("posted to %v", posted)
+	}
+	for _, want := range []string{
+		"<m@example.com> posted to issue example/repo#12",
+		"<m@example.com> failed to post to issue example/repo#34: postIssueComment err=github status 500",
+		"<m@example.com> skipped for issue example/repo#56",
+		"<m@example.com> skipped for issue example/hpc#78, only quotes the previous comment",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
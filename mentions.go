@@ -0,0 +1,61 @@
+// Neutralizes @mentions and #123 issue references that email text would
+// otherwise turn into GitHub notifications and cross-references
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// zeroWidthJoiner is inserted after the @ or # of a reference; GitHub does
+// not link it but the text reads the same
+const zeroWidthJoiner = "‍"
+
+// protectedSpanRe matches inline code and URLs, which are left alone
+var protectedSpanRe = regexp.MustCompile("`+[^`]*`+|https?://[^\\s<>()\"]+|www\\.[^\\s<>()\"]+")
+
+// mentionRe matches a user or team mention; an @ after a word character
+// is part of an email address, which GitHub does not link
+var mentionRe = regexp.MustCompile(`(^|[^\w@./` + "`" + `])@([A-Za-z0-9][A-Za-z0-9-]*(?:/[A-Za-z0-9][\w.-]*)?)`)
+
+// textRefRe matches an issue or pull request reference, including
+// owner/repo#123; &#123; is an HTML character reference
+var textRefRe = regexp.MustCompile(`(^|[^&\w]|[\w.-]+/[\w.-]+)#(\d+)\b`)
+
+// escapeMentions inserts a zero width joiner into the @mentions and issue
+// references in text, outside fenced code blocks, inline code and URLs
+func escapeMentions(text string) string {
+	if keepMentions {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	var st blockState
+	for i, line := range lines {
+		inFence := st.fence != ""
+		st.scan(line)
+		if inFence || st.fence != "" {
+			continue
+		}
+		lines[i] = escapeMentionsLine(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// escapeMentionsLine escapes the references in a line outside its
+// protected spans
+func escapeMentionsLine(line string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range protectedSpanRe.FindAllStringIndex(line, -1) {
+		b.WriteString(escapeRefs(line[last:m[0]]))
+		b.WriteString(line[m[0]:m[1]])
+		last = m[1]
+	}
+	b.WriteString(escapeRefs(line[last:]))
+	return b.String()
+}
+
+func escapeRefs(s string) string {
+	s = mentionRe.ReplaceAllString(s, "${1}@"+zeroWidthJoiner+"${2}")
+	return textRefRe.ReplaceAllString(s, "${1}#"+zeroWidthJoiner+"${2}")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeMentions(t *testing.T) {
+	z := zeroWidthJoiner
+	tests := []struct {
+		name, in, want string
+	}{
+		{"mention", "thanks @octocat", "thanks @" + z + "octocat"},
+		{"team mention", "cc @oxfordrse/rse-team", "cc @" + z + "oxfordrse/rse-team"},
+		{"issue reference", "see #42.", "see #" + z + "42."},
+		{"cross-repo reference", "like octo/repo#7", "like octo/repo#" + z + "7"},
+		{"email address", "mail ann@example.ac.uk", "mail ann@example.ac.uk"},
+		{"inline code", "run `@inline code` and `#42`", "run `@inline code` and `#42`"},
+		{"URL", "https://example.com/@user/page#12", "https://example.com/@user/page#12"},
+		{"character reference", "&#123;", "&#123;"},
+		{"heading", "# 1 Introduction", "# 1 Introduction"},
+		{
+			"fenced code",
+			"```\n@octocat #42\n```\n@octocat",
+			"```\n@octocat #42\n```\n@" + z + "octocat",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeMentions(tt.in); got != tt.want {
+				t.Errorf("escapeMentions(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeMentions_Keep(t *testing.T) {
+	defer func(k bool) { keepMentions = k }(keepMentions)
+	keepMentions = true
+	in := "thanks @octocat, see #42"
+	if got := escapeMentions(in); got != in {
+		t.Errorf("escapeMentions(%q) = %q with KEEP_MENTIONS set", in, got)
+	}
+	if strings.Contains(in, zeroWidthJoiner) {
+		t.Fatal("input already escaped")
+	}
+}
@@ -0,0 +1,143 @@
+// Parses emails, tolerating malformed header blocks
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"regexp"
+)
+
+// maxHeaderBytes limits the size of the header block of an email
+const maxHeaderBytes = 1 << 20
+
+// headerFieldRe matches the start of a valid header field
+var headerFieldRe = regexp.MustCompile(`^[!-9;-~]+:`)
+
+// readMessage parses an email like mail.ReadMessage. If the header block
+// is malformed, it is parsed again leniently: line endings are
+// normalized and lines that are not header fields are dropped. The body
+// is streamed from r, not read into memory.
+func readMessage(r io.Reader) (*mail.Message, error) {
+	br := bufio.NewReader(r)
+	lines, bareCR, err := readHeaderLines(br)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = br
+	if bareCR {
+		body = &bareCRReader{r: br}
+	}
+
+	strict := bytes.Join(lines, []byte("\r\n"))
+	msg, err := mail.ReadMessage(bytes.NewReader(append(strict, "\r\n\r\n"...)))
+	if err == nil {
+		return &mail.Message{Header: msg.Header, Body: body}, nil
+	}
+	log.Printf("malformed header block, parsing leniently: %v", err)
+
+	var clean [][]byte
+	dropping := false
+	for _, line := range lines {
+		if line[0] == ' ' || line[0] == '\t' {
+			// continuation of the previous field
+			if !dropping && len(clean) > 0 {
+				clean = append(clean, line)
+			}
+			continue
+		}
+		if dropping = !headerFieldRe.Match(line); dropping {
+			log.Printf("dropping malformed header line %q", line)
+			continue
+		}
+		clean = append(clean, line)
+	}
+	if len(clean) == 0 {
+		return nil, fmt.Errorf("malformed header block: %w", err)
+	}
+	msg, lerr := mail.ReadMessage(bytes.NewReader(append(bytes.Join(clean, []byte("\r\n")), "\r\n\r\n"...)))
+	if lerr != nil {
+		return nil, fmt.Errorf("malformed header block: %w", lerr)
+	}
+	return &mail.Message{Header: msg.Header, Body: body}, nil
+}
+
+// readHeaderLines reads the header block of an email up to the blank
+// line that ends it, splitting lines on CRLF, LF or a bare CR, and
+// reports whether bare CRs were used
+func readHeaderLines(br *bufio.Reader) (lines [][]byte, bareCR bool, err error) {
+	var line []byte
+	n := 0
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			if len(line) > 0 {
+				lines = append(lines, line)
+			}
+			if len(lines) == 0 {
+				return nil, false, errors.New("empty message")
+			}
+			return lines, bareCR, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if n++; n > maxHeaderBytes {
+			return nil, false, fmt.Errorf("header block larger than %d bytes", maxHeaderBytes)
+		}
+		if c != '\r' && c != '\n' {
+			line = append(line, c)
+			continue
+		}
+		if c == '\r' {
+			if next, err := br.Peek(1); err == nil && next[0] == '\n' {
+				br.ReadByte()
+			} else {
+				bareCR = true
+			}
+		}
+		if len(line) == 0 {
+			return lines, bareCR, nil
+		}
+		lines = append(lines, line)
+		line = nil
+	}
+}
+
+// bareCRReader converts bare CR line endings to CRLF
+type bareCRReader struct {
+	r      *bufio.Reader
+	chunk  [4096]byte
+	buf    []byte
+	err    error
+	lastCR bool
+}
+
+func (b *bareCRReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			if b.lastCR {
+				b.lastCR = false
+				b.buf = []byte("\n")
+				break
+			}
+			return 0, b.err
+		}
+		n, err := b.r.Read(b.chunk[:])
+		b.err = err
+		for _, c := range b.chunk[:n] {
+			if b.lastCR && c != '\n' {
+				b.buf = append(b.buf, '\n')
+			}
+			b.buf = append(b.buf, c)
+			b.lastCR = c == '\r'
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
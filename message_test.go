@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantFrom string
+		wantSubj string
+		wantBody string
+	}{
+		{
+			name:     "well formed",
+			raw:      "From: a@example.com\r\nSubject: Hello\r\n\r\nBody\r\n",
+			wantFrom: "a@example.com",
+			wantSubj: "Hello",
+			wantBody: "Body\r\n",
+		},
+		{
+			name: "line without colon",
+			raw: "From: a@example.com\r\nX-Broken-Relay-Stamp\r\n   continued\r\n" +
+				"Subject: Hello\r\n  world\r\n\r\nBody\r\n",
+			wantFrom: "a@example.com",
+			wantSubj: "Hello world",
+			wantBody: "Body\r\n",
+		},
+		{
+			name:     "mbox From line",
+			raw:      "From a@example.com Mon Mar  3 09:12:00 2025\nFrom: a@example.com\nSubject: Hello\n\nBody\n",
+			wantFrom: "a@example.com",
+			wantSubj: "Hello",
+			wantBody: "Body\n",
+		},
+		{
+			name:     "CR-only line endings",
+			raw:      "From: a@example.com\rSubject: Hello\r\rLine 1\rLine 2\r",
+			wantFrom: "a@example.com",
+			wantSubj: "Hello",
+			wantBody: "Line 1\r\nLine 2\r\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := readMessage(strings.NewReader(tc.raw))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := msg.Header.Get("From"); got != tc.wantFrom {
+				t.Errorf("From: got=%q want=%q", got, tc.wantFrom)
+			}
+			if got := msg.Header.Get("Subject"); got != tc.wantSubj {
+				t.Errorf("Subject: got=%q want=%q", got, tc.wantSubj)
+			}
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if string(body) != tc.wantBody {
+				t.Errorf("body: got=%q want=%q", body, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestReadMessage_Unparseable(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{name: "empty", raw: "", wantErr: "empty message"},
+		{name: "no header fields", raw: "this is not\r\nan email\r\n\r\nbody\r\n", wantErr: "malformed header block"},
+		{name: "header too large", raw: "X-Junk: " + strings.Repeat("a", maxHeaderBytes), wantErr: "header block larger than"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := readMessage(strings.NewReader(tc.raw))
+			if err == nil {
+				t.Fatalf("expected an error, got message with header %v", msg.Header)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %q does not mention %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Recognizes the lines mail clients write before the message a reply
+// quotes, in the languages of their users. A language is added with a line
+// in the tables below.
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// langPattern is a regular expression for a language, or a few languages
+// separated by commas
+type langPattern struct{ lang, pattern string }
+
+// replyLines are the "On ... wrote:" lines of Gmail, Apple Mail and
+// Thunderbird, by language, matched against the whole line
+var replyLines = []langPattern{
+	{"en", `On .+ wrote:`},
+	{"fr", `Le .+ a écrit[ \x{a0}\x{202f}]?:`},
+	{"de", `Am .+ schrieb .+:`},
+	{"es", `El .+ escribió:`},
+	{"pt", `(?:Em|No dia) .+ escreveu:`},
+	{"it", `Il .+ ha scritto:`},
+	{"nl", `Op .+ (?:schreef .+|het volgende geschreven):`},
+	{"sv", `Den .+ skrev .+:`},
+	// Danish and Norwegian Gmail start with the date
+	{"da,nb", `(?:Den )?.+ kl\.? \d{1,2}[:.]\d{2},? skrev .+:`},
+}
+
+// outlookHeaderLabels are the labels of the From, Sent (or Date), To and
+// Subject lines of the header block Outlook writes before a quoted
+// message, by language
+var outlookHeaderLabels = []struct{ lang, from, sent, to, subject string }{
+	{"en", `From`, `Sent|Date`, `To`, `Subject`},
+	{"de", `Von`, `Gesendet|Datum`, `An`, `Betreff`},
+	{"fr", `De`, `Envoyé|Date`, `À`, `Objet`},
+	{"es", `De`, `Enviado(?: el)?|Fecha`, `Para`, `Asunto`},
+	{"pt", `De`, `Enviado|Data`, `Para`, `Assunto`},
+	{"it", `Da`, `Inviato|Data`, `A`, `Oggetto`},
+	{"nl", `Van`, `Verzonden|Datum`, `Aan`, `Onderwerp`},
+	{"sv", `Från`, `Skickat|Datum`, `Till`, `Ämne`},
+	{"da,nb", `Fra`, `Sendt|Dato`, `Til`, `Emne`},
+}
+
+// minHeaderLabels of the labels of a language within headerWindow
+// non-blank lines make an Outlook header block, so that a message that
+// starts "Subject: ..." is not taken for one
+const (
+	minHeaderLabels = 2
+	headerWindow    = 4
+)
+
+// originalMessageLabels are Outlook's "-----Original Message-----" by
+// language. Some clients draw the rules around them with underscores.
+var originalMessageLabels = []langPattern{
+	{"en", `Original Message`},
+	{"de", `Ursprüngliche Nachricht`},
+	{"fr", `Message d['’]origine`},
+	{"es", `Mensaje original`},
+	{"pt", `Mensagem original`},
+	{"it", `Messaggio originale`},
+	{"nl", `Oorspronkelijk bericht`},
+	{"sv", `Originalmeddelande`},
+	{"da", `Oprindelig meddelelse`},
+	{"nb", `Opprinnelig melding`},
+	{"pl", `Oryginalna wiadomość|Wiadomość oryginalna`},
+	{"cs", `Původní zpráva`},
+	{"fi", `Alkuperäinen viesti`},
+	{"hu", `Eredeti üzenet`},
+	{"ru", `Исходное сообщение`},
+}
+
+// separatorRule matches the rule of hyphens or underscores around an
+// Original Message label, which are escaped in text converted from HTML
+const separatorRule = `(?:(?:\\?-)+|(?:\\?_)+)`
+
+// forwardLabels are the "---------- Forwarded message ---------" labels of
+// Gmail and Thunderbird and the "Begin forwarded message:" lines of Apple
+// Mail, by language
+var forwardLabels = []langPattern{
+	{"en", `-+ ?Forwarded message ?-+|Begin forwarded message:`},
+	{"fr", `-+ ?Message transféré ?-+|Début du message réexpédié[ \x{a0}\x{202f}]?:`},
+	{"de", `-+ ?Weitergeleitete Nachricht ?-+|Anfang der weitergeleiteten Nachricht:`},
+	{"es", `-+ ?Mensaje reenviado ?-+|Inicio del mensaje reenviado:`},
+	{"pt", `-+ ?Mensagem encaminhada ?-+|Início da mensagem reencaminhada:`},
+	{"it", `-+ ?Messaggio inoltrato ?-+|Inizio messaggio inoltrato:`},
+	{"nl", `-+ ?Doorgestuurd bericht ?-+|Begin doorgestuurd bericht:`},
+}
+
+// forwardWindow is the number of non-blank lines a forward label must be
+// within for the forwarded message to be the point of the email, which
+// leaves room for a short covering note
+const forwardWindow = 3
+
+// headerSpace matches the spaces around a header label's colon, which
+// French puts a no-break space before
+const headerSpace = `[\s\x{a0}\x{202f}]*`
+
+var (
+	replyLineRe       = regexp.MustCompile(`(?i)^(?:` + alternation(replyLines) + `)$`)
+	originalMessageRe = regexp.MustCompile(`(?i)^` + separatorRule + ` ?(?:` + alternation(originalMessageLabels) + `) ?` + separatorRule)
+	outlookHeaderRes  = compileHeaderLabels()
+	forwardRe         = regexp.MustCompile(`(?i)^\\?(?:` + alternation(forwardLabels) + `)$`)
+)
+
+// forwardStart returns the line of the forward label of an email that
+// forwards a message, with at most a short note before it, or -1. The
+// quoted part of the email starts at split, so that a reply quoting a
+// forward is not taken for one.
+func forwardStart(lines []string, split int) int {
+	for i, window := 0, 0; i < len(lines) && i <= split && window < forwardWindow; i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || quoteMarkersRe.MatchString(line) {
+			continue
+		}
+		window++
+		if i == split {
+			// the quote the HTML converter made of a forward
+			line = strings.TrimSpace(strings.TrimPrefix(line, ">"))
+		}
+		if forwardRe.MatchString(strings.Trim(line, "*_")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// alternation joins the patterns of a table into one alternation
+func alternation(table []langPattern) string {
+	alts := make([]string, len(table))
+	for i, l := range table {
+		alts[i] = l.pattern
+	}
+	return strings.Join(alts, "|")
+}
+
+// headerLabelRes match the From, Sent, To and Subject lines of one
+// language
+type headerLabelRes [4]*regexp.Regexp
+
+func compileHeaderLabels() []headerLabelRes {
+	res := make([]headerLabelRes, len(outlookHeaderLabels))
+	for i, l := range outlookHeaderLabels {
+		for k, label := range []string{l.from, l.sent, l.to, l.subject} {
+			// the labels are bold in headers converted from HTML
+			res[i][k] = regexp.MustCompile(`(?i)^\**(?:` + label + `)` + headerSpace + `:`)
+		}
+	}
+	return res
+}
+
+// label returns which of the From, Sent, To and Subject labels line
+// starts with, or -1. A From line must hold an address.
+func (res headerLabelRes) label(line string) int {
+	for k, re := range res {
+		if re.MatchString(line) && (k != 0 || strings.Contains(line, "@")) {
+			return k
+		}
+	}
+	return -1
+}
+
+// isHeaderLine reports whether line is a line of an Outlook header block,
+// in any language, or its Cc line
+func isHeaderLine(line string) bool {
+	if ccLineRe.MatchString(line) {
+		return true
+	}
+	for _, res := range outlookHeaderRes {
+		for _, re := range res {
+			if re.MatchString(line) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ccLineRe matches the Cc line of a header block
+var ccLineRe = regexp.MustCompile(`(?i)^\**(?:Cc)` + headerSpace + `:`)
+
+// wrappedHeaderGap is the number of non-blank lines after a wrapped
+// "On ... wrote:" line within which quoted text must start
+const wrappedHeaderGap = 3
+
+// quoteFollows reports whether a line quoted with ">" starts within
+// wrappedHeaderGap non-blank lines from lines[i]
+func quoteFollows(lines []string, i int) bool {
+	for seen := 0; i < len(lines) && seen < wrappedHeaderGap; i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		if isQuotedLine(lines[i]) {
+			return true
+		}
+		seen++
+	}
+	return false
+}
+
+// isReplyHeader reports whether lines[i] starts the header of a quoted
+// message: an "On ... wrote:" line, which Gmail may wrap onto the next
+// line, an Original Message separator, or an Outlook header block
+func isReplyHeader(lines []string, i int) bool {
+	line := strings.TrimSpace(lines[i])
+	if replyLineRe.MatchString(line) || originalMessageRe.MatchString(line) {
+		return true
+	}
+	if i+1 < len(lines) {
+		// a long name or date wraps the line; as two lines are more
+		// likely to match by chance, quoted text must follow
+		next := strings.TrimSpace(lines[i+1])
+		if next != "" && replyLineRe.MatchString(line+" "+next) && quoteFollows(lines, i+2) {
+			return true
+		}
+	}
+	for _, res := range outlookHeaderRes {
+		// a From line without an address does not count, but still
+		// starts the block
+		if res.label(line) < 0 && !res[0].MatchString(line) {
+			continue
+		}
+		var seen [4]bool
+		found := 0
+		for j, window := i, 0; j < len(lines) && window < headerWindow; j++ {
+			l := strings.TrimSpace(lines[j])
+			if l == "" {
+				continue
+			}
+			window++
+			if k := res.label(l); k >= 0 && !seen[k] {
+				seen[k] = true
+				found++
+			}
+		}
+		if found >= minHeaderLabels {
+			return true
+		}
+	}
+	return false
+}
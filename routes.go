@@ -0,0 +1,114 @@
+// Routes the emails of a dispatcher shared by several projects to the
+// repository of their ticket address, by the ROUTES table
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ticketTarget is the issue of a repository an email is posted to
+type ticketTarget struct {
+	repo  string // owner/repo
+	issue string
+}
+
+func (t ticketTarget) String() string {
+	return t.repo + "#" + t.issue
+}
+
+// same reports whether t and o are the same issue, e.g. hpc#0042 and hpc#42
+func (t ticketTarget) same(o ticketTarget) bool {
+	return strings.EqualFold(t.repo, o.repo) && sameIssue(t.issue, o.issue)
+}
+
+// errUnknownRoute is returned for a routed ticket address whose route is
+// not in ROUTES
+var errUnknownRoute = errors.New("unknown route")
+
+// routeNameRe matches the names of routes
+var routeNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.]*$`)
+
+// routedLocalRe matches the local part of a ticket address routed by its
+// prefix, hpc-123
+var routedLocalRe = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9_.]*)-(\d+)$`)
+
+// parseRoutes parses ROUTES, a JSON object from the names of routes to the
+// owner/repo of their repositories, e.g. {"hpc": "org/hpc-support"}
+func parseRoutes(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	routes := make(map[string]string, len(raw))
+	for name, repo := range raw {
+		name = strings.ToLower(name)
+		if !routeNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid route name %q", name)
+		}
+		if owner, r, ok := strings.Cut(repo, "/"); !ok || owner == "" || r == "" || strings.Contains(r, "/") {
+			return nil, fmt.Errorf("route %q: %q is not owner/repo", name, repo)
+		}
+		routes[name] = repo
+	}
+	return routes, nil
+}
+
+// extractTarget returns the repository and issue of a ticket address:
+// GITHUB_PROJECT for 123@issues.example.com (or a TICKET_ADDRESS_PREFIX
+// address), and the repository of the route hpc for hpc-123@issues.example.com
+// and 123@hpc.issues.example.com. An address that is not a ticket address
+// has no target; one whose route is not in ROUTES returns errUnknownRoute.
+// Domains and route names are matched whatever their case.
+func extractTarget(local, domain string) (ticketTarget, error) {
+	if issue := issueFromAddress(local, domain); issue != "" {
+		return ticketTarget{githubProject, issue}, nil
+	}
+	domain, base := strings.ToLower(domain), strings.ToLower(ticketDomain)
+	name, issue := "", ""
+	if sub, ok := strings.CutSuffix(domain, "."+base); ok && base != "" {
+		if issue = issueFromAddress(local, ticketDomain); issue == "" {
+			return ticketTarget{}, nil
+		}
+		name = sub
+	} else if m := routedLocalRe.FindStringSubmatch(local); m != nil && domain == base {
+		name, issue = strings.ToLower(m[1]), m[2]
+	} else {
+		return ticketTarget{}, nil
+	}
+	repo, ok := routes[name]
+	if !ok {
+		return ticketTarget{}, fmt.Errorf("%w %q, ROUTES has %s", errUnknownRoute, name, routeNames())
+	}
+	return ticketTarget{repo, issue}, nil
+}
+
+// routeNames lists the names of the routes, for logs
+func routeNames() string {
+	if len(routes) == 0 {
+		return "no routes"
+	}
+	return strings.Join(slices.Sorted(maps.Keys(routes)), ", ")
+}
+
+// routedRepo returns the repository of the routes, or GITHUB_PROJECT, that
+// is repo, whatever its case, or ""
+func routedRepo(repo string) string {
+	if strings.EqualFold(repo, githubProject) {
+		return githubProject
+	}
+	for _, r := range routes {
+		if strings.EqualFold(repo, r) {
+			return r
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func setupRoutes(t *testing.T) {
+	t.Setenv("ROUTES", `{"hpc": "example/hpc-support", "RSE": "example/rse"}`)
+	setupTests(t)
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes(`{"hpc": "example/hpc-support", "RSE": "example/rse"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routes) != 2 || routes["hpc"] != "example/hpc-support" || routes["rse"] != "example/rse" {
+		t.Errorf("parseRoutes = %v", routes)
+	}
+	for _, s := range []string{
+		`["hpc"]`,
+		`{"hpc": "hpc-support"}`,
+		`{"hpc": "example/hpc/support"}`,
+		`{"hpc-1": "example/hpc"}`,
+		`{"": "example/hpc"}`,
+	} {
+		if _, err := parseRoutes(s); err == nil {
+			t.Errorf("parseRoutes(%s) did not fail", s)
+		}
+	}
+}
+
+func TestExtractTarget(t *testing.T) {
+	setupRoutes(t)
+	tests := []struct {
+		name, address string
+		want          ticketTarget
+	}{
+		{"default route", "123@issues.example.com", ticketTarget{"example/repo", "123"}},
+		{"prefix", "hpc-123@issues.example.com", ticketTarget{"example/hpc-support", "123"}},
+		{"prefix case", "RSE-0042@issues.example.com", ticketTarget{"example/rse", "0042"}},
+		{"subdomain", "45@hpc.issues.example.com", ticketTarget{"example/hpc-support", "45"}},
+		{"subdomain case", "45@rse.issues.example.com", ticketTarget{"example/rse", "45"}},
+		{"mixed case prefix and domain", "HPC-123@Issues.Example.com", ticketTarget{"example/hpc-support", "123"}},
+		{"mixed case subdomain", "45@HPC.issues.EXAMPLE.com", ticketTarget{"example/hpc-support", "45"}},
+		{"prefix at another domain", "hpc-123@example.com", ticketTarget{}},
+		{"not a ticket address", "hpc-team@issues.example.com", ticketTarget{}},
+		{"person at a subdomain", "ann@hpc.issues.example.com", ticketTarget{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			local, domain, _ := strings.Cut(tc.address, "@")
+			got, err := extractTarget(local, domain)
+			if err != nil || got != tc.want {
+				t.Errorf("extractTarget(%q) = %v, %v; want %v", tc.address, got, err, tc.want)
+			}
+		})
+	}
+
+	for _, address := range []string{"gpu-123@issues.example.com", "45@gpu.issues.example.com"} {
+		t.Run("unknown route "+address, func(t *testing.T) {
+			local, domain, _ := strings.Cut(address, "@")
+			if _, err := extractTarget(local, domain); !errors.Is(err, errUnknownRoute) || !strings.Contains(err.Error(), `"gpu"`) {
+				t.Errorf("extractTarget(%q) err = %v, want unknown route \"gpu\"", address, err)
+			}
+		})
+	}
+}
+
+func TestExtractTargets_Routes(t *testing.T) {
+	setupRoutes(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	got := extractTargets("12@issues.example.com, hpc-12@issues.example.com, gpu-7@issues.example.com", "12@hpc.issues.example.com")
+	want := []ticketTarget{{"example/repo", "12"}, {"example/hpc-support", "12"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("extractTargets = %v, want %v", got, want)
+	}
+	if !strings.Contains(buf.String(), `ignoring ticket address gpu-7@issues.example.com: unknown route "gpu", ROUTES has hpc, rse`) {
+		t.Errorf("unknown route not logged:\n%s", buf.String())
+	}
+}
+
+func TestFindTargets_Routes(t *testing.T) {
+	setupRoutes(t)
+	tests := []struct {
+		name, header string
+		want         string
+		source       string
+	}{
+		{"envelope", "To: Ann <ann@example.com>\r\nDelivered-To: 9@hpc.issues.example.com\r\n", "example/hpc-support#9", "envelope recipient"},
+		{"subject", "To: Ann <ann@example.com>\r\nSubject: Re: Quota (#45)\r\n", "example/repo#45", "subject"},
+		{"routed notification", "To: Ann <ann@example.com>\r\nIn-Reply-To: <Example/RSE/issues/7@github.com>\r\n", "example/rse#7", "GitHub notification replied to"},
+		{"unknown route only", "To: gpu-7@issues.example.com\r\n", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := mustMessage(t, tc.header+"\r\nbody\r\n")
+			targets, source := findTargets(msg.Header)
+			got := ""
+			if len(targets) > 0 {
+				got = targets[0].String()
+			}
+			if got != tc.want || source != tc.source {
+				t.Errorf("findTargets = %v, %q; want %s, %q", targets, source, tc.want, tc.source)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+// Converts RTF bodies, as sent by Outlook, to markdown
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/net/html/charset"
+)
+
+// rtfSkipDestinations are groups whose content is not body text
+var rtfSkipDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true,
+	"pict": true, "object": true, "objdata": true, "nonshppict": true,
+	"shp": true, "fldinst": true, "header": true, "headerl": true,
+	"headerr": true, "headerf": true, "footer": true, "footerl": true,
+	"footerr": true, "footerf": true, "footnote": true, "listtable": true,
+	"listoverridetable": true, "revtbl": true, "rsidtbl": true,
+	"themedata": true, "colorschememapping": true, "latentstyles": true,
+	"datastore": true, "xmlnstbl": true, "filetbl": true, "generator": true,
+	"pgdsctbl": true, "mmathPr": true, "bkmkstart": true, "bkmkend": true,
+}
+
+// rtfState is the formatting state of an RTF group
+type rtfState struct {
+	skip    bool // inside an ignored destination
+	bold    bool
+	italic  bool
+	uc      int  // characters to skip after \uN
+	listPfx bool // inside \listtext or \pntext
+	htmlTag bool // inside \*\htmltag of HTML-encapsulated RTF
+	htmlRTF bool // inside \htmlrtf, RTF-only content of encapsulated HTML
+}
+
+// rtfConverter accumulates the output of rtfToPlain
+type rtfConverter struct {
+	out      []byte
+	list     strings.Builder // text of the current list prefix group
+	pending  []byte          // \'hh bytes awaiting charset decoding
+	codepage string
+	fromHTML bool
+	st       rtfState
+	emitted  rtfState // emphasis currently open in the output
+	skipN    int      // fallback characters left to skip after \uN
+	high     rune     // pending UTF-16 high surrogate
+}
+
+// rtfToPlain converts an RTF document to plain text with markdown for
+// bold, italic and lists. Unknown control words are dropped and embedded
+// objects and pictures skipped. RTF that encapsulates HTML (\fromhtml1,
+// as produced by Outlook) is converted via htmlToPlain.
+func rtfToPlain(src string) (string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(src), `{\rtf`) {
+		return "", errors.New("not an RTF document")
+	}
+	c := &rtfConverter{codepage: "windows-1252", st: rtfState{uc: 1}}
+	var stack []rtfState
+
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+		switch ch {
+		case '{':
+			c.flush()
+			stack = append(stack, c.st)
+		case '}':
+			c.flush()
+			if len(stack) == 0 {
+				continue
+			}
+			if c.st.listPfx && !c.fromHTML {
+				c.writeListPrefix()
+			}
+			c.st = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case '\\':
+			if i+1 >= len(src) {
+				continue
+			}
+			next := src[i+1]
+			switch {
+			case isASCIILetter(next):
+				j := i + 1
+				for j < len(src) && isASCIILetter(src[j]) {
+					j++
+				}
+				word := src[i+1 : j]
+				k := j
+				if k < len(src) && src[k] == '-' {
+					k++
+				}
+				for k < len(src) && src[k] >= '0' && src[k] <= '9' {
+					k++
+				}
+				param, hasParam := 0, k > j
+				if hasParam {
+					param, _ = strconv.Atoi(src[j:k])
+				}
+				if k < len(src) && src[k] == ' ' {
+					k++
+				}
+				i = k - 1
+				c.controlWord(word, param, hasParam)
+			case next == '\'':
+				if i+3 < len(src) {
+					if b, err := strconv.ParseUint(src[i+2:i+4], 16, 8); err == nil {
+						if c.skipN > 0 {
+							c.skipN--
+						} else if c.visible() {
+							c.pending = append(c.pending, byte(b))
+						}
+					}
+				}
+				i += 3
+			case next == '*':
+				// ignorable destination, unless it is an HTML tag we keep
+				i++
+				if c.fromHTML && strings.HasPrefix(src[i+1:], `\htmltag`) {
+					c.st.htmlTag = true
+					c.st.htmlRTF = false
+				} else {
+					c.st.skip = true
+				}
+			case next == '~':
+				i++
+				c.text(" ")
+			case next == '_':
+				i++
+				c.text("-")
+			case next == '-':
+				i++
+			case next == '\n' || next == '\r':
+				i++
+				c.controlWord("par", 0, false)
+			default:
+				// escaped \ { }
+				i++
+				c.text(string(next))
+			}
+		case '\r', '\n':
+			// line breaks in the source are not significant
+		default:
+			c.text(string(ch))
+		}
+	}
+	c.flush()
+	c.closeEmphasis()
+
+	out := string(c.out)
+	if c.fromHTML {
+		return ConvertHTML(out, htmlOptions)
+	}
+	lines := strings.Split(out, "\n")
+	for i, ln := range lines {
+		lines[i] = strings.TrimRight(ln, " \t")
+	}
+	return normalizeBlankLines(strings.TrimSpace(strings.Join(lines, "\n"))), nil
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// visible reports whether text in the current group is part of the output
+func (c *rtfConverter) visible() bool {
+	if c.st.skip {
+		return false
+	}
+	if c.fromHTML {
+		return c.st.htmlTag || !c.st.htmlRTF
+	}
+	return true
+}
+
+// controlWord applies an RTF control word
+func (c *rtfConverter) controlWord(word string, param int, hasParam bool) {
+	if c.st.skip {
+		return
+	}
+	if rtfSkipDestinations[word] {
+		c.flush()
+		c.st.skip = true
+		return
+	}
+	on := !hasParam || param != 0
+	switch word {
+	case "ansicpg":
+		c.codepage = "windows-" + strconv.Itoa(param)
+	case "fromhtml":
+		c.fromHTML = true
+	case "htmlrtf":
+		c.flush()
+		c.st.htmlRTF = on
+	case "htmltag":
+		// the tag content follows as text
+	case "uc":
+		c.st.uc = param
+	case "u":
+		if param < 0 {
+			param += 65536
+		}
+		c.unicode(rune(param))
+		c.skipN = c.st.uc
+	case "par", "line":
+		if c.fromHTML && !c.st.htmlTag {
+			// paragraph breaks are given by the HTML tags
+			return
+		}
+		c.flush()
+		if !c.fromHTML {
+			c.closeEmphasis()
+		}
+		c.raw("\n")
+	case "tab":
+		c.text("\t")
+	case "b":
+		c.flush()
+		c.st.bold = on
+	case "i":
+		c.flush()
+		c.st.italic = on
+	case "plain":
+		c.flush()
+		c.st.bold, c.st.italic = false, false
+	case "listtext", "pntext":
+		c.flush()
+		c.st.listPfx = true
+		c.list.Reset()
+	case "emdash":
+		c.text("—")
+	case "endash":
+		c.text("–")
+	case "bullet":
+		c.text("•")
+	case "lquote":
+		c.text("‘")
+	case "rquote":
+		c.text("’")
+	case "ldblquote":
+		c.text("“")
+	case "rdblquote":
+		c.text("”")
+	}
+}
+
+// unicode writes a \uN character, pairing UTF-16 surrogates
+func (c *rtfConverter) unicode(r rune) {
+	c.flush()
+	if utf16.IsSurrogate(r) {
+		if c.high == 0 {
+			c.high = r
+			return
+		}
+		r = utf16.DecodeRune(c.high, r)
+	}
+	c.high = 0
+	c.text(string(r))
+}
+
+// text writes visible document text, skipping \uN fallback characters
+func (c *rtfConverter) text(s string) {
+	if c.skipN > 0 {
+		c.skipN--
+		return
+	}
+	if !c.visible() {
+		return
+	}
+	c.flush()
+	if c.fromHTML && !c.st.htmlTag {
+		s = html.EscapeString(s)
+	}
+	c.raw(s)
+}
+
+// raw writes to the output, or to the list prefix when inside one
+func (c *rtfConverter) raw(s string) {
+	if c.st.skip {
+		return
+	}
+	if c.st.listPfx {
+		c.list.WriteString(s)
+		return
+	}
+	if !c.fromHTML && strings.TrimSpace(s) != "" {
+		c.openEmphasis()
+	}
+	c.out = append(c.out, s...)
+}
+
+// flush decodes pending \'hh bytes using the document codepage
+func (c *rtfConverter) flush() {
+	if len(c.pending) == 0 {
+		return
+	}
+	b := c.pending
+	c.pending = nil
+	s := string(b)
+	if enc, _ := charset.Lookup(c.codepage); enc != nil {
+		if d, err := enc.NewDecoder().Bytes(b); err == nil {
+			s = string(d)
+		}
+	}
+	if c.fromHTML && !c.st.htmlTag {
+		s = html.EscapeString(s)
+	}
+	c.raw(s)
+}
+
+// openEmphasis writes markers for bold/italic that are on in the current
+// group but not yet open in the output
+func (c *rtfConverter) openEmphasis() {
+	if c.emitted.bold == c.st.bold && c.emitted.italic == c.st.italic {
+		return
+	}
+	c.closeEmphasis()
+	if c.st.bold {
+		c.out = append(c.out, "**"...)
+	}
+	if c.st.italic {
+		c.out = append(c.out, '*')
+	}
+	c.emitted.bold, c.emitted.italic = c.st.bold, c.st.italic
+}
+
+// closeEmphasis closes any open bold/italic markers, keeping trailing
+// whitespace outside them so that markdown recognizes the closing marker
+func (c *rtfConverter) closeEmphasis() {
+	if !c.emitted.bold && !c.emitted.italic {
+		return
+	}
+	n := len(c.out)
+	for n > 0 && (c.out[n-1] == ' ' || c.out[n-1] == '\t') {
+		n--
+	}
+	trailing := string(c.out[n:])
+	c.out = c.out[:n]
+	if c.emitted.italic {
+		c.out = append(c.out, '*')
+	}
+	if c.emitted.bold {
+		c.out = append(c.out, "**"...)
+	}
+	c.out = append(c.out, trailing...)
+	c.emitted.bold, c.emitted.italic = false, false
+}
+
+// writeListPrefix replaces a \listtext or \pntext group, which holds the
+// rendered bullet or number of a list item, with a markdown list marker
+func (c *rtfConverter) writeListPrefix() {
+	p := strings.TrimSpace(c.list.String())
+	c.list.Reset()
+	c.st.listPfx = false
+	num := strings.TrimRight(p, ".)")
+	if _, err := strconv.Atoi(num); err == nil {
+		c.out = append(c.out, num+". "...)
+		return
+	}
+	c.out = append(c.out, "- "...)
+}
+
+// decompressRTF decompresses the LZFu compressed RTF (PR_RTF_COMPRESSED)
+// found in TNEF streams
+func decompressRTF(b []byte) ([]byte, error) {
+	const (
+		magicCompressed   = 0x75465a4c // "LZFu"
+		magicUncompressed = 0x414c454d // "MELA"
+		prebuf            = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman " +
+			"\\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier" +
+			"{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+	)
+	if len(b) < 16 {
+		return nil, errors.New("compressed RTF too short")
+	}
+	rawSize := binary.LittleEndian.Uint32(b[4:])
+	magic := binary.LittleEndian.Uint32(b[8:])
+	data := b[16:]
+	switch magic {
+	case magicUncompressed:
+		if uint64(rawSize) > uint64(len(data)) {
+			return nil, errors.New("compressed RTF truncated")
+		}
+		return data[:rawSize], nil
+	case magicCompressed:
+	default:
+		return nil, errors.New("unknown compressed RTF format")
+	}
+
+	var dict [4096]byte
+	copy(dict[:], prebuf)
+	wpos := len(prebuf)
+	out := make([]byte, 0, rawSize)
+	for i := 0; i < len(data); {
+		flags := data[i]
+		i++
+		for bit := 0; bit < 8 && i < len(data); bit++ {
+			if flags&(1<<bit) == 0 {
+				out = append(out, data[i])
+				dict[wpos] = data[i]
+				wpos = (wpos + 1) % len(dict)
+				i++
+				continue
+			}
+			if i+1 >= len(data) {
+				return nil, errors.New("compressed RTF truncated")
+			}
+			ref := int(data[i])<<8 | int(data[i+1])
+			i += 2
+			offset, length := ref>>4, ref&0xf+2
+			if offset == wpos {
+				return out, nil
+			}
+			for n := 0; n < length; n++ {
+				c := dict[(offset+n)%len(dict)]
+				out = append(out, c)
+				dict[wpos] = c
+				wpos = (wpos + 1) % len(dict)
+			}
+		}
+	}
+	return out, nil
+}
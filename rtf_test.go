@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// outlookRTF is a simple body as written by Outlook/Word
+const outlookRTF = `{\rtf1\ansi\ansicpg1252\deff0\nouicompat\deflang2057{\fonttbl{\f0\fswiss\fcharset0 Calibri;}{\f1\fnil\fcharset2 Symbol;}}
+{\colortbl ;\red0\green0\blue255;}
+{\*\generator Riched20 10.0.19041}\viewkind4\uc1
+\pard\sa200\sl276\slmult1\f0\fs22\lang9 Hi team,\par
+The job on node \b gpu-07\b0  failed with \i out of memory\i0  errors.\par
+{\pntext\f1\'B7\tab}{\*\pn\pnlvlblt\pnf1\pnindent0{\pntxtb\'B7}}\fi-360\li720 Checked the logs\par
+{\pntext\f1\'B7\tab}Restarted the scheduler\par
+{\pntext\f0 1.\tab}First numbered\par
+\pard\sa200\sl276\slmult1 Caf\'e9 \u8364? and \u-10179?\u-8704? done\par
+{\*\shppict{\pict\pngblip 89504e470d0a1a0a}}Thanks\par
+}`
+
+func TestRtfToPlain(t *testing.T) {
+	got, err := rtfToPlain(outlookRTF)
+	if err != nil {
+		t.Fatalf("rtfToPlain returned error: %v", err)
+	}
+	want := "Hi team,\n" +
+		"The job on node **gpu-07** failed with *out of memory* errors.\n" +
+		"- Checked the logs\n" +
+		"- Restarted the scheduler\n" +
+		"1. First numbered\n" +
+		"Café € and 😀 done\n" +
+		"Thanks"
+	if got != want {
+		t.Errorf("rtfToPlain mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, want)
+	}
+}
+
+func TestRtfToPlain_FromHTML(t *testing.T) {
+	src := `{\rtf1\ansi\ansicpg1252\fromhtml1 \deff0{\fonttbl{\f0\fswiss Arial;}}
+{\*\htmltag19 <html>}{\*\htmltag50 <body>}\htmlrtf {\htmlrtf0
+{\*\htmltag64 <p>}\htmlrtf {\htmlrtf0 Hello \htmlrtf\par\htmlrtf0
+{\*\htmltag84 <b>}\htmlrtf {\b \htmlrtf0 world{\*\htmltag92 </b>}\htmlrtf }\htmlrtf0
+{\*\htmltag72 </p>}\htmlrtf }\htmlrtf0
+{\*\htmltag58 </body>}{\*\htmltag27 </html>}\htmlrtf }\htmlrtf0 }`
+	got, err := rtfToPlain(src)
+	if err != nil {
+		t.Fatalf("rtfToPlain returned error: %v", err)
+	}
+	if got != "Hello **world**" {
+		t.Errorf("rtfToPlain mismatch: got=%q", got)
+	}
+}
+
+func TestDecompressRTF(t *testing.T) {
+	// example from [MS-OXRTFCP] section 4.1
+	compressed, _ := hex.DecodeString("2d0000002b0000004c5a4675f1c5c7a703000a007263706731323542320af32068656c090020627705b06c647d0a800fa0")
+	got, err := decompressRTF(compressed)
+	if err != nil {
+		t.Fatalf("decompressRTF returned error: %v", err)
+	}
+	want := "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n"
+	if string(got) != want {
+		t.Errorf("decompressRTF mismatch:\n--- got ---\n%q\n--- want ---\n%q\n", got, want)
+	}
+}
+
+func TestExtractBodyAsMarkdown_RTFOnly(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=RTF\r\n\r\n" +
+		"--RTF\r\n" +
+		"Content-Type: application/rtf\r\n\r\n" +
+		`{\rtf1\ansi Please {\b restart} the VM\par}` + "\r\n" +
+		"--RTF--\r\n"
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "Please **restart** the VM" {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
@@ -0,0 +1,276 @@
+// Decodes TNEF (winmail.dat) attachments sent by Outlook and Exchange,
+// which can contain the real body and attachments of a message
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/net/html/charset"
+)
+
+const tnefSignature = 0x223e9f78
+
+// TNEF attribute IDs (low 16 bits, the high bits hold the type)
+const (
+	attBody           = 0x800c
+	attAttachData     = 0x800f
+	attAttachTitle    = 0x8010
+	attAttachRendData = 0x9002
+	attMAPIProps      = 0x9003
+	attAttachment     = 0x9005
+)
+
+// MAPI property IDs
+const (
+	prBody               = 0x1000
+	prRTFCompressed      = 0x1009
+	prBodyHTML           = 0x1013
+	prAttachDataBin      = 0x3701
+	prAttachFilename     = 0x3704
+	prAttachLongFilename = 0x3707
+)
+
+// MAPI property types
+const (
+	ptShort    = 0x0002
+	ptLong     = 0x0003
+	ptFloat    = 0x0004
+	ptDouble   = 0x0005
+	ptCurrency = 0x0006
+	ptAppTime  = 0x0007
+	ptError    = 0x000a
+	ptBoolean  = 0x000b
+	ptObject   = 0x000d
+	ptI8       = 0x0014
+	ptString8  = 0x001e
+	ptUnicode  = 0x001f
+	ptSysTime  = 0x0040
+	ptCLSID    = 0x0048
+	ptBinary   = 0x0102
+	ptMulti    = 0x1000
+)
+
+var errNotTNEF = errors.New("not a TNEF stream")
+
+// tnefAttachment is a file contained in a TNEF stream
+type tnefAttachment struct {
+	Filename string
+	Data     []byte
+}
+
+// tnefMessage holds the parts of a TNEF stream we use
+type tnefMessage struct {
+	Body          string
+	HTML          string
+	RTFCompressed []byte
+	Attachments   []tnefAttachment
+}
+
+// isTNEF reports whether a MIME part is a TNEF stream, going by its
+// content type or the conventional winmail.dat filename
+func isTNEF(mediatype, filename string) bool {
+	return mediatype == "application/ms-tnef" ||
+		mediatype == "application/vnd.ms-tnef" ||
+		strings.EqualFold(filename, "winmail.dat")
+}
+
+// decodeTNEF parses a TNEF stream
+func decodeTNEF(data []byte) (*tnefMessage, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, errNotTNEF
+	}
+	m := &tnefMessage{}
+	var att *tnefAttachment
+	r := data[6:] // signature and legacy key
+	for len(r) > 0 {
+		if len(r) < 9 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		level := r[0]
+		id := binary.LittleEndian.Uint32(r[1:]) & 0xffff
+		n := binary.LittleEndian.Uint32(r[5:])
+		if uint64(n)+11 > uint64(len(r)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		val := r[9 : 9+n]
+		r = r[9+n+2:] // skip checksum
+
+		switch {
+		case id == attAttachRendData:
+			m.Attachments = append(m.Attachments, tnefAttachment{})
+			att = &m.Attachments[len(m.Attachments)-1]
+		case level == 2 && att != nil && id == attAttachTitle:
+			att.Filename = decodeString8(val)
+		case level == 2 && att != nil && id == attAttachData:
+			att.Data = val
+		case level == 2 && att != nil && id == attAttachment:
+			props, err := parseMAPIProps(val)
+			if err != nil {
+				return nil, fmt.Errorf("attachment properties: %w", err)
+			}
+			if v, ok := props[prAttachLongFilename]; ok {
+				att.Filename = v.String()
+			} else if v, ok := props[prAttachFilename]; ok && att.Filename == "" {
+				att.Filename = v.String()
+			}
+			if v, ok := props[prAttachDataBin]; ok && att.Data == nil {
+				att.Data = v.Data
+			}
+		case level == 1 && id == attBody:
+			m.Body = decodeString8(val)
+		case level == 1 && id == attMAPIProps:
+			props, err := parseMAPIProps(val)
+			if err != nil {
+				return nil, fmt.Errorf("message properties: %w", err)
+			}
+			if v, ok := props[prBody]; ok && m.Body == "" {
+				m.Body = v.String()
+			}
+			if v, ok := props[prBodyHTML]; ok {
+				m.HTML = v.String()
+			}
+			if v, ok := props[prRTFCompressed]; ok {
+				m.RTFCompressed = v.Data
+			}
+		}
+	}
+	return m, nil
+}
+
+// mapiValue is the (first) value of a MAPI property
+type mapiValue struct {
+	Type uint16
+	Data []byte
+}
+
+// String decodes a string or binary property value as text
+func (v mapiValue) String() string {
+	if v.Type == ptUnicode {
+		return decodeUTF16(v.Data)
+	}
+	return decodeString8(v.Data)
+}
+
+// parseMAPIProps parses an encoded MAPI property list, keyed by property
+// ID. Named properties are skipped.
+func parseMAPIProps(b []byte) (map[uint16]mapiValue, error) {
+	d := &tnefReader{b: b}
+	count := d.u32()
+	props := map[uint16]mapiValue{}
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		typ := uint16(d.u16())
+		id := uint16(d.u16())
+		if id >= 0x8000 {
+			// named property: GUID, then a numeric ID or a name
+			d.skip(16)
+			if kind := d.u32(); kind == 0 {
+				d.skip(4)
+			} else {
+				d.skip(pad4(d.u32()))
+			}
+		}
+		multi := typ&ptMulti != 0
+		base := typ &^ ptMulti
+		nvals := uint32(1)
+		if multi || base == ptString8 || base == ptUnicode || base == ptBinary || base == ptObject {
+			nvals = d.u32()
+		}
+		for j := uint32(0); j < nvals && d.err == nil; j++ {
+			var val []byte
+			switch base {
+			case ptShort, ptLong, ptFloat, ptError, ptBoolean:
+				val = d.bytes(4)
+			case ptDouble, ptCurrency, ptAppTime, ptI8, ptSysTime:
+				val = d.bytes(8)
+			case ptCLSID:
+				val = d.bytes(16)
+			case ptString8, ptUnicode, ptBinary, ptObject:
+				n := d.u32()
+				val = d.bytes(n)
+				d.skip(pad4(n) - n)
+			default:
+				return props, fmt.Errorf("unsupported MAPI property type 0x%04x", typ)
+			}
+			if j == 0 {
+				props[id] = mapiValue{Type: base, Data: val}
+			}
+		}
+	}
+	return props, d.err
+}
+
+// tnefReader reads little-endian values, recording the first short read
+type tnefReader struct {
+	b   []byte
+	err error
+}
+
+func (d *tnefReader) bytes(n uint32) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(d.b)) {
+		d.err = io.ErrUnexpectedEOF
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *tnefReader) skip(n uint32) { d.bytes(n) }
+
+func (d *tnefReader) u16() uint32 {
+	if v := d.bytes(2); v != nil {
+		return uint32(binary.LittleEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (d *tnefReader) u32() uint32 {
+	if v := d.bytes(4); v != nil {
+		return binary.LittleEndian.Uint32(v)
+	}
+	return 0
+}
+
+// pad4 rounds n up to a multiple of 4
+func pad4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// decodeString8 decodes a null-terminated 8-bit string, which Outlook
+// writes in the sender's Windows codepage (assumed to be Windows-1252)
+func decodeString8(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	cr, err := charset.NewReaderLabel("windows-1252", strings.NewReader(string(b)))
+	if err != nil {
+		return string(b)
+	}
+	out, err := io.ReadAll(cr)
+	if err != nil {
+		return string(b)
+	}
+	return string(out)
+}
+
+// decodeUTF16 decodes a null-terminated UTF-16LE string
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tnefEmail wraps a winmail.dat stream in an Exchange-style message with
+// a stub text part
+func tnefEmail(data []byte) string {
+	return "Content-Type: multipart/mixed; boundary=TNEF\r\n\r\n" +
+		"--TNEF\r\n" +
+		"Content-Type: text/plain; charset=us-ascii\r\n\r\n" +
+		"\r\n" +
+		"--TNEF\r\n" +
+		"Content-Type: application/ms-tnef; name=\"winmail.dat\"\r\n" +
+		"Content-Disposition: attachment; filename=\"winmail.dat\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(data) + "\r\n" +
+		"--TNEF--\r\n"
+}
+
+func mustWinmail(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "winmail.dat"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	return data
+}
+
+func TestDecodeTNEF(t *testing.T) {
+	m, err := decodeTNEF(mustWinmail(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(m.Body, "still failing after the update – log") {
+		t.Errorf("unexpected body: %q", m.Body)
+	}
+	if len(m.Attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(m.Attachments))
+	}
+	if m.Attachments[0].Filename != "job.log" || !strings.Contains(string(m.Attachments[0].Data), "oom-kill") {
+		t.Errorf("unexpected first attachment: %+v", m.Attachments[0])
+	}
+	if m.Attachments[1].Filename != "config.yaml" {
+		t.Errorf("unexpected second attachment: %+v", m.Attachments[1])
+	}
+
+	if _, err := decodeTNEF([]byte("PK\x03\x04")); err != errNotTNEF {
+		t.Errorf("expected errNotTNEF, got %v", err)
+	}
+}
+
+func TestExtractBodyAsMarkdown_TNEF(t *testing.T) {
+	data := mustWinmail(t)
+
+	got, err := extractBodyAsMarkdown(mustMessage(t, tnefEmail(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(got, "Hi team,") || !strings.HasSuffix(got, "Sam") {
+		t.Errorf("expected body from winmail.dat: %q", got)
+	}
+
+	atts, err := extractAttachments(mustMessage(t, tnefEmail(data)), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(atts) != 2 || atts[0].Filename != "job.log" || atts[1].Filename != "config.yaml" {
+		t.Errorf("expected attachments from winmail.dat: %+v", atts)
+	}
+}
+
+func TestExtractBodyAsMarkdown_TNEFUndecodable(t *testing.T) {
+	data := mustWinmail(t)[:100] // truncated
+	raw := strings.Replace(tnefEmail(data), "\r\n\r\n\r\n--TNEF", "\r\n\r\nSee attached\r\n--TNEF", 1)
+
+	got, err := extractBodyAsMarkdown(mustMessage(t, raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "See attached\n\n_A winmail.dat attachment could not be decoded._"
+	if got != want {
+		t.Errorf("unexpected body:\n--- got ---\n%q\n--- want ---\n%q", got, want)
+	}
+
+	atts, _ := extractAttachments(mustMessage(t, raw), 1<<20, 1<<20)
+	if len(atts) != 1 || atts[0].Filename != "winmail.dat" {
+		t.Errorf("expected undecodable winmail.dat to be listed: %+v", atts)
+	}
+}
@@ -0,0 +1,86 @@
+// Removes the one-line trailers that mail apps append to every message,
+// such as "Sent from my iPhone" and "Get Outlook for iOS"
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// trailerFormat anchors a trailer pattern to the whole line
+const trailerFormat = `(?i)^(?:%s)$`
+
+// defaultTrailers are the trailers of common mail apps, in the languages
+// of the reply headers in reply_headers.go
+var defaultTrailers = strings.Join([]string{
+	`Sent from my \w+(?: \w+){0,3}`,
+	`Sent (?:from|with) (?:Mail|Outlook) for (?:Windows(?: 1[01])?|Android|iOS)`,
+	`Sent from Yahoo Mail (?:for|on) (?:iPhone|iPad|Android)`,
+	`Get Outlook for (?:iOS|Android)`,
+	`Envoyé (?:de|depuis) mon \w+(?: \w+){0,3}`,
+	`Obtenir Outlook pour (?:iOS|Android)`,
+	`Von meinem \w+(?: \w+){0,3} gesendet`,
+	`Outlook für (?:iOS|Android) beziehen`,
+	`Enviado desde mi \w+(?: \w+){0,3}`,
+	`Obtener Outlook para (?:iOS|Android)`,
+	`Enviado do meu \w+(?: \w+){0,3}`,
+	`Inviato da(?:l mio)? \w+(?: \w+){0,3}`,
+	`(?:Verzonden|Verstuurd) (?:vanaf|met) mijn \w+(?: \w+){0,3}`,
+	`Skickat från min \w+(?: \w+){0,3}`,
+}, "\n")
+
+// markdownLinkRe matches a Markdown link, to compare a trailer by its text
+// ("Get [Outlook for iOS](https://aka.ms/o0ukef)")
+var markdownLinkRe = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+
+// trailerText is the text of a line with links and emphasis removed
+func trailerText(line string) string {
+	line = markdownLinkRe.ReplaceAllString(line, "$1")
+	return strings.Trim(strings.TrimSpace(line), `*_\`)
+}
+
+// parseTrailerPatterns compiles the default trailers and those of
+// TRAILER_PATTERNS, one per line, each matched against the whole line
+func parseTrailerPatterns(extra string) []*regexp.Regexp {
+	return parsePatterns("TRAILER_PATTERNS", defaultTrailers+"\n"+extra, trailerFormat)
+}
+
+// isTrailer reports whether a line is one of trailerPatterns
+func isTrailer(line string) bool {
+	text := trailerText(line)
+	for _, re := range trailerPatterns {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTrailers removes the trailers that are the last non-blank lines of
+// the visible text of a message. Trailers elsewhere in the text are kept,
+// as are those that are all there is to it, so that the comment is not
+// empty.
+func stripTrailers(text string) string {
+	lines := strings.Split(text, "\n")
+	inBlock := make([]bool, len(lines))
+	var st blockState
+	for i, line := range lines {
+		inBlock[i] = st.open()
+		st.scan(line)
+		inBlock[i] = inBlock[i] || st.open()
+	}
+	end := len(lines)
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		if inBlock[i] || !isTrailer(lines[i]) {
+			break
+		}
+		end = i
+	}
+	if end == len(lines) || nonBlankLines(lines[:end]) == 0 {
+		return text
+	}
+	return strings.TrimRight(strings.Join(lines[:end], "\n"), "\n")
+}
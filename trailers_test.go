@@ -0,0 +1,91 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestStripTrailers(t *testing.T) {
+	defer func(p []*regexp.Regexp) { trailerPatterns = p }(trailerPatterns)
+	tests := []struct {
+		name, extra, in, want string
+	}{
+		{
+			name: "iPhone",
+			in:   "The job ID is 123456.\n\nSent from my iPhone",
+			want: "The job ID is 123456.",
+		},
+		{
+			name: "Outlook link",
+			in:   "Thanks, that worked.\n\nGet [Outlook for iOS](https://aka.ms/o0ukef)\n",
+			want: "Thanks, that worked.",
+		},
+		{
+			name: "Mail for Windows and an iPad",
+			in:   "Thanks\n\nSent from [Mail](https://go.microsoft.com/fwlink/?LinkId=550986) for Windows\n\nSent from my iPad",
+			want: "Thanks",
+		},
+		{
+			name: "localized",
+			in:   "Merci beaucoup !\n\nEnvoyé de mon iPhone",
+			want: "Merci beaucoup !",
+		},
+		{
+			name: "German",
+			in:   "Danke\n\nVon meinem iPhone gesendet",
+			want: "Danke",
+		},
+		{
+			name: "mid-body",
+			in:   "The message says \"Sent from my iPhone\" and then:\n\nSent from my iPhone\n\nthe upload fails.",
+			want: "The message says \"Sent from my iPhone\" and then:\n\nSent from my iPhone\n\nthe upload fails.",
+		},
+		{
+			name: "only a trailer",
+			in:   "Sent from my iPhone",
+			want: "Sent from my iPhone",
+		},
+		{
+			name: "in a code block",
+			in:   "The log ends with\n\n```\nSent from my iPhone\n```",
+			want: "The log ends with\n\n```\nSent from my iPhone\n```",
+		},
+		{
+			name: "longer sentence",
+			in:   "Thanks\n\nSent from my iPhone while on the train to the office, sorry for typos",
+			want: "Thanks\n\nSent from my iPhone while on the train to the office, sorry for typos",
+		},
+		{
+			name:  "extra pattern",
+			extra: "Sent via BlackBerry from \\w+",
+			in:    "Thanks\n\nSent via BlackBerry from Vodafone",
+			want:  "Thanks",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trailerPatterns = parseTrailerPatterns(tc.extra)
+			if got := stripTrailers(tc.in); got != tc.want {
+				t.Errorf("stripTrailers(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitQuoted_Trailers(t *testing.T) {
+	quote := "On Tue, 18 Mar 2025 at 17:03, Research Computing <support@example.ac.uk> wrote:\n> Please try again."
+	tests := []struct {
+		name, md, want string
+	}{
+		{"top-posted", "Still failing.\n\nSent from my iPhone\n\n" + quote, "Still failing."},
+		{"bottom-posted", quote + "\n\nStill failing.\n\nGet Outlook for Android", "Still failing."},
+		{"only a trailer", "Sent from my iPhone\n\n" + quote, "Sent from my iPhone"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := SplitQuoted(tc.md, defaultQuoteOptions()).Visible; got != tc.want {
+				t.Errorf("Visible = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}